@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// defaultBackground is the color transparent images are flattened onto by default
+var defaultBackground = color.NRGBA{255, 255, 255, 255}
+
+// ParseColor parses a hexadecimal color as "rgb", "rgba", "rrggbb" or "rrggbbaa",
+// optionally prefixed with "#". Colors without alpha are opaque.
+func ParseColor(value string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(value, "#")
+	if len(hex) == 3 || len(hex) == 4 {
+		// Expand shorthand such as "f80" to "ff8800"
+		var expanded strings.Builder
+		for _, c := range hex {
+			expanded.WriteRune(c)
+			expanded.WriteRune(c)
+		}
+		hex = expanded.String()
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 8 || err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color: %s", value)
+	}
+	return color.NRGBA{uint8(n >> 24), uint8(n >> 16), uint8(n >> 8), uint8(n)}, nil
+}
+
+// Flatten returns img composited over an opaque background, for encoding in formats
+// without an alpha channel. Any alpha of background is ignored.
+func Flatten(img image.Image, background color.Color) *image.RGBA {
+	c := color.NRGBAModel.Convert(background).(color.NRGBA)
+	c.A = 255
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rectangle{Max: bounds.Size()})
+	draw.Draw(dst, dst.Rect, image.NewUniform(c), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Rect, img, bounds.Min, draw.Over)
+	return dst
+}
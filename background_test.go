@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseColor(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected color.NRGBA
+		err      bool
+	}{
+		{value: "#ff8000", expected: color.NRGBA{255, 128, 0, 255}},
+		{value: "FF8000", expected: color.NRGBA{255, 128, 0, 255}},
+		{value: "#f80", expected: color.NRGBA{255, 136, 0, 255}},
+		{value: "f808", expected: color.NRGBA{255, 136, 0, 136}},
+		{value: "#ff800080", expected: color.NRGBA{255, 128, 0, 128}},
+		{value: "", err: true},
+		{value: "#ff80", expected: color.NRGBA{255, 255, 136, 0}},
+		{value: "#ff80000", err: true},
+		{value: "white", err: true},
+		{value: "#gg0000", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			c, err := ParseColor(tt.value)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, c)
+		})
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(2, 2, 5, 3))
+	img.SetNRGBA(2, 2, color.NRGBA{0, 0, 255, 255})
+	img.SetNRGBA(3, 2, color.NRGBA{0, 0, 255, 128})
+
+	flat := Flatten(img, color.NRGBA{255, 0, 0, 0})
+	assert.Equal(t, image.Rect(0, 0, 3, 1), flat.Bounds())
+	assert.True(t, flat.Opaque())
+	assert.Equal(t, color.RGBA{0, 0, 255, 255}, flat.RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{127, 0, 128, 255}, flat.RGBAAt(1, 0))
+	assert.Equal(t, color.RGBA{255, 0, 0, 255}, flat.RGBAAt(2, 0))
+}
+
+// circleImage returns a transparent image holding an opaque red disc with
+// anti-aliased edges.
+func circleImage(size int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	center := float64(size) / 2
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			dx, dy := float64(x)+0.5-center, float64(y)+0.5-center
+			coverage := max(0, min(1, center*0.8-math.Hypot(dx, dy)+0.5))
+			img.SetNRGBA(x, y, color.NRGBA{255, 0, 0, uint8(coverage * 255)})
+		}
+	}
+	return img
+}
+
+func TestFlattenJPEG(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, circleImage(100)))
+	data := buf.Bytes()
+
+	tests := []struct {
+		name       string
+		query      string
+		background color.RGBA
+	}{
+		{name: "Default background", query: "format=jpeg", background: color.RGBA{255, 255, 255, 255}},
+		{name: "Custom background", query: "format=jpeg&background=%23ff00ff", background: color.RGBA{255, 0, 255, 255}},
+		{name: "Resized", query: "format=jpeg&width=37&height=37&background=ffff00", background: color.RGBA{255, 255, 0, 255}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := "/convert?"
+			handler := Handler(HandleConvert)
+			if tt.name == "Resized" {
+				path = "/resize?"
+				handler = Handler(HandleResize)
+			}
+			req := httptest.NewRequest(http.MethodPost, path+tt.query, bytes.NewReader(data))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusOK, rr.Code)
+
+			img, err := jpeg.Decode(rr.Body)
+			assert.NoError(t, err)
+			r, g, b, _ := img.At(0, 0).RGBA()
+			assert.InDelta(t, tt.background.R, r>>8, 12)
+			assert.InDelta(t, tt.background.G, g>>8, 12)
+			assert.InDelta(t, tt.background.B, b>>8, 12)
+
+			// The red channel of both the disc and the background is full, so it stays
+			// full unless the edges are darkened, apart from chroma subsampling
+			bounds := img.Bounds()
+			sum := 0.0
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					r, _, _, _ := img.At(x, y).RGBA()
+					sum += float64(r >> 8)
+				}
+			}
+			assert.Greater(t, sum/float64(bounds.Dx()*bounds.Dy()), 240.0)
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/convert?format=jpeg&background=blue", bytes.NewReader(data))
+	rr := httptest.NewRecorder()
+	Handler(HandleConvert).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestResizeImageAlphaEdges(t *testing.T) {
+	// Scaling is premultiplied, so transparent pixels do not bleed their color
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+	draw.Draw(img, image.Rect(0, 0, 20, 40), image.NewUniform(color.NRGBA{255, 255, 255, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(20, 0, 40, 40), image.NewUniform(color.NRGBA{0, 0, 0, 0}), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, img))
+
+	data, err := ResizeImage(context.Background(), &buf, 13, 13)
+	assert.NoError(t, err)
+	resized, err := png.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	for x := 0; x < 13; x++ {
+		c := color.NRGBAModel.Convert(resized.At(x, 6)).(color.NRGBA)
+		if c.A > 16 {
+			assert.GreaterOrEqual(t, c.R, uint8(240), "x = %d", x)
+		}
+	}
+}
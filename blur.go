@@ -0,0 +1,264 @@
+package main
+
+import (
+	"image"
+	"math"
+	"runtime"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// maxBlurSigma is the largest standard deviation of Gaussian blurs and unsharp masks
+	maxBlurSigma = 100
+	// maxBoxBlurRadius is the largest radius of box blurs
+	maxBoxBlurRadius = 300
+	// maxSharpenAmount is the largest amount of unsharp masks
+	maxSharpenAmount = 10
+	// defaultSharpenRadius is the standard deviation of the blur unsharp masks subtract
+	defaultSharpenRadius = 1
+	// minParallelPixels is the smallest image whose rows are filtered in parallel
+	minParallelPixels = 256 * 256
+	// minBoxGaussianSigma is the smallest standard deviation of Gaussian blurs that are
+	// approximated with repeated box blurs instead of convolved with a Gaussian kernel
+	minBoxGaussianSigma = 10
+	// gaussianBoxPasses is the number of box blurs that approximate a Gaussian blur
+	gaussianBoxPasses = 3
+)
+
+// toRGBA returns img as an *image.RGBA with its origin at zero, copying it if needed.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	rgba := image.NewRGBA(image.Rectangle{Max: img.Bounds().Size()})
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
+
+// GaussianBlur returns img blurred with a Gaussian of standard deviation sigma. The
+// blur is separable and works on premultiplied colors, so transparent pixels do not
+// bleed their color into their neighbors. Pixels beyond the edges repeat the edges.
+// Blurs of at least minBoxGaussianSigma are approximated with repeated box blurs,
+// whose cost does not grow with sigma.
+func GaussianBlur(img image.Image, sigma float64) *image.RGBA {
+	src := toRGBA(img)
+	if sigma <= 0 {
+		return src
+	}
+	if sigma >= minBoxGaussianSigma {
+		for _, radius := range gaussianBoxRadii(sigma, gaussianBoxPasses) {
+			src = boxBlur(src, radius)
+		}
+		return src
+	}
+	kernel := gaussianKernel(int(math.Ceil(3*sigma)), sigma)
+	return convolve(src, kernel)
+}
+
+// gaussianBoxRadii returns the radii of n successive box blurs whose combined
+// variance is as close as possible to that of a Gaussian of standard deviation sigma.
+func gaussianBoxRadii(sigma float64, n int) []int {
+	// The variance of a box of width w is (w*w-1)/12, and variances add up
+	variance := 12 * sigma * sigma
+	lower := int(math.Sqrt(variance/float64(n) + 1))
+	if lower%2 == 0 {
+		lower--
+	}
+	// The first m boxes have the lower width and the others are 2 pixels wider
+	m := int(math.Round((variance - float64(n*lower*lower+4*n*lower+3*n)) / float64(-4*lower-4)))
+	radii := make([]int, n)
+	for i := range radii {
+		width := lower
+		if i >= m {
+			width += 2
+		}
+		radii[i] = width / 2
+	}
+	return radii
+}
+
+// BoxBlur returns img blurred with a box of the given radius, which averages each
+// pixel with the pixels up to radius pixels away horizontally and vertically. Like
+// GaussianBlur, it works on premultiplied colors and repeats the edges. The cost per
+// pixel does not depend on the radius.
+func BoxBlur(img image.Image, radius int) *image.RGBA {
+	src := toRGBA(img)
+	if radius <= 0 {
+		return src
+	}
+	return boxBlur(src, radius)
+}
+
+// UnsharpMask returns img sharpened by adding amount times the difference between img
+// and img blurred with a Gaussian of standard deviation radius. Channels that differ
+// from the blurred image by at most threshold are left unchanged, which keeps noise in
+// flat areas from being amplified. The alpha channel is kept.
+func UnsharpMask(img image.Image, amount, radius float64, threshold int) *image.RGBA {
+	src := toRGBA(img)
+	if amount <= 0 || radius <= 0 {
+		return src
+	}
+	blurred := GaussianBlur(src, radius)
+
+	bounds := src.Bounds()
+	dst := image.NewRGBA(bounds)
+	parallelRows(bounds.Dx(), bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				i, j, k := src.PixOffset(x, y), blurred.PixOffset(x, y), dst.PixOffset(x, y)
+				alpha := src.Pix[i+3]
+				for c := 0; c < 3; c++ {
+					v := src.Pix[i+c]
+					diff := int(v) - int(blurred.Pix[j+c])
+					if diff > threshold || -diff > threshold {
+						// Premultiplied channels cannot exceed the alpha
+						v = uint8(max(0, min(float64(alpha), float64(v)+amount*float64(diff)+0.5)))
+					}
+					dst.Pix[k+c] = v
+				}
+				dst.Pix[k+3] = alpha
+			}
+		}
+	})
+	return dst
+}
+
+// convolve returns src convolved with kernel horizontally and then vertically. The
+// rows of large images are convolved in parallel.
+func convolve(src *image.RGBA, kernel []float64) *image.RGBA {
+	bounds := src.Bounds()
+	if bounds.Empty() {
+		return src
+	}
+	width, height := bounds.Dx(), bounds.Dy()
+	radius := len(kernel) / 2
+
+	tmp := image.NewRGBA(bounds)
+	parallelRows(width, height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < width; x++ {
+				var sum [4]float64
+				for k, weight := range kernel {
+					i := src.PixOffset(min(max(x+k-radius, 0), width-1), y)
+					for c := range sum {
+						sum[c] += weight * float64(src.Pix[i+c])
+					}
+				}
+				setPix(tmp.Pix[tmp.PixOffset(x, y):], sum)
+			}
+		}
+	})
+
+	dst := image.NewRGBA(bounds)
+	parallelRows(width, height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < width; x++ {
+				var sum [4]float64
+				for k, weight := range kernel {
+					i := tmp.PixOffset(x, min(max(y+k-radius, 0), height-1))
+					for c := range sum {
+						sum[c] += weight * float64(tmp.Pix[i+c])
+					}
+				}
+				setPix(dst.Pix[dst.PixOffset(x, y):], sum)
+			}
+		}
+	})
+	return dst
+}
+
+// boxBlur returns src blurred with a box of the given radius horizontally and then
+// vertically. Each pass keeps a running sum of the pixels within the box, which is
+// updated with the pixel entering the box and the pixel leaving it as the box moves.
+func boxBlur(src *image.RGBA, radius int) *image.RGBA {
+	bounds := src.Bounds()
+	if bounds.Empty() {
+		// There are no edge pixels to repeat
+		return src
+	}
+	width, height := bounds.Dx(), bounds.Dy()
+	size := 2*radius + 1
+
+	tmp := image.NewRGBA(bounds)
+	parallelRows(width, height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := src.Pix[src.PixOffset(0, y):]
+			at := func(x int) []uint8 {
+				i := 4 * min(max(x, 0), width-1)
+				return row[i : i+4]
+			}
+			var sum [4]int
+			for x := -radius; x <= radius; x++ {
+				for c, v := range at(x) {
+					sum[c] += int(v)
+				}
+			}
+			out := tmp.Pix[tmp.PixOffset(0, y):]
+			for x := 0; x < width; x++ {
+				for c := range sum {
+					out[4*x+c] = uint8((sum[c] + size/2) / size)
+				}
+				in, left := at(x+radius+1), at(x-radius)
+				for c := range sum {
+					sum[c] += int(in[c]) - int(left[c])
+				}
+			}
+		}
+	})
+
+	dst := image.NewRGBA(bounds)
+	parallelRows(width, height, func(y0, y1 int) {
+		row := func(y int) []uint8 {
+			i := tmp.PixOffset(0, min(max(y, 0), height-1))
+			return tmp.Pix[i : i+4*width]
+		}
+		// One running sum per channel of every column
+		sums := make([]int, 4*width)
+		for y := y0 - radius; y <= y0+radius; y++ {
+			for i, v := range row(y) {
+				sums[i] += int(v)
+			}
+		}
+		for y := y0; y < y1; y++ {
+			out := dst.Pix[dst.PixOffset(0, y):]
+			for i, sum := range sums {
+				out[i] = uint8((sum + size/2) / size)
+			}
+			in, top := row(y+radius+1), row(y-radius)
+			for i := range sums {
+				sums[i] += int(in[i]) - int(top[i])
+			}
+		}
+	})
+	return dst
+}
+
+// parallelRows calls fn with consecutive ranges of rows [y0, y1) that together cover
+// height rows of width pixels. Images of at least minParallelPixels pixels are split
+// into one range per CPU, which are processed concurrently.
+func parallelRows(width, height int, fn func(y0, y1 int)) {
+	workers := min(runtime.GOMAXPROCS(0), height)
+	if width*height < minParallelPixels || workers < 2 {
+		fn(0, height)
+		return
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		y0, y1 := height*i/workers, height*(i+1)/workers
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(y0, y1)
+		}()
+	}
+	wg.Wait()
+}
+
+// setPix stores the premultiplied color sum in pix, rounding and clamping each channel.
+func setPix(pix []uint8, sum [4]float64) {
+	for c, v := range sum {
+		pix[c] = uint8(max(0, min(255, v+0.5)))
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGaussianBlur(t *testing.T) {
+	// Left half black, right half white
+	step := solidImage(20, 10, color.Black)
+	draw.Draw(step, image.Rect(10, 0, 20, 10), image.White, image.Point{}, draw.Src)
+
+	// Opaque red square on a transparent background
+	transparent := image.NewRGBA(image.Rect(0, 0, 20, 20))
+	draw.Draw(transparent, image.Rect(5, 5, 15, 15), image.NewUniform(color.RGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+
+	t.Run("Zero sigma keeps the image", func(t *testing.T) {
+		assert.Equal(t, step.Pix, GaussianBlur(step, 0).Pix)
+	})
+
+	t.Run("Uniform image stays uniform", func(t *testing.T) {
+		img := solidImage(10, 10, color.RGBA{10, 20, 30, 255})
+		assert.Equal(t, img.Pix, GaussianBlur(img, 2).Pix)
+	})
+
+	t.Run("Edges are smoothed", func(t *testing.T) {
+		blurred := GaussianBlur(step, 1.5)
+		assert.Equal(t, step.Bounds(), blurred.Bounds())
+		assert.Equal(t, uint8(0), blurred.RGBAAt(0, 5).R)
+		assert.Equal(t, uint8(255), blurred.RGBAAt(19, 5).R)
+		assert.Greater(t, blurred.RGBAAt(9, 5).R, uint8(0))
+		assert.Less(t, blurred.RGBAAt(10, 5).R, uint8(255))
+		for x := 1; x < 20; x++ {
+			assert.GreaterOrEqual(t, blurred.RGBAAt(x, 5).R, blurred.RGBAAt(x-1, 5).R)
+		}
+	})
+
+	t.Run("Transparent pixels do not bleed", func(t *testing.T) {
+		blurred := GaussianBlur(transparent, 2)
+		edge := color.NRGBAModel.Convert(blurred.At(4, 10)).(color.NRGBA)
+		assert.Greater(t, edge.A, uint8(0))
+		assert.Equal(t, color.NRGBA{255, 0, 0, edge.A}, edge)
+	})
+
+	t.Run("Offset bounds", func(t *testing.T) {
+		sub := step.SubImage(image.Rect(5, 2, 15, 8))
+		blurred := GaussianBlur(sub, 1)
+		assert.Equal(t, image.Rect(0, 0, 10, 6), blurred.Bounds())
+	})
+}
+
+func TestBoxBlur(t *testing.T) {
+	// Single white pixel in a black row
+	dot := solidImage(9, 1, color.Black)
+	dot.Set(4, 0, color.White)
+
+	t.Run("Zero radius keeps the image", func(t *testing.T) {
+		assert.Equal(t, dot.Pix, BoxBlur(dot, 0).Pix)
+	})
+
+	t.Run("Uniform image stays uniform", func(t *testing.T) {
+		img := solidImage(10, 10, color.RGBA{10, 20, 30, 255})
+		assert.Equal(t, img.Pix, BoxBlur(img, 3).Pix)
+	})
+
+	t.Run("Averages within the radius", func(t *testing.T) {
+		blurred := BoxBlur(dot, 1)
+		for x, expected := range []uint8{0, 0, 0, 85, 85, 85, 0, 0, 0} {
+			assert.Equal(t, expected, blurred.RGBAAt(x, 0).R, "pixel %d", x)
+		}
+	})
+
+	// Large enough to be blurred in parallel
+	pattern := image.NewRGBA(image.Rect(0, 0, 300, 260))
+	for i := range pattern.Pix {
+		pattern.Pix[i] = uint8(i * 7919 % 256)
+	}
+	for i := 3; i < len(pattern.Pix); i += 4 {
+		pattern.Pix[i] = 255
+	}
+
+	tests := []struct {
+		name   string
+		img    *image.RGBA
+		radius int
+	}{
+		{name: "Small radius", img: pattern, radius: 1},
+		{name: "Large radius", img: pattern, radius: 20},
+		// Boxes wider than the image repeat its edges
+		{name: "Radius beyond the edges", img: pattern.SubImage(image.Rect(0, 0, 30, 20)).(*image.RGBA), radius: 40},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kernel := make([]float64, 2*tt.radius+1)
+			for i := range kernel {
+				kernel[i] = 1 / float64(len(kernel))
+			}
+			expected := convolve(toRGBA(tt.img), kernel)
+			blurred := BoxBlur(tt.img, tt.radius)
+			for i := range expected.Pix {
+				if !assert.InDelta(t, expected.Pix[i], blurred.Pix[i], 1, "byte %d", i) {
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestGaussianBlurBoxes(t *testing.T) {
+	for _, sigma := range []float64{minBoxGaussianSigma, 37.5, maxBlurSigma} {
+		variance := 0.0
+		for _, radius := range gaussianBoxRadii(sigma, gaussianBoxPasses) {
+			width := float64(2*radius + 1)
+			variance += (width*width - 1) / 12
+		}
+		assert.InDelta(t, sigma*sigma, variance, sigma*sigma*0.05, "sigma %v", sigma)
+	}
+
+	// Left half black, right half white
+	step := solidImage(200, 4, color.Black)
+	draw.Draw(step, image.Rect(100, 0, 200, 4), image.White, image.Point{}, draw.Src)
+	sigma := 2.0 * minBoxGaussianSigma
+	expected := convolve(step, gaussianKernel(int(math.Ceil(3*sigma)), sigma))
+	blurred := GaussianBlur(step, sigma)
+	for x := 0; x < 200; x++ {
+		assert.InDelta(t, expected.RGBAAt(x, 2).R, blurred.RGBAAt(x, 2).R, 4, "pixel %d", x)
+	}
+}
+
+func TestUnsharpMask(t *testing.T) {
+	// Left half dark grey, right half light grey
+	step := solidImage(20, 10, color.RGBA{64, 64, 64, 255})
+	draw.Draw(step, image.Rect(10, 0, 20, 10), image.NewUniform(color.RGBA{192, 192, 192, 255}), image.Point{}, draw.Src)
+
+	t.Run("Zero amount keeps the image", func(t *testing.T) {
+		assert.Equal(t, step.Pix, UnsharpMask(step, 0, 1, 0).Pix)
+	})
+
+	t.Run("Uniform image stays uniform", func(t *testing.T) {
+		img := solidImage(10, 10, color.RGBA{10, 20, 30, 255})
+		assert.Equal(t, img.Pix, UnsharpMask(img, 2, 1, 0).Pix)
+	})
+
+	t.Run("Edges are enhanced", func(t *testing.T) {
+		sharpened := UnsharpMask(step, 1, 1, 0)
+		assert.Less(t, sharpened.RGBAAt(9, 5).R, uint8(64))
+		assert.Greater(t, sharpened.RGBAAt(10, 5).R, uint8(192))
+		assert.Equal(t, uint8(64), sharpened.RGBAAt(0, 5).R)
+		assert.Equal(t, uint8(192), sharpened.RGBAAt(19, 5).R)
+		assert.Equal(t, uint8(255), sharpened.RGBAAt(9, 5).A)
+	})
+
+	t.Run("Threshold keeps small differences", func(t *testing.T) {
+		assert.Equal(t, step.Pix, UnsharpMask(step, 1, 1, 128).Pix)
+	})
+
+	t.Run("Channels stay within the alpha", func(t *testing.T) {
+		translucent := image.NewRGBA(image.Rect(0, 0, 20, 10))
+		draw.Draw(translucent, image.Rect(10, 0, 20, 10), image.NewUniform(color.NRGBA{255, 255, 255, 128}), image.Point{}, draw.Src)
+		sharpened := UnsharpMask(translucent, 5, 2, 0)
+		for i := 0; i < len(sharpened.Pix); i += 4 {
+			a := sharpened.Pix[i+3]
+			assert.Equal(t, translucent.Pix[i+3], a)
+			for c := 0; c < 3; c++ {
+				assert.LessOrEqual(t, sharpened.Pix[i+c], a)
+			}
+		}
+	})
+}
+
+func TestParallelRows(t *testing.T) {
+	for _, size := range []image.Point{{10, 10}, {1000, 300}, {100000, 3}} {
+		var mu sync.Mutex
+		seen := make([]int, size.Y)
+		parallelRows(size.X, size.Y, func(y0, y1 int) {
+			mu.Lock()
+			defer mu.Unlock()
+			for y := y0; y < y1; y++ {
+				seen[y]++
+			}
+		})
+		for y, n := range seen {
+			assert.Equal(t, 1, n, "row %d of %v", y, size)
+		}
+	}
+
+	// Large images are filtered in parallel with the same result as small ones
+	img := photoImage(600, 400)
+	blurred := GaussianBlur(img, 2)
+	tile := GaussianBlur(img.SubImage(image.Rect(0, 0, 100, 100)), 2)
+	for y := 0; y < 90; y++ {
+		for x := 0; x < 90; x++ {
+			assert.Equal(t, tile.RGBAAt(x, y), blurred.RGBAAt(x, y))
+		}
+	}
+}
+
+func TestParseOptionsFilters(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		err      bool
+		expected Options
+	}{
+		{name: "No filters", query: ""},
+		{name: "Blur", query: "blur=2.5", expected: Options{Blur: 2.5}},
+		{name: "Box blur", query: "box_blur=3", expected: Options{BoxBlur: 3}},
+		{name: "Sharpen defaults", query: "sharpen=1.5", expected: Options{Sharpen: 1.5, SharpenRadius: 1}},
+		{
+			name:     "Sharpen",
+			query:    "sharpen=0.8&sharpen_radius=2&sharpen_threshold=4",
+			expected: Options{Sharpen: 0.8, SharpenRadius: 2, SharpenThreshold: 4},
+		},
+		{name: "Sharpen options without sharpen", query: "sharpen_radius=2"},
+		{name: "Invalid blur", query: "blur=soft", err: true},
+		{name: "Negative blur", query: "blur=-1", err: true},
+		{name: "Huge blur", query: "blur=1000", err: true},
+		{name: "Invalid box blur", query: "box_blur=1.5", err: true},
+		{name: "Huge box blur", query: "box_blur=1000", err: true},
+		{name: "Invalid sharpen", query: "sharpen=much", err: true},
+		{name: "Huge sharpen", query: "sharpen=50", err: true},
+		{name: "Zero sharpen radius", query: "sharpen=1&sharpen_radius=0", err: true},
+		{name: "Invalid sharpen threshold", query: "sharpen=1&sharpen_threshold=300", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/resize?"+tt.query, nil)
+			opts, err := ParseOptions(req)
+			assert.Equal(t, tt.err, err != nil)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, &tt.expected, newOptions(opts))
+		})
+	}
+}
+
+func TestBlurEmptyImage(t *testing.T) {
+	for _, img := range []*image.RGBA{image.NewRGBA(image.Rect(0, 0, 0, 10)), image.NewRGBA(image.Rect(0, 0, 10, 0))} {
+		for name, blur := range map[string]func(image.Image) *image.RGBA{
+			"Gaussian":       func(img image.Image) *image.RGBA { return GaussianBlur(img, 2) },
+			"Large Gaussian": func(img image.Image) *image.RGBA { return GaussianBlur(img, minBoxGaussianSigma) },
+			"Box":            func(img image.Image) *image.RGBA { return BoxBlur(img, 2) },
+			"Unsharp mask":   func(img image.Image) *image.RGBA { return UnsharpMask(img, 1, 2, 0) },
+		} {
+			assert.NotPanics(t, func() {
+				assert.True(t, blur(img).Bounds().Empty(), name)
+			}, name)
+		}
+	}
+
+	// Empty derivatives are rejected before they are blurred
+	req := httptest.NewRequest(http.MethodPost, "/resize?width=0&height=10&box_blur=2", bytes.NewReader(createImage(t, "png")))
+	rr := httptest.NewRecorder()
+	Handler(HandleResize).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// ErrInvalidHash is returned when a placeholder hash cannot be decoded
+var ErrInvalidHash = fmt.Errorf("invalid hash")
+
+const (
+	// base83Digits are the digits of the base 83 encoding used by BlurHash
+	base83Digits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+	// maxBlurHashComponents is the largest number of components along each axis
+	maxBlurHashComponents = 9
+)
+
+// BlurHash returns the BlurHash of img with xComponents horizontal and yComponents
+// vertical components, each between 1 and 9.
+func BlurHash(img image.Image, xComponents, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > maxBlurHashComponents || yComponents < 1 || yComponents > maxBlurHashComponents {
+		return "", fmt.Errorf("invalid components: %dx%d", xComponents, yComponents)
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			linear[y*width+x] = [3]float64{srgbToLinear(r >> 8), srgbToLinear(g >> 8), srgbToLinear(b >> 8)}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalization := 2.0
+			if i == 0 && j == 0 {
+				normalization = 1
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				fy := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for x := 0; x < width; x++ {
+					basis := fy * math.Cos(math.Pi*float64(i)*float64(x)/float64(width))
+					for c := range factor {
+						factor[c] += basis * linear[y*width+x][c]
+					}
+				}
+			}
+			for c := range factor {
+				factor[c] *= normalization / float64(width*height)
+			}
+			factors = append(factors, factor)
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((xComponents-1)+(yComponents-1)*9, 1))
+
+	maximum := 1.0
+	if len(factors) > 1 {
+		actual := 0.0
+		for _, factor := range factors[1:] {
+			for _, v := range factor {
+				actual = max(actual, math.Abs(v))
+			}
+		}
+		quantized := int(max(0, min(82, math.Floor(actual*166-0.5))))
+		maximum = float64(quantized+1) / 166
+		hash.WriteString(encodeBase83(quantized, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	dc := factors[0]
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4))
+	for _, factor := range factors[1:] {
+		value := 0
+		for _, v := range factor {
+			quantized := int(max(0, min(18, math.Floor(signPow(v/maximum, 0.5)*9+9.5))))
+			value = value*19 + quantized
+		}
+		hash.WriteString(encodeBase83(value, 2))
+	}
+	return hash.String(), nil
+}
+
+// DecodeBlurHash renders hash as a width by height image. punch scales the contrast
+// of the image; 1 renders it as encoded. It returns ErrInvalidHash if hash is malformed.
+func DecodeBlurHash(hash string, width, height int, punch float64) (*image.NRGBA, error) {
+	if len(hash) < 6 {
+		return nil, ErrInvalidHash
+	}
+	sizeFlag, err := decodeBase83(hash[:1])
+	if err != nil {
+		return nil, err
+	}
+	xComponents, yComponents := sizeFlag%9+1, sizeFlag/9+1
+	if len(hash) != 4+2*xComponents*yComponents {
+		return nil, ErrInvalidHash
+	}
+
+	quantized, err := decodeBase83(hash[1:2])
+	if err != nil {
+		return nil, err
+	}
+	maximum := float64(quantized+1) / 166
+
+	colors := make([][3]float64, xComponents*yComponents)
+	for i := range colors {
+		if i == 0 {
+			value, err := decodeBase83(hash[2:6])
+			if err != nil {
+				return nil, err
+			}
+			colors[i] = [3]float64{srgbToLinear(uint32(value >> 16 & 255)), srgbToLinear(uint32(value >> 8 & 255)), srgbToLinear(uint32(value & 255))}
+			continue
+		}
+		value, err := decodeBase83(hash[4+i*2 : 6+i*2])
+		if err != nil {
+			return nil, err
+		}
+		for c, q := range [3]int{value / (19 * 19), value / 19 % 19, value % 19} {
+			colors[i][c] = signPow(float64(q-9)/9, 2) * maximum * punch
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var pixel [3]float64
+			for j := 0; j < yComponents; j++ {
+				fy := math.Cos(math.Pi * float64(y) * float64(j) / float64(height))
+				for i := 0; i < xComponents; i++ {
+					basis := fy * math.Cos(math.Pi*float64(x)*float64(i)/float64(width))
+					for c := range pixel {
+						pixel[c] += colors[j*xComponents+i][c] * basis
+					}
+				}
+			}
+			img.SetNRGBA(x, y, color.NRGBA{uint8(linearToSRGB(pixel[0])), uint8(linearToSRGB(pixel[1])), uint8(linearToSRGB(pixel[2])), 255})
+		}
+	}
+	return img, nil
+}
+
+// encodeBase83 returns value as length base 83 digits.
+func encodeBase83(value, length int) string {
+	digits := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		digits[i] = base83Digits[value%83]
+		value /= 83
+	}
+	return string(digits)
+}
+
+// decodeBase83 returns the value of the base 83 digits in s.
+func decodeBase83(s string) (int, error) {
+	value := 0
+	for i := 0; i < len(s); i++ {
+		digit := strings.IndexByte(base83Digits, s[i])
+		if digit < 0 {
+			return 0, ErrInvalidHash
+		}
+		value = value*83 + digit
+	}
+	return value, nil
+}
+
+// srgbToLinear converts an 8-bit sRGB value to linear light between 0 and 1.
+func srgbToLinear(value uint32) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB converts linear light to an 8-bit sRGB value, clamping it to 0–255.
+func linearToSRGB(value float64) int {
+	v := max(0, min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// signPow raises the magnitude of value to exp, keeping its sign.
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// solidImage returns a width by height image filled with c.
+func solidImage(width, height int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestBlurHash(t *testing.T) {
+	red := solidImage(20, 10, color.RGBA{255, 0, 0, 255})
+
+	tests := []struct {
+		name     string
+		img      image.Image
+		x, y     int
+		expected string
+		err      bool
+	}{
+		{name: "Reference", img: patternImage(true), x: 4, y: 3, expected: "L#HU?[2lwtX3l[WUjvfAgFflfTfk"},
+		{name: "Many components", img: patternImage(true), x: 5, y: 2, expected: "D#HU?[2lwtX3jrl[WUjvfAfS"},
+		{name: "Single component", img: red, x: 1, y: 1, expected: "00" + encodeBase83(0xff0000, 4)},
+		{name: "Too few components", img: red, x: 0, y: 1, err: true},
+		{name: "Too many components", img: red, x: 4, y: 10, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, err := BlurHash(tt.img, tt.x, tt.y)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, hash)
+		})
+	}
+}
+
+func TestDecodeBlurHash(t *testing.T) {
+	// Left half black, right half white
+	img := solidImage(40, 20, color.Black)
+	draw.Draw(img, image.Rect(20, 0, 40, 20), image.White, image.Point{}, draw.Src)
+	hash, err := BlurHash(img, 4, 3)
+	assert.NoError(t, err)
+	assert.Len(t, hash, 4+2*4*3)
+
+	decoded, err := DecodeBlurHash(hash, 32, 16, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 32, 16), decoded.Bounds())
+	left, right := decoded.NRGBAAt(2, 8), decoded.NRGBAAt(29, 8)
+	assert.Greater(t, int(right.R)-int(left.R), 100)
+	assert.Equal(t, left.R, left.G)
+	assert.Equal(t, uint8(255), left.A)
+
+	// Solid images keep their color
+	hash, err = BlurHash(solidImage(20, 10, color.RGBA{255, 0, 0, 255}), 3, 3)
+	assert.NoError(t, err)
+	decoded, err = DecodeBlurHash(hash, 20, 10, 1)
+	assert.NoError(t, err)
+	center := decoded.NRGBAAt(10, 5)
+	assert.InDelta(t, 255, center.R, 16)
+	assert.InDelta(t, 0, center.G, 16)
+
+	// Solid colors survive the round trip
+	decoded, err = DecodeBlurHash("00"+encodeBase83(0x336699, 4), 4, 4, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, color.NRGBA{0x33, 0x66, 0x99, 255}, decoded.NRGBAAt(1, 1))
+
+	for _, invalid := range []string{"", "00", "00000", "10" + encodeBase83(0, 4), "00\x00000"} {
+		_, err := DecodeBlurHash(invalid, 4, 4, 1)
+		assert.Equal(t, ErrInvalidHash, err, invalid)
+	}
+}
+
+func TestBase83(t *testing.T) {
+	for _, value := range []int{0, 1, 82, 83, 6888, 83*83*83*83 - 1} {
+		decoded, err := decodeBase83(encodeBase83(value, 4))
+		assert.NoError(t, err)
+		assert.Equal(t, value, decoded)
+	}
+	assert.Equal(t, "~", encodeBase83(82, 1))
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// CacheStats holds counters describing the effectiveness of a cache.
+type CacheStats struct {
+	// Hits is the number of lookups that found an entry
+	Hits uint64 `json:"hits"`
+	// Misses is the number of lookups that found no entry
+	Misses uint64 `json:"misses"`
+	// Entries is the number of entries currently cached
+	Entries int `json:"entries"`
+	// Bytes is the total size of the entries currently cached
+	Bytes int64 `json:"bytes"`
+}
+
+// Cache stores image responses by key.
+type Cache interface {
+	// Get returns the response cached under key.
+	Get(key string) (*ImageResponse, bool)
+	// Set caches resp under key.
+	Set(key string, resp *ImageResponse)
+	// Stats returns the current cache counters.
+	Stats() CacheStats
+}
+
+// TieredCache is a Cache made of several tiers, ordered from fastest to slowest.
+// Lookups try each tier in turn and copy hits into the faster tiers.
+type TieredCache []Cache
+
+// Get returns the response cached under key in the fastest tier holding it.
+func (c TieredCache) Get(key string) (*ImageResponse, bool) {
+	for i, tier := range c {
+		if resp, ok := tier.Get(key); ok {
+			for _, faster := range c[:i] {
+				faster.Set(key, resp)
+			}
+			return resp, true
+		}
+	}
+	return nil, false
+}
+
+// Set caches resp under key in every tier.
+func (c TieredCache) Set(key string, resp *ImageResponse) {
+	for _, tier := range c {
+		tier.Set(key, resp)
+	}
+}
+
+// Stats returns the counters of the fastest tier, whose hits and misses
+// reflect all lookups made through the TieredCache.
+func (c TieredCache) Stats() CacheStats {
+	if len(c) == 0 {
+		return CacheStats{}
+	}
+	return c[0].Stats()
+}
+
+// HandleCacheStats returns a Handler that reports the counters of the named caches as JSON.
+func HandleCacheStats(caches map[string]Cache) Handler {
+	return func(w http.ResponseWriter, r *http.Request) http.Handler {
+		stats := make(map[string]CacheStats, len(caches))
+		for name, c := range caches {
+			stats[name] = c.Stats()
+		}
+		return JSON(http.StatusOK, stats)
+	}
+}
+
+// MemoryCache is an in-memory cache of image responses. It is bounded by the total
+// size of the cached images and evicts the least recently used entries first.
+type MemoryCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	order    *list.List
+	entries  map[string]*list.Element
+	hits     uint64
+	misses   uint64
+}
+
+type memoryCacheEntry struct {
+	key  string
+	resp *ImageResponse
+	size int64
+}
+
+// NewMemoryCache returns a MemoryCache holding at most maxBytes of images.
+func NewMemoryCache(maxBytes int64) *MemoryCache {
+	return &MemoryCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+// Get returns the response cached under key and marks it as recently used.
+func (c *MemoryCache) Get(key string) (*ImageResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*memoryCacheEntry).resp, true
+}
+
+// Set caches resp under key, evicting the least recently used entries until the
+// cache fits within its size limit. Responses larger than the limit are not cached.
+func (c *MemoryCache) Set(key string, resp *ImageResponse) {
+	size := int64(len(key) + len(resp.Data))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.order.PushFront(&memoryCacheEntry{key: key, resp: resp, size: size})
+	c.bytes += size
+
+	for c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// Stats returns the current cache counters.
+func (c *MemoryCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Hits: c.hits, Misses: c.misses, Entries: len(c.entries), Bytes: c.bytes}
+}
+
+func (c *MemoryCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*memoryCacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+}
+
+type imageDataContextKey struct{}
+
+// bufferedImage is a request image read into memory by Cached.
+type bufferedImage struct {
+	data []byte
+	info ObjectInfo
+}
+
+// Cached returns a Handler that serves repeated requests for the same transformation
+// from c. Requests are keyed by a hash of the source image and the normalized query
+// parameters, so the same image sent twice with the same options hits the cache
+// regardless of parameter order. Only successful image responses are cached, and
+// concurrent requests for the same transformation are computed only once. Images
+// larger than 32 MiB are rejected with 413 Request Entity Too Large. Images read from
+// a Source are tagged with SourceETag, so a source that reports the image unchanged
+// since If-Modified-Since is answered with NotModified.
+func Cached(c Cache, h Handler) Handler {
+	return func(w http.ResponseWriter, r *http.Request) http.Handler {
+		// Read image
+		body, info, err := RequestImage(r)
+		if err == ErrNotModified {
+			return NotModified(r, info)
+		}
+		if err != nil {
+			return SourceError(err)
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, body, maxUploadSize))
+		body.Close()
+		if _, ok := err.(*http.MaxBytesError); ok {
+			return Error(http.StatusRequestEntityTooLarge, fmt.Errorf("image too large"))
+		}
+		if err != nil {
+			return Error(http.StatusBadRequest, err)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), imageDataContextKey{}, bufferedImage{data, info}))
+
+		next := cachedResponse(r.Context(), c, cacheKey(r, data), func(ctx context.Context) http.Handler {
+			return h(w, r.WithContext(ctx))
+		})
+		if resp, ok := next.(*ImageResponse); ok && resp.Code == http.StatusOK && info.Key != "" {
+			resp.Header.Set("ETag", SourceETag(r, info))
+		}
+		return next
+	}
+}
+
+// inflight coalesces concurrent computations of responses that are not cached yet.
+var inflight Group
+
+// cachedResponse returns the response cached under key in c. On a miss the response
+// is produced by fn and cached if it is a successful image. Concurrent misses for the
+// same key share a single call to fn; a caller whose ctx is done stops waiting for it.
+func cachedResponse(ctx context.Context, c Cache, key string, fn func(ctx context.Context) http.Handler) http.Handler {
+	if resp, ok := c.Get(key); ok {
+		return cacheResponse(resp, "HIT")
+	}
+
+	next, shared, err := inflight.Do(ctx, key, func(ctx context.Context) http.Handler {
+		next := fn(ctx)
+		if resp, ok := next.(*ImageResponse); ok && resp.Code == http.StatusOK {
+			c.Set(key, resp)
+		}
+		return next
+	})
+	if err != nil {
+		return Error(http.StatusServiceUnavailable, err)
+	}
+
+	resp, ok := next.(*ImageResponse)
+	if !ok || resp.Code != http.StatusOK {
+		return next
+	}
+	if shared {
+		return cacheResponse(resp, "COALESCED")
+	}
+	return cacheResponse(resp, "MISS")
+}
+
+// cacheKey returns the key of the transformation requested by r on data. Parameters
+// that do not affect the output are left out.
+func cacheKey(r *http.Request, data []byte) string {
+	params := r.URL.Query()
+	params.Del("src")
+	params.Del("dest")
+	if params.Get("format") == formatAuto {
+		// The negotiated format depends on the formats the client accepts
+		params["accept"] = acceptedFormats(r.Header.Get("Accept"))
+	}
+
+	hash := sha256.New()
+	io.WriteString(hash, r.URL.Path+"?"+params.Encode()+"\n")
+	hash.Write(data)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// cacheResponse returns a copy of resp reporting the cache status in the X-Cache header.
+func cacheResponse(resp *ImageResponse, status string) *ImageResponse {
+	header := resp.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("X-Cache", status)
+	return &ImageResponse{Code: resp.Code, Data: resp.Data, Header: header, ModTime: resp.ModTime}
+}
+
+// requestImageData returns the image buffered in the context of r by Cached.
+func requestImageData(r *http.Request) (io.ReadCloser, ObjectInfo, bool) {
+	img, ok := r.Context().Value(imageDataContextKey{}).(bufferedImage)
+	if !ok {
+		return nil, ObjectInfo{}, false
+	}
+	return io.NopCloser(bytes.NewReader(img.data)), img.info, true
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryCache(t *testing.T) {
+	cache := NewMemoryCache(30)
+
+	cache.Set("a", Image(http.StatusOK, []byte("0123456789")))
+	cache.Set("b", Image(http.StatusOK, []byte("0123456789")))
+
+	// Touch a so that b is the least recently used entry
+	_, ok := cache.Get("a")
+	assert.True(t, ok)
+
+	cache.Set("c", Image(http.StatusOK, []byte("0123456789")))
+
+	_, ok = cache.Get("b")
+	assert.False(t, ok)
+	_, ok = cache.Get("a")
+	assert.True(t, ok)
+	_, ok = cache.Get("c")
+	assert.True(t, ok)
+
+	// Entries larger than the cache are not stored
+	cache.Set("d", Image(http.StatusOK, bytes.Repeat([]byte("x"), 100)))
+	_, ok = cache.Get("d")
+	assert.False(t, ok)
+
+	assert.Equal(t, CacheStats{Hits: 3, Misses: 2, Entries: 2, Bytes: 22}, cache.Stats())
+}
+
+func TestCached(t *testing.T) {
+	cache := NewMemoryCache(1 << 20)
+	calls := 0
+	handler := Cached(cache, func(w http.ResponseWriter, r *http.Request) http.Handler {
+		calls++
+		return HandleThumbnail(w, r)
+	})
+
+	tests := []struct {
+		name          string
+		query         string
+		imageData     []byte
+		expectedCache string
+		expectedCalls int
+	}{
+		{name: "First request", query: "width=50", imageData: createImage(t, "png"), expectedCache: "MISS", expectedCalls: 1},
+		{name: "Repeated request", query: "width=50", imageData: createImage(t, "png"), expectedCache: "HIT", expectedCalls: 1},
+		{name: "Destination ignored", query: "width=50&dest=thumb.png", imageData: createImage(t, "png"), expectedCache: "HIT", expectedCalls: 1},
+		{name: "Different options", query: "width=40", imageData: createImage(t, "png"), expectedCache: "MISS", expectedCalls: 2},
+		{name: "Different image", query: "width=50", imageData: createImage(t, "jpeg"), expectedCache: "MISS", expectedCalls: 3},
+		{name: "Error not cached", query: "width=abc", imageData: createImage(t, "png"), expectedCache: "", expectedCalls: 4},
+		{name: "Error repeated", query: "width=abc", imageData: createImage(t, "png"), expectedCache: "", expectedCalls: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/thumbnail?"+tt.query, bytes.NewReader(tt.imageData))
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.expectedCache, rr.Header().Get("X-Cache"))
+			assert.Equal(t, tt.expectedCalls, calls)
+		})
+	}
+
+	// Oversized images are rejected before they are buffered
+	req := httptest.NewRequest(http.MethodPost, "/thumbnail?width=50", bytes.NewReader(make([]byte, maxUploadSize+1)))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	assert.Equal(t, 5, calls)
+}
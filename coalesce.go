@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Group coalesces concurrent computations of the same response. While a computation
+// for a key is in flight, further callers for that key wait for its result instead of
+// starting their own. The zero value is ready to use.
+type Group struct {
+	mu    sync.Mutex
+	calls map[string]*groupCall
+}
+
+type groupCall struct {
+	done    chan struct{}
+	result  http.Handler
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// Do returns the result of fn for key, calling fn only if no computation for key is
+// already in flight. The shared result reports whether the caller joined a computation
+// started by another caller.
+//
+// Each caller waits until the result is ready or its own ctx is done, in which case
+// ctx.Err() is returned. fn runs with a context that is detached from the callers' and
+// is cancelled only once every caller has given up.
+func (g *Group) Do(ctx context.Context, key string, fn func(ctx context.Context) http.Handler) (result http.Handler, shared bool, err error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*groupCall{}
+	}
+	c, shared := g.calls[key]
+	if !shared {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &groupCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+		go g.run(c, key, callCtx, fn)
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.result, shared, nil
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// Nobody is interested in the result anymore
+			c.cancel()
+			g.forget(c, key)
+		}
+		g.mu.Unlock()
+		return nil, shared, ctx.Err()
+	}
+}
+
+// run computes the result of c and wakes its waiters.
+func (g *Group) run(c *groupCall, key string, ctx context.Context, fn func(ctx context.Context) http.Handler) {
+	defer func() {
+		if err := recover(); err != nil {
+			c.result = Error(http.StatusInternalServerError, fmt.Errorf("panic: %v", err))
+		}
+		g.mu.Lock()
+		g.forget(c, key)
+		g.mu.Unlock()
+		c.cancel()
+		close(c.done)
+	}()
+	c.result = fn(ctx)
+}
+
+// forget removes c from the in-flight calls if it is still registered under key.
+// It must be called with g.mu held.
+func (g *Group) forget(c *groupCall, key string) {
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupDo(t *testing.T) {
+	var g Group
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) http.Handler {
+		calls.Add(1)
+		<-release
+		return Image(http.StatusOK, []byte("result"))
+	}
+
+	const callers = 10
+	var wg sync.WaitGroup
+	var sharedCount atomic.Int32
+	results := make([]http.Handler, callers)
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, shared, err := g.Do(context.Background(), "key", fn)
+			assert.NoError(t, err)
+			if shared {
+				sharedCount.Add(1)
+			}
+			results[i] = result
+		}()
+	}
+
+	// Wait for every caller to join before releasing the computation
+	assert.Eventually(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.calls["key"] != nil && g.calls["key"].waiters == callers
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, int32(callers-1), sharedCount.Load())
+	for _, result := range results {
+		assert.Same(t, results[0], result)
+	}
+}
+
+func TestGroupDoWaiterCancel(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	var computationCancelled atomic.Bool
+	fn := func(ctx context.Context) http.Handler {
+		select {
+		case <-release:
+		case <-ctx.Done():
+			computationCancelled.Store(true)
+		}
+		return Image(http.StatusOK, []byte("result"))
+	}
+
+	done := make(chan http.Handler)
+	go func() {
+		result, _, _ := g.Do(context.Background(), "key", fn)
+		done <- result
+	}()
+	assert.Eventually(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.calls["key"] != nil
+	}, time.Second, time.Millisecond)
+
+	// A waiter that gives up does not affect the others
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err := g.Do(ctx, "key", fn)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	close(release)
+	assert.NotNil(t, <-done)
+	assert.False(t, computationCancelled.Load())
+}
+
+func TestGroupDoAllWaitersCancel(t *testing.T) {
+	var g Group
+	cancelled := make(chan struct{})
+	fn := func(ctx context.Context) http.Handler {
+		<-ctx.Done()
+		close(cancelled)
+		return Error(http.StatusServiceUnavailable, ctx.Err())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, _, err := g.Do(ctx, "key", fn)
+	assert.Equal(t, context.Canceled, err)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("computation was not cancelled")
+	}
+}
+
+func TestGroupDoPanic(t *testing.T) {
+	var g Group
+	result, _, err := g.Do(context.Background(), "key", func(ctx context.Context) http.Handler {
+		panic("boom")
+	})
+	assert.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	result.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"image"
+
+	"golang.org/x/image/draw"
+)
+
+// Resample returns img scaled to width by height pixels with Catmull-Rom
+// interpolation, in an image of the same type as img so that its color model and bit
+// depth are kept: grayscale images stay grayscale, 16-bit images keep their precision
+// and paletted images keep their palette. YCbCr images are scaled plane by plane and
+// keep their chroma subsampling. Other images are scaled to RGBA.
+func Resample(img image.Image, width, height int) image.Image {
+	rect := image.Rect(0, 0, width, height)
+	switch src := img.(type) {
+	case *image.YCbCr:
+		return resampleYCbCr(src, rect)
+	case *image.Paletted:
+		// Interpolated colors are mapped back to the palette, diffusing the error
+		// like the GIF encoder does
+		scaled := image.NewRGBA(rect)
+		draw.CatmullRom.Scale(scaled, rect, src, src.Bounds(), draw.Src, nil)
+		dst := image.NewPaletted(rect, src.Palette)
+		draw.FloydSteinberg.Draw(dst, rect, scaled, image.Point{})
+		return dst
+	}
+
+	dst := newImageLike(img, rect)
+	draw.CatmullRom.Scale(dst, rect, img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// newImageLike returns an empty image with bounds rect and the same color model and
+// bit depth as img. Images of other types get an RGBA image.
+func newImageLike(img image.Image, rect image.Rectangle) draw.Image {
+	switch img.(type) {
+	case *image.Gray:
+		return image.NewGray(rect)
+	case *image.Gray16:
+		return image.NewGray16(rect)
+	case *image.NRGBA:
+		return image.NewNRGBA(rect)
+	case *image.NRGBA64:
+		return image.NewNRGBA64(rect)
+	case *image.RGBA64:
+		return image.NewRGBA64(rect)
+	default:
+		return image.NewRGBA(rect)
+	}
+}
+
+// resampleYCbCr scales the planes of src to fill rect, which has its origin at zero.
+func resampleYCbCr(src *image.YCbCr, rect image.Rectangle) *image.YCbCr {
+	dst := image.NewYCbCr(rect, src.SubsampleRatio)
+	srcChroma := chromaRect(src.Rect, src.SubsampleRatio).Size()
+	dstChroma := chromaRect(dst.Rect, dst.SubsampleRatio).Size()
+	y := src.YOffset(src.Rect.Min.X, src.Rect.Min.Y)
+	c := src.COffset(src.Rect.Min.X, src.Rect.Min.Y)
+
+	planes := [][2]*image.Gray{
+		{grayPlane(dst.Y, dst.YStride, rect.Size()), grayPlane(src.Y[y:], src.YStride, src.Rect.Size())},
+		{grayPlane(dst.Cb, dst.CStride, dstChroma), grayPlane(src.Cb[c:], src.CStride, srcChroma)},
+		{grayPlane(dst.Cr, dst.CStride, dstChroma), grayPlane(src.Cr[c:], src.CStride, srcChroma)},
+	}
+	for _, p := range planes {
+		draw.CatmullRom.Scale(p[0], p[0].Rect, p[1], p[1].Rect, draw.Src, nil)
+	}
+	return dst
+}
+
+// grayPlane returns the samples in pix as a grayscale image of the given size.
+func grayPlane(pix []uint8, stride int, size image.Point) *image.Gray {
+	return &image.Gray{Pix: pix, Stride: stride, Rect: image.Rectangle{Max: size}}
+}
+
+// chromaRect returns the bounds of the chroma planes of a YCbCr image with bounds r
+// and the given subsample ratio, in chroma samples.
+func chromaRect(r image.Rectangle, ratio image.YCbCrSubsampleRatio) image.Rectangle {
+	x, y := 1, 1
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		x = 2
+	case image.YCbCrSubsampleRatio420:
+		x, y = 2, 2
+	case image.YCbCrSubsampleRatio440:
+		y = 2
+	case image.YCbCrSubsampleRatio411:
+		x = 4
+	case image.YCbCrSubsampleRatio410:
+		x, y = 4, 2
+	}
+	return image.Rect(r.Min.X/x, r.Min.Y/y, (r.Max.X+x-1)/x, (r.Max.Y+y-1)/y)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// uniformOf returns an image of the given type filled with c, with bounds not at the origin.
+func uniformOf(img draw.Image, c color.Color) draw.Image {
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestResample(t *testing.T) {
+	rect := image.Rect(5, 3, 45, 33)
+	tests := []struct {
+		name     string
+		img      image.Image
+		expected image.Image
+	}{
+		{name: "Gray", img: uniformOf(image.NewGray(rect), color.Gray{77}), expected: &image.Gray{}},
+		{name: "Gray16", img: uniformOf(image.NewGray16(rect), color.Gray16{0x1234}), expected: &image.Gray16{}},
+		{name: "NRGBA", img: uniformOf(image.NewNRGBA(rect), color.NRGBA{200, 100, 50, 128}), expected: &image.NRGBA{}},
+		{name: "NRGBA64", img: uniformOf(image.NewNRGBA64(rect), color.NRGBA64{0x1234, 0x5678, 0x9abc, 0xffff}), expected: &image.NRGBA64{}},
+		{name: "RGBA64", img: uniformOf(image.NewRGBA64(rect), color.RGBA64{0x1234, 0x5678, 0x9abc, 0xffff}), expected: &image.RGBA64{}},
+		{name: "RGBA", img: uniformOf(image.NewRGBA(rect), color.RGBA{10, 20, 30, 255}), expected: &image.RGBA{}},
+		{name: "CMYK", img: uniformOf(image.NewCMYK(rect), color.CMYK{0, 128, 255, 0}), expected: &image.RGBA{}},
+		{name: "Paletted", img: uniformOf(image.NewPaletted(rect, palette.WebSafe), palette.WebSafe[100]), expected: &image.Paletted{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resized := Resample(tt.img, 20, 10)
+			assert.IsType(t, tt.expected, resized)
+			assert.Equal(t, image.Rect(0, 0, 20, 10), resized.Bounds())
+			// A uniform image keeps its exact color
+			assert.Equal(t, resized.ColorModel().Convert(tt.img.At(rect.Min.X, rect.Min.Y)), resized.At(10, 5))
+			if p, ok := resized.(*image.Paletted); ok {
+				assert.Equal(t, tt.img.(*image.Paletted).Palette, p.Palette)
+			}
+		})
+	}
+}
+
+func TestResampleYCbCr(t *testing.T) {
+	ratios := []image.YCbCrSubsampleRatio{
+		image.YCbCrSubsampleRatio444,
+		image.YCbCrSubsampleRatio422,
+		image.YCbCrSubsampleRatio420,
+		image.YCbCrSubsampleRatio440,
+		image.YCbCrSubsampleRatio411,
+		image.YCbCrSubsampleRatio410,
+	}
+	c := color.YCbCr{Y: 120, Cb: 90, Cr: 200}
+
+	for _, ratio := range ratios {
+		t.Run(ratio.String(), func(t *testing.T) {
+			img := image.NewYCbCr(image.Rect(3, 1, 43, 31), ratio)
+			for i := range img.Y {
+				img.Y[i] = c.Y
+			}
+			for i := range img.Cb {
+				img.Cb[i], img.Cr[i] = c.Cb, c.Cr
+			}
+
+			resized := Resample(img, 21, 11)
+			if assert.IsType(t, &image.YCbCr{}, resized) {
+				ycbcr := resized.(*image.YCbCr)
+				assert.Equal(t, ratio, ycbcr.SubsampleRatio)
+				assert.Equal(t, image.Rect(0, 0, 21, 11), ycbcr.Rect)
+				assert.Equal(t, c, ycbcr.YCbCrAt(0, 0))
+				assert.Equal(t, c, ycbcr.YCbCrAt(20, 10))
+			}
+		})
+	}
+}
+
+func TestResampleYCbCrGradient(t *testing.T) {
+	// Luma and chroma are scaled consistently
+	src := photoImage(200, 150)
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, src, &jpeg.Options{Quality: 95}))
+	img, err := jpeg.Decode(&buf)
+	assert.NoError(t, err)
+	assert.IsType(t, &image.YCbCr{}, img)
+
+	expected := scaleImage(img, 100, 75)
+	resized := Resample(img, 100, 75)
+	ssim, err := SSIM(expected, resized)
+	assert.NoError(t, err)
+	assert.Greater(t, ssim, 0.95)
+}
+
+func TestResizeImageColorModel(t *testing.T) {
+	encode := func(img image.Image, format string) []byte {
+		var buf bytes.Buffer
+		var err error
+		switch format {
+		case formatPNG:
+			err = png.Encode(&buf, img)
+		case formatGIF:
+			err = gif.Encode(&buf, img, nil)
+		}
+		assert.NoError(t, err)
+		return buf.Bytes()
+	}
+	rect := image.Rect(0, 0, 40, 30)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected image.Image
+	}{
+		{name: "Grayscale PNG", data: encode(uniformOf(image.NewGray(rect), color.Gray{77}), formatPNG), expected: &image.Gray{}},
+		{name: "16-bit grayscale PNG", data: encode(uniformOf(image.NewGray16(rect), color.Gray16{0x1234}), formatPNG), expected: &image.Gray16{}},
+		{name: "16-bit PNG", data: encode(uniformOf(image.NewRGBA64(rect), color.RGBA64{0x1234, 0x5678, 0x9abc, 0xffff}), formatPNG), expected: &image.RGBA64{}},
+		{name: "Paletted PNG", data: encode(uniformOf(image.NewPaletted(rect, palette.Plan9), palette.Plan9[7]), formatPNG), expected: &image.Paletted{}},
+		{name: "GIF", data: encode(uniformOf(image.NewPaletted(rect, palette.Plan9), palette.Plan9[7]), formatGIF), expected: &image.Paletted{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := ResizeImage(context.Background(), bytes.NewReader(tt.data), 15, 20)
+			assert.NoError(t, err)
+			img, _, err := image.Decode(bytes.NewReader(data))
+			assert.NoError(t, err)
+			assert.IsType(t, tt.expected, img)
+			assert.Equal(t, image.Rect(0, 0, 20, 15), img.Bounds())
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// alignNone requires the compared images to have the same size
+	alignNone = ""
+	// alignTopLeft compares the overlapping region anchored at the top left corners
+	alignTopLeft = "topleft"
+	// alignCenter compares the overlapping region anchored at the centers
+	alignCenter = "center"
+)
+
+// Comparison describes the difference between two images.
+type Comparison struct {
+	// Width is the width of the compared region
+	Width int `json:"width"`
+	// Height is the height of the compared region
+	Height int `json:"height"`
+	// PSNR is the peak signal-to-noise ratio in decibels, or nil if the images are identical
+	PSNR *float64 `json:"psnr"`
+	// SSIM is the structural similarity of the images' luma
+	SSIM float64 `json:"ssim"`
+	// DiffPixels is the number of pixels that differ by more than the threshold
+	DiffPixels int `json:"diffPixels"`
+	// DiffRatio is DiffPixels as a fraction of the compared pixels
+	DiffRatio float64 `json:"diffRatio"`
+	// Heatmap is the encoded diff heatmap, if requested
+	Heatmap []byte `json:"heatmap,omitempty"`
+	// HeatmapFormat is the format Heatmap is encoded in
+	HeatmapFormat string `json:"heatmapFormat,omitempty"`
+}
+
+// HandleCompare compares the two images uploaded in the multipart form fields "a" and
+// "b" and returns the differences between them.
+//
+// Query Parameters:
+// - rescale: Whether to scale b to the size of a before comparing (optional).
+// - align: "topleft" or "center" to compare the overlapping region of images of different sizes (optional).
+// - threshold: The largest channel difference between 0 and 255 not counted as a diff (optional).
+// - heatmap: The format to encode a diff heatmap in, included in the response (optional).
+//
+// Responses:
+// - 400 Bad Request: If the form or a parameter is invalid.
+// - 413 Request Entity Too Large: If the images are larger than 64 MiB together.
+// - 422 Unprocessable Entity: If an image is invalid, the images differ in size or the heatmap format is unsupported.
+// - 500 Internal Server Error: If the heatmap could not be encoded.
+// - 200 OK: The Comparison.
+func HandleCompare(w http.ResponseWriter, r *http.Request) http.Handler {
+	// Parse query parameters
+	params := r.URL.Query()
+	rescale, err := boolParam(params.Get("rescale"))
+	if err != nil {
+		return Error(http.StatusBadRequest, fmt.Errorf("invalid rescale: %s", params.Get("rescale")))
+	}
+	align := params.Get("align")
+	if align != alignNone && align != alignTopLeft && align != alignCenter {
+		return Error(http.StatusBadRequest, fmt.Errorf("invalid align: %s", align))
+	}
+	threshold := 0
+	if value := params.Get("threshold"); value != "" {
+		threshold, err = strconv.Atoi(value)
+		if err != nil || threshold < 0 || threshold > 255 {
+			return Error(http.StatusBadRequest, fmt.Errorf("invalid threshold: %s", value))
+		}
+	}
+	heatmap := params.Get("heatmap")
+
+	// Read images
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxUploadSize)
+	if err := r.ParseMultipartForm(2 * maxUploadSize); err != nil {
+		if _, ok := err.(*http.MaxBytesError); ok {
+			return Error(http.StatusRequestEntityTooLarge, fmt.Errorf("images too large"))
+		}
+		return Error(http.StatusBadRequest, err)
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	a, err := formImage(r.MultipartForm, "a")
+	if err != nil {
+		return Error(http.StatusUnprocessableEntity, err)
+	}
+	b, err := formImage(r.MultipartForm, "b")
+	if err != nil {
+		return Error(http.StatusUnprocessableEntity, err)
+	}
+
+	// Compare images
+	if rescale {
+		b = scaleImage(b, a.Bounds().Dx(), a.Bounds().Dy())
+	}
+	a, b, err = alignImages(a, b, align)
+	if err != nil {
+		return Error(http.StatusUnprocessableEntity, err)
+	}
+	comparison, diff := CompareImages(a, b, threshold)
+
+	if heatmap != "" {
+		data, err := EncodeImage(r.Context(), Heatmap(diff), heatmap)
+		if err == ErrUnsupportedFormat {
+			return Error(http.StatusUnprocessableEntity, err)
+		}
+		if err != nil {
+			return Error(http.StatusInternalServerError, err)
+		}
+		comparison.Heatmap, comparison.HeatmapFormat = data, heatmap
+	}
+
+	return JSON(http.StatusOK, comparison)
+}
+
+// formImage decodes the image uploaded in the form field name.
+func formImage(form *multipart.Form, name string) (image.Image, error) {
+	files := form.File[name]
+	if len(files) == 0 {
+		return nil, fmt.Errorf("missing image: %s", name)
+	}
+	f, err := files[0].Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	return img, nil
+}
+
+// scaleImage returns img scaled to width and height.
+func scaleImage(img image.Image, width, height int) image.Image {
+	rect := image.Rect(0, 0, width, height)
+	scaled := image.NewRGBA(rect)
+	draw.CatmullRom.Scale(scaled, rect, img, img.Bounds(), draw.Over, nil)
+	return scaled
+}
+
+// alignImages returns the regions of a and b to compare. Without an alignment the
+// images must have the same size; otherwise their overlapping region is anchored at
+// the top left corners or the centers. It returns ErrSizeMismatch if the images
+// cannot be compared.
+func alignImages(a, b image.Image, align string) (image.Image, image.Image, error) {
+	sizeA, sizeB := a.Bounds().Size(), b.Bounds().Size()
+	if sizeA == sizeB {
+		return a, b, nil
+	}
+	if align == alignNone {
+		return nil, nil, ErrSizeMismatch
+	}
+
+	size := image.Pt(min(sizeA.X, sizeB.X), min(sizeA.Y, sizeB.Y))
+	region := func(img image.Image) image.Image {
+		bounds := img.Bounds()
+		origin := bounds.Min
+		if align == alignCenter {
+			origin = origin.Add(bounds.Size().Sub(size).Div(2))
+		}
+		return subImage(img, image.Rectangle{Min: origin, Max: origin.Add(size)})
+	}
+	return region(a), region(b), nil
+}
+
+// subImage returns the part of img within rect, sharing pixels with img when its type
+// supports it.
+func subImage(img image.Image, rect image.Rectangle) image.Image {
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+	cropped := image.NewRGBA(image.Rectangle{Max: rect.Size()})
+	draw.Draw(cropped, cropped.Bounds(), img, rect.Min, draw.Src)
+	return cropped
+}
+
+// CompareImages compares a and b, which must have the same size, and returns the
+// Comparison together with the largest channel difference of each pixel. Pixels
+// whose channels differ by more than threshold count as diffs.
+func CompareImages(a, b image.Image, threshold int) (Comparison, *image.Gray) {
+	boundsA, boundsB := a.Bounds(), b.Bounds()
+	diff := image.NewGray(image.Rectangle{Max: boundsA.Size()})
+	comparison := Comparison{Width: boundsA.Dx(), Height: boundsA.Dy()}
+
+	sumSquares := 0.0
+	for y := 0; y < boundsA.Dy(); y++ {
+		for x := 0; x < boundsA.Dx(); x++ {
+			ca := color.NRGBAModel.Convert(a.At(boundsA.Min.X+x, boundsA.Min.Y+y)).(color.NRGBA)
+			cb := color.NRGBAModel.Convert(b.At(boundsB.Min.X+x, boundsB.Min.Y+y)).(color.NRGBA)
+			largest := 0
+			for _, d := range [...]int{
+				int(ca.R) - int(cb.R),
+				int(ca.G) - int(cb.G),
+				int(ca.B) - int(cb.B),
+				int(ca.A) - int(cb.A),
+			} {
+				sumSquares += float64(d * d)
+				largest = max(largest, d, -d)
+			}
+			diff.Pix[y*diff.Stride+x] = uint8(largest)
+			if largest > threshold {
+				comparison.DiffPixels++
+			}
+		}
+	}
+
+	if pixels := boundsA.Dx() * boundsA.Dy(); pixels > 0 {
+		comparison.DiffRatio = float64(comparison.DiffPixels) / float64(pixels)
+		if mse := sumSquares / float64(4*pixels); mse > 0 {
+			psnr := 10 * math.Log10(255*255/mse)
+			comparison.PSNR = &psnr
+		}
+		comparison.SSIM, _ = SSIM(a, b)
+	}
+	return comparison, diff
+}
+
+// Heatmap renders per-pixel differences, ranging from black for identical pixels
+// through red to yellow for the largest differences.
+func Heatmap(diff *image.Gray) *image.RGBA {
+	bounds := diff.Bounds()
+	heatmap := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			d := int(diff.GrayAt(x, y).Y)
+			heatmap.SetRGBA(x, y, color.RGBA{R: uint8(min(2*d, 255)), G: uint8(max(2*d-255, 0)), A: 255})
+		}
+	}
+	return heatmap
+}
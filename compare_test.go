@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// compareRequest returns a /compare request uploading a and b.
+func compareRequest(t *testing.T, query string, a, b []byte) *http.Request {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for name, data := range map[string][]byte{"a": a, "b": b} {
+		if data == nil {
+			continue
+		}
+		part, err := mw.CreateFormFile(name, name+".png")
+		assert.NoError(t, err)
+		part.Write(data)
+	}
+	assert.NoError(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/compare?"+query, body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestCompareImages(t *testing.T) {
+	img := noisyImage()
+	changed := noisyImage()
+	changed.Set(10, 10, color.RGBA{0, 0, 0, 255})
+	changed.Set(20, 20, color.RGBA{255, 255, 255, 255})
+
+	tests := []struct {
+		name       string
+		b          image.Image
+		threshold  int
+		diffPixels int
+		identical  bool
+	}{
+		{name: "Identical images", b: img, identical: true},
+		{name: "Changed pixels", b: changed, diffPixels: 2},
+		{name: "Changes below threshold", b: changed, threshold: 255},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			comparison, diff := CompareImages(img, tt.b, tt.threshold)
+			assert.Equal(t, 100, comparison.Width)
+			assert.Equal(t, 100, comparison.Height)
+			assert.Equal(t, tt.diffPixels, comparison.DiffPixels)
+			assert.InDelta(t, float64(tt.diffPixels)/10000, comparison.DiffRatio, 1e-9)
+			assert.Equal(t, tt.identical, comparison.PSNR == nil)
+			if tt.identical {
+				assert.InDelta(t, 1, comparison.SSIM, 1e-9)
+				assert.Zero(t, diff.GrayAt(10, 10).Y)
+			} else {
+				assert.Greater(t, *comparison.PSNR, 30.0)
+				assert.Less(t, comparison.SSIM, 1.0)
+				assert.NotZero(t, diff.GrayAt(10, 10).Y)
+			}
+		})
+	}
+}
+
+func TestAlignImages(t *testing.T) {
+	small := image.NewRGBA(image.Rect(0, 0, 50, 40))
+	large := image.NewRGBA(image.Rect(0, 0, 100, 100))
+
+	tests := []struct {
+		name    string
+		align   string
+		boundsA image.Rectangle
+		boundsB image.Rectangle
+		err     error
+	}{
+		{name: "No alignment", align: alignNone, err: ErrSizeMismatch},
+		{name: "Top left", align: alignTopLeft, boundsA: image.Rect(0, 0, 50, 40), boundsB: image.Rect(0, 0, 50, 40)},
+		{name: "Center", align: alignCenter, boundsA: image.Rect(0, 0, 50, 40), boundsB: image.Rect(25, 30, 75, 70)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b, err := alignImages(small, large, tt.align)
+			assert.Equal(t, tt.err, err)
+			if tt.err != nil {
+				return
+			}
+			assert.Equal(t, tt.boundsA, a.Bounds())
+			assert.Equal(t, tt.boundsB, b.Bounds())
+		})
+	}
+}
+
+func TestHandleCompare(t *testing.T) {
+	a, err := EncodeImage(context.Background(), noisyImage(), "png")
+	assert.NoError(t, err)
+	changed := noisyImage()
+	changed.Set(10, 10, color.RGBA{0, 0, 0, 255})
+	b, err := EncodeImage(context.Background(), changed, "png")
+	assert.NoError(t, err)
+	small, err := EncodeImage(context.Background(), image.NewRGBA(image.Rect(0, 0, 50, 50)), "png")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		query      string
+		a, b       []byte
+		code       int
+		diffPixels int
+		heatmap    bool
+	}{
+		{name: "Identical images", a: a, b: a, code: http.StatusOK},
+		{name: "Changed pixel", a: a, b: b, code: http.StatusOK, diffPixels: 1},
+		{name: "Heatmap", query: "heatmap=png", a: a, b: b, code: http.StatusOK, diffPixels: 1, heatmap: true},
+		{name: "Size mismatch", a: a, b: small, code: http.StatusUnprocessableEntity},
+		{name: "Rescale", query: "rescale=true&threshold=255", a: a, b: small, code: http.StatusOK},
+		{name: "Align", query: "align=center&threshold=255", a: a, b: small, code: http.StatusOK},
+		{name: "Missing image", a: a, code: http.StatusUnprocessableEntity},
+		{name: "Invalid image", a: a, b: []byte("not an image"), code: http.StatusUnprocessableEntity},
+		{name: "Unsupported heatmap format", query: "heatmap=bmp", a: a, b: b, code: http.StatusUnprocessableEntity},
+		{name: "Invalid threshold", query: "threshold=256", a: a, b: b, code: http.StatusBadRequest},
+		{name: "Invalid align", query: "align=left", a: a, b: b, code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+
+			handler := Handler(HandleCompare)
+			handler.ServeHTTP(rr, compareRequest(t, tt.query, tt.a, tt.b))
+
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			var comparison Comparison
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &comparison))
+			assert.Equal(t, tt.diffPixels, comparison.DiffPixels)
+			if !tt.heatmap {
+				assert.Nil(t, comparison.Heatmap)
+				return
+			}
+			assert.Equal(t, "png", comparison.HeatmapFormat)
+			heatmap, err := png.Decode(bytes.NewReader(comparison.Heatmap))
+			assert.NoError(t, err)
+			assert.Equal(t, image.Rect(0, 0, 100, 100), heatmap.Bounds())
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrCropOutOfBounds is returned when a crop rectangle does not lie within the image
+var ErrCropOutOfBounds = fmt.Errorf("crop rectangle out of bounds")
+
+// CropLength is a coordinate or size of a crop rectangle, in pixels or as a
+// percentage of the matching dimension of the image.
+type CropLength struct {
+	// Value is the number of pixels, or the percentage if Percent is set
+	Value float64
+	// Percent is set when Value is a percentage
+	Percent bool
+}
+
+// pixels returns l in pixels of a dimension of the given size.
+func (l CropLength) pixels(size int) int {
+	if l.Percent {
+		return int(math.Round(l.Value * float64(size) / 100))
+	}
+	return int(l.Value)
+}
+
+// CropRect is a rectangle to crop an image to, relative to the top left corner of the image.
+type CropRect struct {
+	X, Y, Width, Height CropLength
+}
+
+// Bounds returns the part of bounds that r selects. It returns ErrCropOutOfBounds if
+// the rectangle is empty or does not lie within bounds.
+func (r CropRect) Bounds(bounds image.Rectangle) (image.Rectangle, error) {
+	x, y := r.X.pixels(bounds.Dx()), r.Y.pixels(bounds.Dy())
+	width, height := r.Width.pixels(bounds.Dx()), r.Height.pixels(bounds.Dy())
+	rect := image.Rect(x, y, x+width, y+height).Add(bounds.Min)
+	if width < 1 || height < 1 || !rect.In(bounds) {
+		return image.Rectangle{}, ErrCropOutOfBounds
+	}
+	return rect, nil
+}
+
+// parseCropLength parses a crop coordinate or size given in pixels, such as "120", or
+// as a percentage, such as "12.5%".
+func parseCropLength(value string) (CropLength, error) {
+	if number, ok := strings.CutSuffix(value, "%"); ok {
+		percent, err := strconv.ParseFloat(number, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return CropLength{}, fmt.Errorf("invalid percentage: %s", value)
+		}
+		return CropLength{Value: percent, Percent: true}, nil
+	}
+	pixels, err := strconv.Atoi(value)
+	if err != nil || pixels < 0 {
+		return CropLength{}, fmt.Errorf("invalid length: %s", value)
+	}
+	return CropLength{Value: float64(pixels)}, nil
+}
+
+// ParseCropRect parses the x, y, width and height of a crop rectangle. Empty
+// coordinates are zero.
+func ParseCropRect(x, y, width, height string) (CropRect, error) {
+	var rect CropRect
+	for _, field := range []struct {
+		name, value string
+		length      *CropLength
+	}{
+		{"x", x, &rect.X},
+		{"y", y, &rect.Y},
+		{"width", width, &rect.Width},
+		{"height", height, &rect.Height},
+	} {
+		if field.value == "" && (field.name == "x" || field.name == "y") {
+			continue
+		}
+		length, err := parseCropLength(field.value)
+		if err != nil {
+			return CropRect{}, fmt.Errorf("invalid %s: %s", field.name, field.value)
+		}
+		*field.length = length
+	}
+	return rect, nil
+}
+
+// transformImage decodes an image from r, prepares it as requested by opts, scales it
+// to width by height pixels and applies the remaining operations of opts before
+// encoding it. A zero width or height is computed from the other to preserve the
+// aspect ratio, and zero dimensions keep the prepared size. The image is encoded in
+// its original format unless opts name another.
+//
+// Possible errors:
+//   - ErrInvalidImage: If the image cannot be decoded.
+//   - ErrCropOutOfBounds: If the crop rectangle does not lie within the image.
+//   - ErrDerivativeTooLarge: If the result would be larger than maxDerivativeSize and the image.
+func transformImage(ctx context.Context, r io.Reader, width, height int, opts []Option) ([]byte, error) {
+	img, format, err := image.Decode(r)
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+
+	o := newOptions(opts)
+	img, err = o.prepare(img)
+	if err != nil {
+		return nil, err
+	}
+	if width != 0 || height != 0 {
+		width, height, err = derivativeSize(img.Bounds(), width, height)
+		if err != nil {
+			return nil, err
+		}
+		img = Resample(img, width, height)
+	}
+	return o.encode(ctx, o.apply(img), format)
+}
+
+// HandleCrop crops the image in the request body, or the source image named by the
+// src query parameter, and optionally scales the cropped image.
+//
+// Query Parameters:
+// - x, y: The top left corner of the crop rectangle in pixels or percentages, such as "10%" (optional, default to 0).
+// - width, height: The size of the crop rectangle in pixels or percentages (required).
+// - w, h: The size to scale the cropped image to; either one preserves the aspect ratio (optional).
+// - format, quality and the other parameters of ParseOptions (optional).
+//
+// Responses:
+// - 400 Bad Request: If a parameter is missing or invalid.
+// - 404 Not Found: If the source image does not exist.
+// - 422 Unprocessable Entity: If the image is invalid, its format is unsupported, the crop rectangle
+// does not lie within it, the result is larger than 4096 pixels and the image in either dimension, or it
+// does not fit within max_bytes.
+// - 500 Internal Server Error: If an error occurs during cropping.
+// - 200 OK: The cropped image.
+func HandleCrop(w http.ResponseWriter, r *http.Request) http.Handler {
+	// Parse query parameters
+	params := r.URL.Query()
+	for _, name := range []string{"width", "height"} {
+		if params.Get(name) == "" {
+			return Error(http.StatusBadRequest, fmt.Errorf("missing required parameter: %s", name))
+		}
+	}
+	rect, err := ParseCropRect(params.Get("x"), params.Get("y"), params.Get("width"), params.Get("height"))
+	if err != nil {
+		return Error(http.StatusBadRequest, err)
+	}
+	width, err := dimensionParam(params.Get("w"))
+	if err != nil {
+		return Error(http.StatusBadRequest, fmt.Errorf("invalid w: %s", params.Get("w")))
+	}
+	height, err := dimensionParam(params.Get("h"))
+	if err != nil {
+		return Error(http.StatusBadRequest, fmt.Errorf("invalid h: %s", params.Get("h")))
+	}
+
+	// Parse options
+	opts, err := ParseOptions(r)
+	if err != nil {
+		return Error(http.StatusBadRequest, err)
+	}
+	var report Report
+	opts = append(opts, WithCrop(rect), WithReport(&report))
+
+	// Open image
+	body, info, err := RequestImage(r)
+	if err != nil {
+		return SourceError(err)
+	}
+	defer body.Close()
+
+	// Crop image
+	cropped, err := transformImage(r.Context(), body, width, height, opts)
+	if err == ErrInvalidImage || err == ErrCropOutOfBounds || err == ErrUnsupportedFormat || err == ErrTooLarge || err == ErrDerivativeTooLarge {
+		return Error(http.StatusUnprocessableEntity, err)
+	}
+	if err != nil {
+		return Error(http.StatusInternalServerError, err)
+	}
+
+	// Return cropped image
+	return Image(http.StatusOK, cropped).LastModified(info.ModTime).Encoded(report)
+}
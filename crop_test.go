@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCropRect(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   [4]string
+		expected CropRect
+		err      string
+	}{
+		{
+			name:     "Pixels",
+			values:   [4]string{"10", "20", "30", "40"},
+			expected: CropRect{CropLength{10, false}, CropLength{20, false}, CropLength{30, false}, CropLength{40, false}},
+		},
+		{
+			name:     "Percentages",
+			values:   [4]string{"12.5%", "0%", "50%", "100%"},
+			expected: CropRect{CropLength{12.5, true}, CropLength{0, true}, CropLength{50, true}, CropLength{100, true}},
+		},
+		{
+			name:     "Default corner",
+			values:   [4]string{"", "", "30", "50%"},
+			expected: CropRect{Width: CropLength{30, false}, Height: CropLength{50, true}},
+		},
+		{name: "Missing width", values: [4]string{"0", "0", "", "10"}, err: "invalid width: "},
+		{name: "Negative x", values: [4]string{"-1", "0", "10", "10"}, err: "invalid x: -1"},
+		{name: "Fractional pixels", values: [4]string{"0", "1.5", "10", "10"}, err: "invalid y: 1.5"},
+		{name: "Percentage above 100", values: [4]string{"0", "0", "101%", "10"}, err: "invalid width: 101%"},
+		{name: "Invalid percentage", values: [4]string{"0", "0", "10", "ten%"}, err: "invalid height: ten%"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rect, err := ParseCropRect(tt.values[0], tt.values[1], tt.values[2], tt.values[3])
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, rect)
+		})
+	}
+}
+
+func TestCropRectBounds(t *testing.T) {
+	bounds := image.Rect(10, 20, 110, 70)
+	px := func(v float64) CropLength { return CropLength{Value: v} }
+	pct := func(v float64) CropLength { return CropLength{Value: v, Percent: true} }
+
+	tests := []struct {
+		name     string
+		rect     CropRect
+		expected image.Rectangle
+		err      error
+	}{
+		{name: "Pixels", rect: CropRect{px(5), px(10), px(20), px(30)}, expected: image.Rect(15, 30, 35, 60)},
+		{name: "Percentages", rect: CropRect{pct(50), pct(20), pct(50), pct(50)}, expected: image.Rect(60, 30, 110, 55)},
+		{name: "Whole image", rect: CropRect{Width: pct(100), Height: px(50)}, expected: bounds},
+		{name: "Too wide", rect: CropRect{px(1), px(0), px(100), px(10)}, err: ErrCropOutOfBounds},
+		{name: "Too high", rect: CropRect{px(0), pct(50), px(10), pct(60)}, err: ErrCropOutOfBounds},
+		{name: "Empty", rect: CropRect{px(0), px(0), px(0), px(10)}, err: ErrCropOutOfBounds},
+		{name: "Rounds to empty", rect: CropRect{px(0), px(0), pct(0.1), px(10)}, err: ErrCropOutOfBounds},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rect, err := tt.rect.Bounds(bounds)
+			assert.Equal(t, tt.err, err)
+			assert.Equal(t, tt.expected, rect)
+		})
+	}
+}
+
+func TestPrepareCropSharesPixels(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	o := newOptions([]Option{WithCrop(CropRect{X: CropLength{Value: 2}, Y: CropLength{Value: 3}, Width: CropLength{Value: 4}, Height: CropLength{Value: 5}})})
+	cropped, err := o.prepare(img)
+	assert.NoError(t, err)
+	if assert.IsType(t, &image.RGBA{}, cropped) {
+		assert.Equal(t, image.Rect(2, 3, 6, 8), cropped.Bounds())
+		img.SetRGBA(2, 3, color.RGBA{1, 2, 3, 4})
+		assert.Equal(t, color.RGBA{1, 2, 3, 4}, cropped.(*image.RGBA).RGBAAt(2, 3))
+	}
+}
+
+// quadrantImage returns a 100x60 image with red, green, blue and white quadrants.
+func quadrantImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 100, 60))
+	draw.Draw(img, image.Rect(0, 0, 50, 30), image.NewUniform(color.RGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(50, 0, 100, 30), image.NewUniform(color.RGBA{0, 255, 0, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 30, 50, 60), image.NewUniform(color.RGBA{0, 0, 255, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(50, 30, 100, 60), image.NewUniform(color.RGBA{255, 255, 255, 255}), image.Point{}, draw.Src)
+	return img
+}
+
+func TestHandleCrop(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, quadrantImage()))
+	data := buf.Bytes()
+
+	tests := []struct {
+		name   string
+		path   string
+		body   []byte
+		code   int
+		size   image.Point
+		center color.RGBA
+	}{
+		{name: "Missing width", path: "/crop?height=10", body: data, code: http.StatusBadRequest},
+		{name: "Missing height", path: "/crop?width=10", body: data, code: http.StatusBadRequest},
+		{name: "Invalid x", path: "/crop?x=a&width=10&height=10", body: data, code: http.StatusBadRequest},
+		{name: "Invalid w", path: "/crop?width=10&height=10&w=0", body: data, code: http.StatusBadRequest},
+		{name: "Invalid image", path: "/crop?width=10&height=10", body: []byte("not an image"), code: http.StatusUnprocessableEntity},
+		{name: "Out of bounds", path: "/crop?x=60&width=50&height=10", body: data, code: http.StatusUnprocessableEntity},
+		{name: "Pixels", path: "/crop?x=50&y=0&width=50&height=30", body: data, code: http.StatusOK, size: image.Pt(50, 30), center: color.RGBA{0, 255, 0, 255}},
+		{name: "Percentages", path: "/crop?y=50%25&width=50%25&height=50%25", body: data, code: http.StatusOK, size: image.Pt(50, 30), center: color.RGBA{0, 0, 255, 255}},
+		{name: "Crop then scale to width", path: "/crop?x=50&y=30&width=50&height=30&w=20", body: data, code: http.StatusOK, size: image.Pt(20, 12), center: color.RGBA{255, 255, 255, 255}},
+		{name: "Crop then scale to height", path: "/crop?width=50&height=30&h=15", body: data, code: http.StatusOK, size: image.Pt(25, 15), center: color.RGBA{255, 0, 0, 255}},
+		{name: "Scaled too large", path: "/crop?width=50&height=30&w=100000", body: data, code: http.StatusUnprocessableEntity},
+		{name: "Scaled height too large", path: "/crop?width=1&height=30&w=200", body: data, code: http.StatusUnprocessableEntity},
+		{name: "Crop then resize", path: "/crop?width=50&height=30&w=10&h=40", body: data, code: http.StatusOK, size: image.Pt(10, 40), center: color.RGBA{255, 0, 0, 255}},
+		{name: "Resize with crop", path: "/resize?width=20&height=20&crop=50%25,50%25,50%25,50%25", body: data, code: http.StatusOK, size: image.Pt(20, 20), center: color.RGBA{255, 255, 255, 255}},
+		{name: "Resize with invalid crop", path: "/resize?width=20&height=20&crop=0,0,50", body: data, code: http.StatusBadRequest},
+		{name: "Resize with crop out of bounds", path: "/resize?width=20&height=20&crop=0,0,101,10", body: data, code: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+
+			handler := Handler(HandleCrop)
+			if req.URL.Path == "/resize" {
+				handler = Handler(HandleResize)
+			}
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			img, err := png.Decode(rr.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.size, img.Bounds().Size())
+			center := img.Bounds().Max.Div(2)
+			assert.Equal(t, tt.center, color.RGBAModel.Convert(img.At(center.X, center.Y)))
+		})
+	}
+}
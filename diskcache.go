@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errCorruptCacheFile is returned when a cache file cannot be parsed
+var errCorruptCacheFile = fmt.Errorf("corrupt cache file")
+
+// DiskCache is a cache of image responses stored on the local filesystem, so that
+// cached derivatives survive restarts. Entries are spread over sharded directories
+// named after the first two characters of their key and are written atomically.
+// The cache is bounded by the total size of its files and evicts the least recently
+// accessed entries first; access times are tracked in the files' modification times
+// so that the index can be recovered on startup. Entries older than the TTL expire.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	bytes   int64
+	order   *list.List
+	entries map[string]*list.Element
+	hits    uint64
+	misses  uint64
+}
+
+type diskCacheEntry struct {
+	key  string
+	size int64
+}
+
+// diskCacheHeader is stored as the first line of every cache file.
+type diskCacheHeader struct {
+	Expires time.Time   `json:"expires,omitempty"`
+	ModTime time.Time   `json:"modTime,omitempty"`
+	Header  http.Header `json:"header,omitempty"`
+}
+
+// NewDiskCache returns a DiskCache storing at most maxBytes of images in dir. Entries
+// expire ttl after they are written; a zero ttl keeps them until they are evicted.
+// Entries left in dir by a previous process are recovered.
+func NewDiskCache(dir string, maxBytes int64, ttl time.Duration) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		now:      time.Now,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+	if err := c.recover(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// recover rebuilds the index from the files in the cache directory, ordered by
+// their access times, and removes temporary files left by interrupted writes as
+// well as expired entries, so that they do not count toward the size limit.
+func (c *DiskCache) recover() error {
+	type file struct {
+		key      string
+		size     int64
+		accessed time.Time
+	}
+	var files []file
+
+	err := filepath.WalkDir(c.dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			removeStale(name)
+			return nil
+		}
+		if !validCacheKey(d.Name()) || filepath.Base(filepath.Dir(name)) != d.Name()[:2] {
+			return nil
+		}
+		expires, err := readDiskCacheExpires(name)
+		if err != nil || !expires.IsZero() && !c.now().Before(expires) {
+			removeStale(name)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, file{key: d.Name(), size: info.Size(), accessed: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].accessed.Before(files[j].accessed) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range files {
+		c.entries[f.key] = c.order.PushFront(&diskCacheEntry{key: f.key, size: f.size})
+		c.bytes += f.size
+	}
+	c.evict()
+	return nil
+}
+
+// Get returns the response cached under key and marks it as recently accessed.
+// It implements Cache.
+func (c *DiskCache) Get(key string) (*ImageResponse, bool) {
+	c.mu.Lock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	c.mu.Unlock()
+
+	name := c.path(key)
+	resp, expires, err := readDiskCacheFile(name)
+	if err != nil || !expires.IsZero() && !c.now().Before(expires) {
+		c.mu.Lock()
+		if elem, ok := c.entries[key]; ok {
+			c.remove(elem)
+		}
+		c.misses++
+		c.mu.Unlock()
+		return nil, false
+	}
+
+	now := c.now()
+	os.Chtimes(name, now, now)
+
+	c.mu.Lock()
+	c.hits++
+	c.mu.Unlock()
+	return resp, true
+}
+
+// Set writes resp to the cache under key, evicting the least recently accessed
+// entries until the cache fits within its size limit. It implements Cache.
+func (c *DiskCache) Set(key string, resp *ImageResponse) {
+	if !validCacheKey(key) {
+		return
+	}
+
+	header := diskCacheHeader{ModTime: resp.ModTime, Header: resp.Header}
+	if c.ttl > 0 {
+		header.Expires = c.now().Add(c.ttl).UTC()
+	}
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+		return
+	}
+	data := append(append(encoded, '\n'), resp.Data...)
+	size := int64(len(data))
+	if size > c.maxBytes {
+		return
+	}
+
+	name := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		log.Printf("Error: %v\n", err)
+		return
+	}
+	if err := writeFileAtomic(name, data); err != nil {
+		log.Printf("Error: %v\n", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		entry := c.order.Remove(elem).(*diskCacheEntry)
+		c.bytes -= entry.size
+	}
+	c.entries[key] = c.order.PushFront(&diskCacheEntry{key: key, size: size})
+	c.bytes += size
+	c.evict()
+}
+
+// Stats returns the current cache counters. It implements Cache.
+func (c *DiskCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Hits: c.hits, Misses: c.misses, Entries: len(c.entries), Bytes: c.bytes}
+}
+
+// evict removes the least recently accessed entries until the cache fits within its size limit.
+func (c *DiskCache) evict() {
+	for c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove deletes the entry held in elem and its file.
+func (c *DiskCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*diskCacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+	if err := os.Remove(c.path(entry.key)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error: %v\n", err)
+	}
+}
+
+// removeStale deletes a file that recover does not index. Files that cannot be
+// deleted are logged and left in place, so that they do not keep the cache from opening.
+func removeStale(name string) {
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error: %v\n", err)
+	}
+}
+
+func (c *DiskCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// readDiskCacheFile reads a cache file written by DiskCache.Set.
+func readDiskCacheFile(name string) (*ImageResponse, time.Time, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	line, data, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return nil, time.Time{}, errCorruptCacheFile
+	}
+	var header diskCacheHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, time.Time{}, err
+	}
+	if header.Header == nil {
+		header.Header = http.Header{}
+	}
+	resp := &ImageResponse{Code: http.StatusOK, Data: data, Header: header.Header, ModTime: header.ModTime}
+	return resp, header.Expires, nil
+}
+
+// readDiskCacheExpires reads the expiry time from the header of a cache file
+// written by DiskCache.Set without reading the cached image.
+func readDiskCacheExpires(name string) (time.Time, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return time.Time{}, errCorruptCacheFile
+	}
+	var header diskCacheHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return time.Time{}, err
+	}
+	return header.Expires, nil
+}
+
+// validCacheKey reports whether key is a hex-encoded cache key that is safe to use as a file name.
+func validCacheKey(key string) bool {
+	return len(key) > 2 && isLowerHex(key)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewDiskCache(dir, 1<<20, 0)
+	assert.NoError(t, err)
+
+	key := strings.Repeat("ab", 32)
+	resp := Image(http.StatusOK, []byte("image data"))
+	resp.Header.Set("X-Test", "value")
+
+	_, ok := cache.Get(key)
+	assert.False(t, ok)
+
+	cache.Set(key, resp)
+	assert.FileExists(t, filepath.Join(dir, "ab", key))
+
+	cached, ok := cache.Get(key)
+	assert.True(t, ok)
+	assert.Equal(t, resp.Data, cached.Data)
+	assert.Equal(t, "value", cached.Header.Get("X-Test"))
+
+	// Keys that are not safe file names are not cached
+	cache.Set("../escape", resp)
+	_, ok = cache.Get("../escape")
+	assert.False(t, ok)
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, 1, stats.Entries)
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	resp := Image(http.StatusOK, []byte("0123456789"))
+	cache, err := NewDiskCache(dir, 3*fileSize(t, resp)-1, 0)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	a, b, c := strings.Repeat("a", 64), strings.Repeat("b", 64), strings.Repeat("c", 64)
+	cache.Set(a, resp)
+	cache.Set(b, resp)
+
+	// Access a so that b is the least recently accessed entry
+	now = now.Add(time.Minute)
+	_, ok := cache.Get(a)
+	assert.True(t, ok)
+
+	cache.Set(c, resp)
+
+	_, ok = cache.Get(b)
+	assert.False(t, ok)
+	assert.NoFileExists(t, filepath.Join(dir, "bb", b))
+	_, ok = cache.Get(a)
+	assert.True(t, ok)
+	_, ok = cache.Get(c)
+	assert.True(t, ok)
+}
+
+func TestDiskCacheTTL(t *testing.T) {
+	cache, err := NewDiskCache(t.TempDir(), 1<<20, time.Hour)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	key := strings.Repeat("a", 64)
+	cache.Set(key, Image(http.StatusOK, []byte("image data")))
+
+	now = now.Add(59 * time.Minute)
+	_, ok := cache.Get(key)
+	assert.True(t, ok)
+
+	now = now.Add(time.Minute)
+	_, ok = cache.Get(key)
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Stats().Entries)
+}
+
+func TestDiskCacheRecovery(t *testing.T) {
+	dir := t.TempDir()
+	resp := Image(http.StatusOK, []byte("0123456789"))
+	cache, err := NewDiskCache(dir, 1<<20, 0)
+	assert.NoError(t, err)
+
+	older, newer := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	cache.Set(older, resp)
+	cache.Set(newer, resp)
+	past := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "aa", older), past, past))
+
+	// Leftover temporary file from an interrupted write
+	tmp := filepath.Join(dir, "aa", ".tmp-123")
+	assert.NoError(t, os.WriteFile(tmp, []byte("partial"), 0o644))
+
+	// Recover with room for a single entry; the older one is evicted
+	recovered, err := NewDiskCache(dir, fileSize(t, resp), 0)
+	assert.NoError(t, err)
+	assert.NoFileExists(t, tmp)
+
+	_, ok := recovered.Get(older)
+	assert.False(t, ok)
+	cached, ok := recovered.Get(newer)
+	assert.True(t, ok)
+	assert.Equal(t, resp.Data, cached.Data)
+}
+
+func TestDiskCacheRecoveryExpired(t *testing.T) {
+	dir := t.TempDir()
+	resp := Image(http.StatusOK, []byte("0123456789"))
+	cache, err := NewDiskCache(dir, 1<<20, time.Hour)
+	assert.NoError(t, err)
+
+	live, expired := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	cache.Set(live, resp)
+	now := time.Now()
+	cache.now = func() time.Time { return now.Add(-2 * time.Hour) }
+	cache.Set(expired, resp)
+	past := now.Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "aa", live), past, past))
+
+	// A corrupt file is removed as well
+	corrupt := filepath.Join(dir, "cc", strings.Repeat("c", 64))
+	assert.NoError(t, os.MkdirAll(filepath.Dir(corrupt), 0o755))
+	assert.NoError(t, os.WriteFile(corrupt, []byte("no header"), 0o644))
+
+	// The expired entry was accessed more recently, but it must not evict the live one
+	info, err := os.Stat(filepath.Join(dir, "aa", live))
+	assert.NoError(t, err)
+	recovered, err := NewDiskCache(dir, info.Size(), time.Hour)
+	assert.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(dir, "bb", expired))
+	assert.NoFileExists(t, corrupt)
+	assert.Equal(t, 1, recovered.Stats().Entries)
+	assert.Equal(t, info.Size(), recovered.Stats().Bytes)
+
+	cached, ok := recovered.Get(live)
+	assert.True(t, ok)
+	assert.Equal(t, resp.Data, cached.Data)
+}
+
+func TestDiskCacheRecoveryUnremovable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can remove files from read-only directories")
+	}
+	dir := t.TempDir()
+	tmp := filepath.Join(dir, "aa", ".tmp-123")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(tmp), 0o755))
+	assert.NoError(t, os.WriteFile(tmp, []byte("partial"), 0o644))
+	assert.NoError(t, os.Chmod(filepath.Dir(tmp), 0o555))
+	t.Cleanup(func() { os.Chmod(filepath.Dir(tmp), 0o755) })
+
+	// The leftover file is logged and skipped
+	cache, err := NewDiskCache(dir, 1<<20, 0)
+	assert.NoError(t, err)
+	assert.FileExists(t, tmp)
+	assert.Equal(t, 0, cache.Stats().Entries)
+}
+
+func TestTieredCache(t *testing.T) {
+	memory := NewMemoryCache(1 << 20)
+	disk, err := NewDiskCache(t.TempDir(), 1<<20, 0)
+	assert.NoError(t, err)
+	cache := TieredCache{memory, disk}
+
+	key := strings.Repeat("a", 64)
+	disk.Set(key, Image(http.StatusOK, []byte("image data")))
+
+	_, ok := memory.Get(key)
+	assert.False(t, ok)
+
+	cached, ok := cache.Get(key)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("image data"), cached.Data)
+
+	// The hit was copied into the memory tier
+	_, ok = memory.Get(key)
+	assert.True(t, ok)
+}
+
+// fileSize returns the size of the file the disk cache writes for resp.
+func fileSize(t *testing.T, resp *ImageResponse) int64 {
+	t.Helper()
+	dir := t.TempDir()
+	cache, err := NewDiskCache(dir, 1<<20, 0)
+	assert.NoError(t, err)
+	cache.Set(strings.Repeat("f", 64), resp)
+	return cache.Stats().Bytes
+}
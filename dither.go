@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// maxIndexedColors is the largest number of colors of an indexed image
+	maxIndexedColors = 256
+
+	// Supported quantizers
+	quantizerMedianCut = "mediancut"
+	quantizerOctree    = "octree"
+	quantizerWu        = "wu"
+
+	// Supported dithering methods
+	ditherNone           = "none"
+	ditherFloydSteinberg = "floydsteinberg"
+	ditherOrdered        = "ordered"
+)
+
+// quantizers maps the names of the supported quantizers to their implementations.
+var quantizers = map[string]func(pixels []color.RGBA, n int) []colorCount{
+	quantizerMedianCut: MedianCut,
+	quantizerOctree:    Octree,
+	quantizerWu:        Wu,
+}
+
+// ditherers maps the names of the supported dithering methods to functions that draw
+// src onto dst, which has the same bounds.
+var ditherers = map[string]func(dst *image.Paletted, src *image.RGBA){
+	ditherNone: func(dst *image.Paletted, src *image.RGBA) {
+		draw.Draw(dst, dst.Rect, src, image.Point{}, draw.Src)
+	},
+	ditherFloydSteinberg: func(dst *image.Paletted, src *image.RGBA) {
+		draw.FloydSteinberg.Draw(dst, dst.Rect, src, image.Point{})
+	},
+	ditherOrdered: OrderedDither,
+}
+
+// Quantize returns img reduced to a palette of at most n colors, chosen by the named
+// quantizer and drawn with the named dithering method. An empty quantizer selects Wu's
+// and an empty dithering method Floyd-Steinberg. Pixels at least half opaque become
+// fully opaque and the others fully transparent, sharing one palette entry. Images
+// with at most n colors keep their exact colors without dithering.
+func Quantize(img image.Image, quantizer, dither string, n int) (*image.Paletted, error) {
+	if quantizer == "" {
+		quantizer = quantizerWu
+	}
+	if dither == "" {
+		dither = ditherFloydSteinberg
+	}
+	quantize, ok := quantizers[quantizer]
+	if !ok {
+		return nil, fmt.Errorf("unsupported quantizer: %s", quantizer)
+	}
+	drawPaletted, ok := ditherers[dither]
+	if !ok {
+		return nil, fmt.Errorf("unsupported dither: %s", dither)
+	}
+	if n < 2 || n > maxIndexedColors {
+		return nil, fmt.Errorf("invalid number of colors: %d", n)
+	}
+	if p, ok := img.(*image.Paletted); ok && len(p.Palette) <= n {
+		return p, nil
+	}
+
+	src := binaryAlpha(img)
+	pixels := opaquePixels(src)
+	transparent := len(pixels) < len(src.Pix)/4
+	if transparent {
+		n--
+	}
+
+	var palette color.Palette
+	if exact := distinctColors(pixels, n); exact != nil {
+		palette = exact
+		drawPaletted = ditherers[ditherNone]
+	} else {
+		for _, c := range quantize(pixels, n) {
+			palette = append(palette, c.color)
+		}
+	}
+	if transparent {
+		palette = append(palette, color.RGBA{})
+	}
+
+	dst := image.NewPaletted(src.Rect, palette)
+	drawPaletted(dst, src)
+	return dst, nil
+}
+
+// binaryAlpha returns a copy of img with its origin at zero in which the pixels at
+// least half opaque are fully opaque and the others fully transparent.
+func binaryAlpha(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rectangle{Max: bounds.Size()})
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A >= minOpaqueAlpha {
+				dst.SetRGBA(x-bounds.Min.X, y-bounds.Min.Y, color.RGBA{c.R, c.G, c.B, 255})
+			}
+		}
+	}
+	return dst
+}
+
+// distinctColors returns the distinct colors of pixels, or nil if there are more than n.
+func distinctColors(pixels []color.RGBA, n int) color.Palette {
+	seen := map[color.RGBA]struct{}{}
+	var palette color.Palette
+	for _, p := range pixels {
+		if _, ok := seen[p]; ok {
+			continue
+		}
+		if len(seen) == n {
+			return nil
+		}
+		seen[p] = struct{}{}
+		palette = append(palette, p)
+	}
+	return palette
+}
+
+// bayer8 is the 8x8 Bayer threshold matrix of ordered dithering.
+var bayer8 = [8][8]float64{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// OrderedDither draws src onto dst, which has the same bounds, offsetting each opaque
+// pixel by the 8x8 Bayer matrix before picking the closest palette color. The offsets
+// span the typical distance between the colors of the palette. Unlike error diffusion,
+// the pattern of a region does not depend on its surroundings, which suits animations
+// and compresses well.
+func OrderedDither(dst *image.Paletted, src *image.RGBA) {
+	spread := 255 / math.Cbrt(float64(len(dst.Palette)))
+	bounds := dst.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			p := src.RGBAAt(x, y)
+			if p.A != 0 {
+				offset := ((bayer8[y&7][x&7]+0.5)/64 - 0.5) * spread
+				p.R = uint8(max(0, min(255, float64(p.R)+offset+0.5)))
+				p.G = uint8(max(0, min(255, float64(p.G)+offset+0.5)))
+				p.B = uint8(max(0, min(255, float64(p.B)+offset+0.5)))
+			}
+			dst.SetColorIndex(x, y, uint8(dst.Palette.Index(p)))
+		}
+	}
+}
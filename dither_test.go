@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rampImage returns an opaque horizontal gradient from black to orange.
+func rampImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := x * 255 / (width - 1)
+			img.SetRGBA(x, y, color.RGBA{uint8(v), uint8(v / 2), 0, 255})
+		}
+	}
+	return img
+}
+
+// meanError returns the mean absolute difference of the red channels of a and b
+// averaged over 8x8 blocks, which dithering preserves.
+func meanError(a, b image.Image) float64 {
+	bounds := a.Bounds()
+	total, blocks := 0.0, 0
+	for y := bounds.Min.Y; y+8 <= bounds.Max.Y; y += 8 {
+		for x := bounds.Min.X; x+8 <= bounds.Max.X; x += 8 {
+			var sa, sb float64
+			for dy := 0; dy < 8; dy++ {
+				for dx := 0; dx < 8; dx++ {
+					ra, _, _, _ := a.At(x+dx, y+dy).RGBA()
+					rb, _, _, _ := b.At(x+dx, y+dy).RGBA()
+					sa += float64(ra >> 8)
+					sb += float64(rb >> 8)
+				}
+			}
+			d := (sa - sb) / 64
+			if d < 0 {
+				d = -d
+			}
+			total += d
+			blocks++
+		}
+	}
+	return total / float64(blocks)
+}
+
+func TestQuantize(t *testing.T) {
+	img := rampImage(256, 16)
+
+	for _, quantizer := range []string{"", quantizerMedianCut, quantizerOctree, quantizerWu} {
+		for _, dither := range []string{"", ditherNone, ditherFloydSteinberg, ditherOrdered} {
+			t.Run(quantizer+"/"+dither, func(t *testing.T) {
+				paletted, err := Quantize(img, quantizer, dither, 8)
+				assert.NoError(t, err)
+				assert.Equal(t, img.Bounds(), paletted.Bounds())
+				assert.LessOrEqual(t, len(paletted.Palette), 8)
+				assert.Less(t, meanError(img, paletted), 12.0)
+			})
+		}
+	}
+
+	_, err := Quantize(img, "kmeans", "", 8)
+	assert.Error(t, err)
+	_, err = Quantize(img, "", "random", 8)
+	assert.Error(t, err)
+	_, err = Quantize(img, "", "", 1)
+	assert.Error(t, err)
+	_, err = Quantize(img, "", "", 257)
+	assert.Error(t, err)
+}
+
+func TestQuantizeDither(t *testing.T) {
+	img := rampImage(256, 16)
+	plain, err := Quantize(img, quantizerWu, ditherNone, 4)
+	assert.NoError(t, err)
+	dithered, err := Quantize(img, quantizerWu, ditherFloydSteinberg, 4)
+	assert.NoError(t, err)
+	ordered, err := Quantize(img, quantizerWu, ditherOrdered, 4)
+	assert.NoError(t, err)
+
+	// Dithering approximates the gradient with patterns of the palette colors
+	assert.Less(t, meanError(img, dithered), meanError(img, plain))
+	assert.Less(t, meanError(img, ordered), meanError(img, plain))
+	// The ordered pattern of a column repeats every 8 rows
+	for x := 0; x < 256; x++ {
+		assert.Equal(t, ordered.ColorIndexAt(x, 0), ordered.ColorIndexAt(x, 8))
+	}
+}
+
+func TestQuantizeExact(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(10, 10, 30, 20))
+	draw.Draw(img, image.Rect(10, 10, 20, 20), image.NewUniform(color.NRGBA{200, 30, 40, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(20, 10, 25, 20), image.NewUniform(color.NRGBA{20, 130, 40, 200}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(25, 10, 30, 20), image.NewUniform(color.NRGBA{20, 130, 240, 100}), image.Point{}, draw.Src)
+
+	paletted, err := Quantize(img, "", "", 4)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 20, 10), paletted.Bounds())
+	assert.Len(t, paletted.Palette, 3)
+	assert.Equal(t, color.RGBA{200, 30, 40, 255}, paletted.At(0, 0))
+	// Partially transparent pixels become fully opaque or fully transparent
+	assert.Equal(t, color.RGBA{20, 130, 40, 255}, paletted.At(10, 0))
+	assert.Equal(t, color.RGBA{}, paletted.At(15, 0))
+
+	// Images that are already indexed are kept
+	again, err := Quantize(paletted, quantizerOctree, ditherOrdered, 4)
+	assert.NoError(t, err)
+	assert.Same(t, paletted, again)
+}
+
+func TestEncodeIndexed(t *testing.T) {
+	// Sensor noise makes lossless compression of photos inefficient
+	img := photoImage(200, 150)
+	rng := rand.New(rand.NewSource(1))
+	for i := range img.Pix {
+		if i%4 != 3 {
+			img.Pix[i] = uint8(max(0, min(255, int(img.Pix[i])+rng.Intn(17)-8)))
+		}
+	}
+	ctx := context.Background()
+	png32, err := EncodeImage(ctx, img, formatPNG)
+	assert.NoError(t, err)
+
+	data, err := EncodeImage(ctx, img, formatPNG8, WithQuantizer(quantizerOctree, 64), WithDither(ditherOrdered))
+	assert.NoError(t, err)
+	assert.Less(t, len(data), len(png32)/4)
+	decoded, err := png.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	if assert.IsType(t, &image.Paletted{}, decoded) {
+		assert.LessOrEqual(t, len(decoded.(*image.Paletted).Palette), 64)
+	}
+
+	data, err = EncodeImage(ctx, img, formatGIF, WithQuantizer(quantizerMedianCut, 0))
+	assert.NoError(t, err)
+	decoded, err = gif.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Less(t, meanError(img, decoded), 4.0)
+
+	_, err = EncodeImage(ctx, img, formatGIF, WithQuantizer("kmeans", 0))
+	assert.Error(t, err)
+}
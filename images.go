@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxUploadSize is the largest image accepted by ImageService.HandleUpload
+const maxUploadSize = 32 << 20
+
+// ImageService serves original images held in a Storage and renders derivatives of them on demand.
+// It indexes the perceptual hashes of the stored images to find near-duplicates.
+type ImageService struct {
+	storage Storage
+	cache   Cache
+	index   HashIndex
+	now     func() time.Time
+}
+
+// NewImageService returns an ImageService that stores images in storage and caches
+// rendered derivatives in cache. A nil cache disables caching. Images already in
+// storage are not indexed until Reindex is called.
+func NewImageService(storage Storage, cache Cache) *ImageService {
+	return &ImageService{storage: storage, cache: cache, now: time.Now}
+}
+
+// HandleUpload stores the image in the request body under an ID derived from its
+// content and returns its metadata. Uploading an image that is already stored
+// returns the existing metadata.
+//
+// Responses:
+// - 201 Created: If the image was stored.
+// - 200 OK: If the image was already stored.
+// - 413 Request Entity Too Large: If the image is larger than 32 MiB.
+// - 422 Unprocessable Entity: If the body is not a supported image.
+// - 500 Internal Server Error: If the image could not be stored.
+func (s *ImageService) HandleUpload(w http.ResponseWriter, r *http.Request) http.Handler {
+	// Read image
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadSize))
+	if err != nil {
+		return Error(http.StatusRequestEntityTooLarge, fmt.Errorf("image too large"))
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return Error(http.StatusUnprocessableEntity, ErrInvalidImage)
+	}
+
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:])
+
+	// Return existing image
+	if meta, err := s.storage.Stat(r.Context(), id); err == nil {
+		return JSON(http.StatusOK, meta)
+	}
+
+	// Store image
+	meta := ImageMeta{
+		ID:      id,
+		Format:  format,
+		Width:   img.Bounds().Dx(),
+		Height:  img.Bounds().Dy(),
+		Size:    len(data),
+		Created: s.now().UTC(),
+	}
+	if err := s.storage.Put(r.Context(), meta, data); err != nil {
+		return Error(http.StatusInternalServerError, err)
+	}
+	s.index.Add(id, HashImage(img))
+
+	return JSON(http.StatusCreated, meta)
+}
+
+// HandleList returns the metadata of all stored images.
+//
+// Responses:
+// - 200 OK: The list of images.
+// - 500 Internal Server Error: If the images could not be listed.
+func (s *ImageService) HandleList(w http.ResponseWriter, r *http.Request) http.Handler {
+	metas, err := s.storage.List(r.Context())
+	if err != nil {
+		return Error(http.StatusInternalServerError, err)
+	}
+	return JSON(http.StatusOK, metas)
+}
+
+// HandleGet returns the image stored under the ID in the request path, or a derivative
+// of it. When both w and h are given the image is resized to exactly those dimensions.
+// When only one of them is given the image is scaled to it, preserving its aspect ratio.
+// Derivatives may be no larger than 4096 pixels or the image, whichever is larger, in
+// each dimension. The other parameters of ParseOptions, such as angle or crop, also
+// produce a derivative.
+//
+// Query Parameters:
+// - w: The width of the derivative (optional).
+// - h: The height of the derivative (optional).
+// - format: The format of the derivative, or "auto" to negotiate it from the Accept header (optional).
+// - quality, angle, crop and the other parameters of ParseOptions (optional).
+//
+// Responses:
+// - 304 Not Modified: If the client's copy, identified by If-None-Match or If-Modified-Since, is current.
+// - 400 Bad Request: If a parameter is invalid or the derivative is too large.
+// - 404 Not Found: If no image is stored under the ID.
+// - 422 Unprocessable Entity: If the format is unsupported, the crop rectangle is out of bounds, the rotated
+// image is too large, or the derivative does not fit within max_bytes.
+// - 500 Internal Server Error: If the derivative could not be rendered.
+// - 200 OK: The image or derivative.
+func (s *ImageService) HandleGet(w http.ResponseWriter, r *http.Request) http.Handler {
+	// Parse query parameters
+	params := r.URL.Query()
+	width, err := dimensionParam(params.Get("w"))
+	if err != nil {
+		return Error(http.StatusBadRequest, fmt.Errorf("invalid w: %s", params.Get("w")))
+	}
+	height, err := dimensionParam(params.Get("h"))
+	if err != nil {
+		return Error(http.StatusBadRequest, fmt.Errorf("invalid h: %s", params.Get("h")))
+	}
+
+	// Look up image
+	id := r.PathValue("id")
+	meta, err := s.storage.Stat(r.Context(), id)
+	if err == ErrNotFound {
+		return Error(http.StatusNotFound, err)
+	}
+	if err != nil {
+		return Error(http.StatusInternalServerError, err)
+	}
+
+	// Parse options
+	opts, err := ParseOptions(r)
+	if err != nil {
+		return Error(http.StatusBadRequest, err)
+	}
+
+	if width == 0 && height == 0 && params.Get("format") == "" && len(opts) == 0 {
+		return s.original(r, meta)
+	}
+	if width != 0 || height != 0 {
+		scaledWidth, _, err := derivativeSize(image.Rect(0, 0, meta.Width, meta.Height), width, height)
+		if err != nil {
+			return Error(http.StatusBadRequest, err)
+		}
+		if width == 0 {
+			width = scaledWidth
+		}
+	}
+
+	// Derivatives of an ID never change, so they can be cached by URL.
+	if s.cache == nil {
+		return s.derivative(r, meta, width, height, opts)
+	}
+	return cachedResponse(r.Context(), s.cache, cacheKey(r, nil), func(ctx context.Context) http.Handler {
+		return s.derivative(r.WithContext(ctx), meta, width, height, opts)
+	})
+}
+
+// original returns the image described by meta.
+func (s *ImageService) original(r *http.Request, meta ImageMeta) http.Handler {
+	data, _, err := s.storage.Get(r.Context(), meta.ID)
+	if err == ErrNotFound {
+		return Error(http.StatusNotFound, err)
+	}
+	if err != nil {
+		return Error(http.StatusInternalServerError, err)
+	}
+	return Image(http.StatusOK, data).LastModified(meta.Created)
+}
+
+// derivative renders the image described by meta at the given dimensions with opts.
+// A zero height scales the image to width, preserving its aspect ratio, and zero
+// dimensions keep the original size and, unless the request names another, format.
+func (s *ImageService) derivative(r *http.Request, meta ImageMeta, width, height int, opts []Option) http.Handler {
+	var report Report
+	opts = append(opts, WithReport(&report))
+
+	// Load image
+	data, _, err := s.storage.Get(r.Context(), meta.ID)
+	if err == ErrNotFound {
+		return Error(http.StatusNotFound, err)
+	}
+	if err != nil {
+		return Error(http.StatusInternalServerError, err)
+	}
+
+	// Render derivative
+	switch {
+	case width == 0 && height == 0:
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = meta.Format
+		}
+		data, err = ConvertImage(r.Context(), bytes.NewReader(data), format, opts...)
+	case height == 0:
+		data, err = ThumbnailImage(r.Context(), bytes.NewReader(data), width, opts...)
+	default:
+		data, err = ResizeImage(r.Context(), bytes.NewReader(data), height, width, opts...)
+	}
+	if err == ErrUnsupportedFormat || err == ErrTooLarge || err == ErrCropOutOfBounds || err == ErrDerivativeTooLarge {
+		return Error(http.StatusUnprocessableEntity, err)
+	}
+	if err != nil {
+		return Error(http.StatusInternalServerError, err)
+	}
+
+	return Image(http.StatusOK, data).LastModified(meta.Created).Encoded(report)
+}
+
+// HandleDelete removes the image stored under the ID in the request path.
+//
+// Responses:
+// - 204 No Content: If the image was removed.
+// - 404 Not Found: If no image is stored under the ID.
+// - 500 Internal Server Error: If the image could not be removed.
+func (s *ImageService) HandleDelete(w http.ResponseWriter, r *http.Request) http.Handler {
+	id := r.PathValue("id")
+	err := s.storage.Delete(r.Context(), id)
+	if err == ErrNotFound {
+		return Error(http.StatusNotFound, err)
+	}
+	if err != nil {
+		return Error(http.StatusInternalServerError, err)
+	}
+	s.index.Remove(id)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// dimensionParam parses an optional positive image dimension. An empty value yields zero.
+func dimensionParam(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid dimension: %s", value)
+	}
+	return n, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newImageServiceMux(svc *ImageService) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("POST /images", Handler(svc.HandleUpload))
+	mux.Handle("GET /images", Handler(svc.HandleList))
+	mux.Handle("GET /images/{id}", Handler(svc.HandleGet))
+	mux.Handle("DELETE /images/{id}", Handler(svc.HandleDelete))
+	return mux
+}
+
+func TestImageService(t *testing.T) {
+	mux := newImageServiceMux(NewImageService(NewMemoryStorage(), nil))
+	data := createImage(t, "png")
+
+	// Upload
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/images", bytes.NewReader(data)))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	var meta ImageMeta
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &meta))
+	assert.Len(t, meta.ID, 64)
+	assert.Equal(t, "png", meta.Format)
+	assert.Equal(t, 100, meta.Width)
+	assert.Equal(t, 100, meta.Height)
+	assert.Equal(t, len(data), meta.Size)
+
+	// Upload again
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/images", bytes.NewReader(data)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// List
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var metas []ImageMeta
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &metas))
+	assert.Equal(t, []ImageMeta{meta}, metas)
+
+	// Get derivatives
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{name: "Original", query: "", expectedStatus: http.StatusOK, expectedWidth: 100, expectedHeight: 100},
+		{name: "Width and height", query: "?w=40&h=20", expectedStatus: http.StatusOK, expectedWidth: 40, expectedHeight: 20},
+		{name: "Width only", query: "?w=50", expectedStatus: http.StatusOK, expectedWidth: 50, expectedHeight: 50},
+		{name: "Height only", query: "?h=25", expectedStatus: http.StatusOK, expectedWidth: 25, expectedHeight: 25},
+		{name: "Invalid width", query: "?w=abc", expectedStatus: http.StatusBadRequest},
+		{name: "Negative height", query: "?h=-1", expectedStatus: http.StatusBadRequest},
+		{name: "Largest upscale", query: "?w=4096&h=10", expectedStatus: http.StatusOK, expectedWidth: 4096, expectedHeight: 10},
+		{name: "Width too large", query: "?w=100000&h=100000", expectedStatus: http.StatusBadRequest},
+		{name: "Height too large", query: "?w=10&h=4097", expectedStatus: http.StatusBadRequest},
+		{name: "Scaled height too large", query: "?w=5000", expectedStatus: http.StatusBadRequest},
+		{name: "Options only", query: "?crop=0,0,10,20", expectedStatus: http.StatusOK, expectedWidth: 10, expectedHeight: 20},
+		{name: "Options and width", query: "?crop=0,0,10,20&w=20", expectedStatus: http.StatusOK, expectedWidth: 20, expectedHeight: 40},
+		{name: "Invalid option", query: "?quality=0", expectedStatus: http.StatusBadRequest},
+		{name: "Crop out of bounds", query: "?crop=90,90,20,20", expectedStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/"+meta.ID+tt.query, nil))
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+
+			config, format, err := image.DecodeConfig(rr.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, "png", format)
+			assert.Equal(t, tt.expectedWidth, config.Width)
+			assert.Equal(t, tt.expectedHeight, config.Height)
+		})
+	}
+
+	// Delete
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/images/"+meta.ID, nil))
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/"+meta.ID, nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/images/"+meta.ID, nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestImageServiceUploadInvalid(t *testing.T) {
+	mux := newImageServiceMux(NewImageService(NewMemoryStorage(), nil))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/images", bytes.NewReader([]byte("not an image"))))
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+}
+
+func TestImageServiceCache(t *testing.T) {
+	cache := NewMemoryCache(1 << 20)
+	mux := newImageServiceMux(NewImageService(NewMemoryStorage(), cache))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/images", bytes.NewReader(createImage(t, "png"))))
+	var meta ImageMeta
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &meta))
+
+	var etag string
+	for _, expected := range []string{"MISS", "HIT"} {
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/"+meta.ID+"?w=50", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, expected, rr.Header().Get("X-Cache"))
+		assert.Equal(t, meta.Created.Format(http.TimeFormat), rr.Header().Get("Last-Modified"))
+		etag = rr.Header().Get("ETag")
+	}
+
+	// Revalidation of a cached derivative
+	req := httptest.NewRequest(http.MethodGet, "/images/"+meta.ID+"?w=50", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+
+	// Cached derivatives are not served once the image is deleted
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/images/"+meta.ID, nil))
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/"+meta.ID+"?w=50", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
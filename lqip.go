@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// ErrTooWide is returned when an image is too wide to scale to a placeholder at least a pixel high
+var ErrTooWide = fmt.Errorf("image too wide for placeholder")
+
+const (
+	// defaultLQIPWidth is the default width of a low-quality image placeholder
+	defaultLQIPWidth = 16
+	// maxLQIPWidth is the largest width of a low-quality image placeholder
+	maxLQIPWidth = 64
+	// defaultLQIPQuality is the default JPEG quality of a low-quality image placeholder
+	defaultLQIPQuality = 30
+	// defaultLQIPBlur is the default blur of a low-quality image placeholder
+	defaultLQIPBlur = 1
+	// maxLQIPBlur is the largest blur of a low-quality image placeholder
+	maxLQIPBlur = 10
+)
+
+// LQIP is a low-quality image placeholder.
+type LQIP struct {
+	// DataURI is the placeholder image as a base64 data URI
+	DataURI string `json:"dataUri"`
+	// Width is the width of the placeholder image
+	Width int `json:"width"`
+	// Height is the height of the placeholder image
+	Height int `json:"height"`
+	// AspectRatio is the width of the original image divided by its height
+	AspectRatio float64 `json:"aspectRatio"`
+}
+
+// NewLQIP returns a low-quality image placeholder of the image in data, width pixels
+// wide. The thumbnail is blurred with a Gaussian of standard deviation sigma and
+// encoded at the given JPEG quality, or as PNG if it has transparency. If svg is set,
+// the thumbnail is not blurred itself but wrapped in an SVG image that blurs it with a
+// CSS filter of radius sigma when it is rendered, so that the blur is not scaled up
+// with the thumbnail.
+func NewLQIP(ctx context.Context, data []byte, width, quality int, sigma float64, svg bool) (LQIP, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil || img.Bounds().Empty() {
+		return LQIP{}, ErrInvalidImage
+	}
+	bounds := img.Bounds()
+	height := bounds.Dy() * width / bounds.Dx()
+	if height == 0 {
+		return LQIP{}, ErrTooWide
+	}
+	if err := checkDerivativeSize(bounds, width, height); err != nil {
+		return LQIP{}, err
+	}
+
+	thumbnail := Resample(img, width, height)
+	if sigma > 0 && !svg {
+		thumbnail = GaussianBlur(thumbnail, sigma)
+	}
+	// JPEG is smaller, but has no alpha channel
+	format := formatPNG
+	if isOpaque(thumbnail) {
+		format = formatJPEG
+	}
+	encoded, err := EncodeImage(ctx, thumbnail, format, WithQuality(quality))
+	if err != nil {
+		return LQIP{}, err
+	}
+
+	lqip := LQIP{
+		DataURI:     dataURI(mediaTypeOf(format), encoded),
+		Width:       width,
+		Height:      height,
+		AspectRatio: float64(bounds.Dx()) / float64(bounds.Dy()),
+	}
+	if svg {
+		wrapped := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d">`+
+			`<image href="%s" width="%d" height="%d" preserveAspectRatio="none" style="filter:blur(%spx)"/></svg>`,
+			width, height, lqip.DataURI, width, height, strconv.FormatFloat(sigma, 'f', -1, 64))
+		lqip.DataURI = dataURI("image/svg+xml", []byte(wrapped))
+	}
+	return lqip, nil
+}
+
+// dataURI returns data as a base64 data URI of the given media type.
+func dataURI(mediaType string, data []byte) string {
+	return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// HandleLQIP returns a low-quality image placeholder of the image in the request body,
+// or of the source image named by the src query parameter.
+//
+// Query Parameters:
+// - width: The width of the placeholder between 1 and 64 (optional, defaults to 16).
+// - quality: The JPEG quality between 1 and 100 (optional, defaults to 30).
+// - blur: The standard deviation of the blur between 0 and 10; 0 disables it (optional, defaults to 1).
+// - svg: Whether to wrap the placeholder in an SVG image that blurs it with a CSS filter instead
+// of blurring the thumbnail (optional).
+// - src: The key of a source image to use instead of the request body (optional).
+//
+// Responses:
+// - 400 Bad Request: If a parameter is invalid.
+// - 404 Not Found: If the source image does not exist.
+// - 413 Request Entity Too Large: If the image is larger than 32 MiB.
+// - 422 Unprocessable Entity: If the image is invalid, or too wide or too tall for the placeholder.
+// - 500 Internal Server Error: If the placeholder could not be rendered.
+// - 200 OK: The LQIP.
+func HandleLQIP(w http.ResponseWriter, r *http.Request) http.Handler {
+	// Parse query parameters
+	params := r.URL.Query()
+	width := defaultLQIPWidth
+	if value := params.Get("width"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxLQIPWidth {
+			return Error(http.StatusBadRequest, fmt.Errorf("invalid width: %s", value))
+		}
+		width = n
+	}
+	quality := defaultLQIPQuality
+	if value := params.Get("quality"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 100 {
+			return Error(http.StatusBadRequest, fmt.Errorf("invalid quality: %s", value))
+		}
+		quality = n
+	}
+	sigma := float64(defaultLQIPBlur)
+	if value := params.Get("blur"); value != "" {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 || f > maxLQIPBlur {
+			return Error(http.StatusBadRequest, fmt.Errorf("invalid blur: %s", value))
+		}
+		sigma = f
+	}
+	svg, err := boolParam(params.Get("svg"))
+	if err != nil {
+		return Error(http.StatusBadRequest, fmt.Errorf("invalid svg: %s", params.Get("svg")))
+	}
+
+	// Read image
+	body, _, err := RequestImage(r)
+	if err != nil {
+		return SourceError(err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(http.MaxBytesReader(w, body, maxUploadSize))
+	if err != nil {
+		return Error(http.StatusRequestEntityTooLarge, fmt.Errorf("image too large"))
+	}
+
+	lqip, err := NewLQIP(r.Context(), data, width, quality, sigma, svg)
+	if err == ErrInvalidImage || err == ErrTooWide || err == ErrDerivativeTooLarge {
+		return Error(http.StatusUnprocessableEntity, err)
+	}
+	if err != nil {
+		return Error(http.StatusInternalServerError, err)
+	}
+	return JSON(http.StatusOK, lqip)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/draw"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// decodeDataURI returns the media type and data of a base64 data URI.
+func decodeDataURI(t *testing.T, uri string) (string, []byte) {
+	header, encoded, ok := strings.Cut(strings.TrimPrefix(uri, "data:"), ";base64,")
+	assert.True(t, ok, uri)
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	assert.NoError(t, err)
+	return header, data
+}
+
+func TestNewLQIP(t *testing.T) {
+	opaque, err := EncodeImage(context.Background(), photoImage(400, 300), "png")
+	assert.NoError(t, err)
+	transparent := photoImage(400, 300)
+	draw.Draw(transparent, image.Rect(0, 0, 100, 300), image.Transparent, image.Point{}, draw.Src)
+	withAlpha, err := EncodeImage(context.Background(), transparent, "png")
+	assert.NoError(t, err)
+	wide, err := EncodeImage(context.Background(), image.NewRGBA(image.Rect(0, 0, 100, 1)), "png")
+	assert.NoError(t, err)
+	tall, err := EncodeImage(context.Background(), image.NewRGBA(image.Rect(0, 0, 1, 5000)), "png")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		width     int
+		svg       bool
+		mediaType string
+		height    int
+		err       error
+	}{
+		{name: "Opaque image", data: opaque, width: 16, mediaType: "image/jpeg", height: 12},
+		{name: "Transparent image", data: withAlpha, width: 16, mediaType: "image/png", height: 12},
+		{name: "Wider placeholder", data: opaque, width: 32, mediaType: "image/jpeg", height: 24},
+		{name: "SVG", data: opaque, width: 16, svg: true, mediaType: "image/svg+xml", height: 12},
+		{name: "Invalid image", data: []byte("not an image"), width: 16, err: ErrInvalidImage},
+		{name: "Too wide", data: wide, width: 16, err: ErrTooWide},
+		{name: "Too tall", data: tall, width: 16, err: ErrDerivativeTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lqip, err := NewLQIP(context.Background(), tt.data, tt.width, 30, 1, tt.svg)
+			assert.Equal(t, tt.err, err)
+			if tt.err != nil {
+				return
+			}
+			assert.Equal(t, tt.width, lqip.Width)
+			assert.Equal(t, tt.height, lqip.Height)
+			assert.InDelta(t, 4.0/3, lqip.AspectRatio, 1e-9)
+
+			mediaType, data := decodeDataURI(t, lqip.DataURI)
+			assert.Equal(t, tt.mediaType, mediaType)
+			if tt.svg {
+				svg := string(data)
+				assert.Contains(t, svg, `viewBox="0 0 16 12"`)
+				assert.Contains(t, svg, `style="filter:blur(1px)"`)
+				start := strings.Index(svg, `href="`) + len(`href="`)
+				data = data[start : start+strings.Index(svg[start:], `"`)]
+				mediaType, data = decodeDataURI(t, string(data))
+				assert.Equal(t, "image/jpeg", mediaType)
+			}
+			img, _, err := image.Decode(bytes.NewReader(data))
+			assert.NoError(t, err)
+			assert.Equal(t, image.Rect(0, 0, tt.width, tt.height), img.Bounds())
+		})
+	}
+}
+
+func TestNewLQIPBlur(t *testing.T) {
+	data, err := EncodeImage(context.Background(), noisyImage(), "png")
+	assert.NoError(t, err)
+
+	sharp, err := NewLQIP(context.Background(), data, 32, 100, 0, false)
+	assert.NoError(t, err)
+	blurred, err := NewLQIP(context.Background(), data, 32, 100, 2, false)
+	assert.NoError(t, err)
+
+	// Blurring removes detail, which makes the placeholder compress better
+	_, sharpData := decodeDataURI(t, sharp.DataURI)
+	_, blurredData := decodeDataURI(t, blurred.DataURI)
+	assert.Less(t, len(blurredData), len(sharpData))
+
+	// The SVG variant leaves the blur to its CSS filter
+	svg, err := NewLQIP(context.Background(), data, 32, 100, 2, true)
+	assert.NoError(t, err)
+	_, svgData := decodeDataURI(t, svg.DataURI)
+	assert.Contains(t, string(svgData), sharp.DataURI)
+}
+
+func TestHandleLQIP(t *testing.T) {
+	data, err := EncodeImage(context.Background(), photoImage(400, 300), "png")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		query string
+		body  []byte
+		code  int
+		width int
+	}{
+		{name: "Defaults", body: data, code: http.StatusOK, width: 16},
+		{name: "Custom", query: "width=24&quality=10&blur=0.5&svg=true", body: data, code: http.StatusOK, width: 24},
+		{name: "Invalid width", query: "width=65", body: data, code: http.StatusBadRequest},
+		{name: "Invalid quality", query: "quality=0", body: data, code: http.StatusBadRequest},
+		{name: "Invalid blur", query: "blur=-1", body: data, code: http.StatusBadRequest},
+		{name: "Blur too strong", query: "blur=11", body: data, code: http.StatusBadRequest},
+		{name: "Invalid svg", query: "svg=maybe", body: data, code: http.StatusBadRequest},
+		{name: "Invalid image", body: []byte("not an image"), code: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/lqip?"+tt.query, bytes.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+
+			handler := Handler(HandleLQIP)
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			var lqip LQIP
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &lqip))
+			assert.Equal(t, tt.width, lqip.Width)
+			assert.True(t, strings.HasPrefix(lqip.DataURI, "data:image/"))
+		})
+	}
+}
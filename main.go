@@ -3,6 +3,9 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"image"
@@ -16,8 +19,7 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
-
-	"golang.org/x/image/draw"
+	"time"
 )
 
 var (
@@ -25,6 +27,11 @@ var (
 	ErrUnsupportedFormat = fmt.Errorf("unsupported format")
 	// ErrInvalidImage is returned when an invalid image is encountered
 	ErrInvalidImage = fmt.Errorf("invalid image")
+	// ErrTooLarge is returned when an image cannot be encoded within the requested size
+	ErrTooLarge = fmt.Errorf("image cannot be encoded within max_bytes")
+	// ErrDerivativeTooLarge is returned when a processed image would be larger than
+	// maxDerivativeSize and its source image
+	ErrDerivativeTooLarge = fmt.Errorf("derivative too large")
 )
 
 const (
@@ -32,6 +39,12 @@ const (
 	formatJPEG = "jpeg"
 	formatPNG  = "png"
 	formatGIF  = "gif"
+	// formatPNG8 is PNG with an indexed palette of at most 256 colors
+	formatPNG8 = "png8"
+	// formatAuto negotiates the output format from the Accept header
+	formatAuto = "auto"
+	// formatSmallest selects the format with the smallest output
+	formatSmallest = "smallest"
 )
 
 func main() {
@@ -39,13 +52,89 @@ func main() {
 
 	addr := fmt.Sprintf("%s:%d", flags.Host, flags.Port)
 	mux := http.NewServeMux()
-	mux.Handle("POST /resize", Handler(HandleResize))
-	mux.Handle("POST /convert", Handler(HandleConvert))
-	mux.Handle("POST /thumbnail", Handler(HandleThumbnail))
+	cacheControl, err := ParseCacheControl(flags.CacheControl)
+	if err != nil {
+		log.Fatalf("Error parsing cache control: %v\n", err)
+	}
+
+	cache := NewMemoryCache(flags.CacheSize)
+	mux.Handle("POST /resize", Persist(CacheControl(cacheControl["resize"], Cached(cache, HandleResize))))
+	mux.Handle("POST /convert", Persist(CacheControl(cacheControl["convert"], Cached(cache, HandleConvert))))
+	mux.Handle("POST /thumbnail", Persist(CacheControl(cacheControl["thumbnail"], Cached(cache, HandleThumbnail))))
+	mux.Handle("POST /rotate", Persist(CacheControl(cacheControl["rotate"], Cached(cache, HandleRotate))))
+	mux.Handle("POST /crop", Persist(CacheControl(cacheControl["crop"], Cached(cache, HandleCrop))))
+	mux.Handle("POST /watermark", Persist(CacheControl(cacheControl["watermark"], Cached(cache, HandleWatermark))))
+	mux.Handle("POST /compare", Handler(HandleCompare))
+	mux.Handle("POST /hash", Handler(HandleHash))
+	mux.Handle("POST /placeholder", Handler(HandlePlaceholder))
+	mux.Handle("GET /placeholder/blurhash", Handler(HandleDecodeBlurHash))
+	mux.Handle("GET /placeholder/thumbhash", Handler(HandleDecodeThumbHash))
+	mux.Handle("POST /lqip", Handler(HandleLQIP))
+	mux.Handle("POST /palette", Handler(HandlePalette))
+
+	var storage Storage = NewMemoryStorage()
+	if flags.StorageDir != "" {
+		fs, err := NewFileStorage(flags.StorageDir)
+		if err != nil {
+			log.Fatalf("Error opening storage directory: %v\n", err)
+		}
+		storage = fs
+	}
+	caches := map[string]Cache{"memory": cache}
+	var derivatives Cache = cache
+	if flags.CacheDir != "" {
+		disk, err := NewDiskCache(flags.CacheDir, flags.DiskCacheSize, flags.CacheTTL)
+		if err != nil {
+			log.Fatalf("Error opening cache directory: %v\n", err)
+		}
+		caches["disk"] = disk
+		derivatives = TieredCache{cache, disk}
+	}
+	mux.Handle("GET /cache/stats", HandleCacheStats(caches))
+
+	images := NewImageService(storage, derivatives)
+	if err := images.Reindex(context.Background()); err != nil {
+		log.Printf("Error indexing stored images: %v\n", err)
+	}
+	mux.Handle("POST /images", Handler(images.HandleUpload))
+	mux.Handle("GET /images", Handler(images.HandleList))
+	mux.Handle("POST /images/duplicates", Handler(images.HandleDuplicates))
+	mux.Handle("GET /images/{id}", CacheControl(cacheControl["images"], images.HandleGet))
+	mux.Handle("DELETE /images/{id}", Handler(images.HandleDelete))
+
+	var handler http.Handler = mux
+	if flags.S3.Bucket != "" {
+		store, err := NewS3Store(flags.S3)
+		if err != nil {
+			log.Fatalf("Error configuring S3: %v\n", err)
+		}
+		handler = WithSource(store, WithDestination(store, handler))
+	}
+	if flags.Watermark != "" {
+		overlay, err := LoadWatermark(flags.Watermark)
+		if err != nil {
+			log.Fatalf("Error loading watermark: %v\n", err)
+		}
+		handler = WithOverlay(overlay, handler)
+	}
+	if flags.FontDir != "" {
+		fonts, err := LoadFonts(flags.FontDir)
+		if err != nil {
+			log.Fatalf("Error loading fonts: %v\n", err)
+		}
+		handler = WithFonts(fonts, handler)
+	}
+	if flags.SourceDir != "" {
+		src, err := NewFileSource(flags.SourceDir)
+		if err != nil {
+			log.Fatalf("Error opening source directory: %v\n", err)
+		}
+		handler = WithSource(src, handler)
+	}
 
 	shutdownCtx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
-	srv := &http.Server{Addr: addr, Handler: mux}
+	srv := &http.Server{Addr: addr, Handler: handler}
 	go func() {
 		log.Printf("Listening on %s\n", addr)
 		log.Println(srv.ListenAndServe())
@@ -62,12 +151,47 @@ type Flags struct {
 	Host string
 	// Port is the port to listen on
 	Port int
+	// SourceDir is the directory images are read from when a request names a source key
+	SourceDir string
+	// S3 configures the S3-compatible bucket images are read from and written to
+	S3 S3Config
+	// StorageDir is the directory uploaded images are stored in; empty keeps them in memory
+	StorageDir string
+	// CacheSize is the maximum total size in bytes of processed images cached in memory
+	CacheSize int64
+	// CacheDir is the directory derivatives are cached in on disk; empty disables the disk cache
+	CacheDir string
+	// DiskCacheSize is the maximum total size in bytes of the disk cache
+	DiskCacheSize int64
+	// CacheTTL is how long derivatives are kept in the disk cache; zero keeps them until evicted
+	CacheTTL time.Duration
+	// CacheControl lists the Cache-Control header values of routes, see ParseCacheControl
+	CacheControl string
+	// Watermark is the path of the overlay image composited over images that request a watermark
+	Watermark string
+	// FontDir is the directory of TrueType and OpenType fonts text can be drawn in besides the bundled fonts
+	FontDir string
 }
 
 // ParseFlags parses the command-line flags and returns a Flags struct.
 func ParseFlags() Flags {
 	host := flag.String("host", "localhost", "host to listen on")
 	port := flag.Int("port", 8080, "port to listen on")
+	sourceDir := flag.String("source-dir", "", "directory to read source images from")
+	s3Endpoint := flag.String("s3-endpoint", "", "endpoint of the S3-compatible object store")
+	s3Bucket := flag.String("s3-bucket", "", "bucket to read source images from and write results to")
+	s3Region := flag.String("s3-region", "", "region of the S3 bucket")
+	s3AccessKey := flag.String("s3-access-key", "", "access key ID for the S3 bucket")
+	s3SecretKey := flag.String("s3-secret-key", "", "secret access key for the S3 bucket")
+	s3PathStyle := flag.Bool("s3-path-style", false, "address the S3 bucket in the URL path")
+	storageDir := flag.String("storage-dir", "", "directory to store uploaded images in (default in memory)")
+	cacheSize := flag.Int64("cache-size", 64<<20, "maximum size in bytes of the in-memory result cache")
+	cacheDir := flag.String("cache-dir", "", "directory to cache derivatives in on disk")
+	diskCacheSize := flag.Int64("disk-cache-size", 1<<30, "maximum size in bytes of the disk cache")
+	cacheTTL := flag.Duration("cache-ttl", 24*time.Hour, "time to keep derivatives in the disk cache")
+	cacheControl := flag.String("cache-control", "", "Cache-Control header per route, e.g. \"resize=public, max-age=3600;images=public, immutable\"")
+	watermark := flag.String("watermark", "", "path of the watermark image to composite over images that request it")
+	fontDir := flag.String("font-dir", "", "directory of TrueType and OpenType fonts to draw text in")
 	flag.VisitAll(func(f *flag.Flag) {
 		envKey := strings.ReplaceAll(strings.ToUpper(f.Name), "-", "_")
 		if value, ok := os.LookupEnv(envKey); ok {
@@ -75,7 +199,27 @@ func ParseFlags() Flags {
 		}
 	})
 	flag.Parse()
-	return Flags{*host, *port}
+	return Flags{
+		Host:      *host,
+		Port:      *port,
+		SourceDir: *sourceDir,
+		S3: S3Config{
+			Endpoint:  *s3Endpoint,
+			Bucket:    *s3Bucket,
+			Region:    *s3Region,
+			AccessKey: *s3AccessKey,
+			SecretKey: *s3SecretKey,
+			PathStyle: *s3PathStyle,
+		},
+		StorageDir:    *storageDir,
+		CacheSize:     *cacheSize,
+		CacheDir:      *cacheDir,
+		DiskCacheSize: *diskCacheSize,
+		CacheTTL:      *cacheTTL,
+		CacheControl:  *cacheControl,
+		Watermark:     *watermark,
+		FontDir:       *fontDir,
+	}
 }
 
 // Handler is a type that wraps an http.Handler with a custom handler function.
@@ -98,12 +242,29 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // On success, it returns the resized image.
 //
 // Query Parameters:
-// - height: The desired height of the resized image (required).
-// - width: The desired width of the resized image (required).
+// - height: The desired height of the resized image, at least 1 (required).
+// - width: The desired width of the resized image, at least 1 (required).
+// - src: The key of a source image to resize instead of the request body (optional).
+// - format: The output format, "auto" to negotiate it from the Accept header, or "smallest" (optional).
+// - quality: The JPEG quality between 1 and 100 (optional).
+// - max_bytes, downscale, target_ssim: Encoding limits and targets, see ParseOptions (optional). With max_bytes,
+// JPEG images are encoded at the highest quality that fits, up to quality if given and 100 otherwise.
+// - quantizer, dither, colors: Palette reduction of GIF and PNG8 images, see ParseOptions (optional).
+// - background: The color transparent areas are flattened onto in JPEG output, see ParseOptions (optional).
+// - angle, flip, kernel, expand: Rotation of the source image before it is resized, see ParseOptions (optional).
+// - trim, trim_color, trim_tolerance, trim_padding: Trimming of a uniform border before resizing, see ParseOptions (optional).
+// - crop: The rectangle to crop the source image to before it is resized, see ParseOptions (optional).
+// - blur, box_blur, sharpen, sharpen_radius, sharpen_threshold: Filters applied to the resized image, see ParseOptions (optional).
+// - watermark, watermark_gravity, watermark_offset, watermark_scale, watermark_opacity, watermark_tile:
+// The watermark composited over the resized image, see ParseOptions (optional).
+// - text, text_font, text_size, text_color, text_stroke, text_stroke_color, text_align, text_width, text_gravity,
+// text_offset: Text drawn over the resized image, see ParseOptions (optional).
 //
 // Responses:
 // - 400 Bad Request: If the height or width parameters are missing or invalid.
-// - 422 Unprocessable Entity: If the image format is unsupported.
+// - 404 Not Found: If the source image does not exist.
+// - 422 Unprocessable Entity: If the image format is unsupported, the crop rectangle is out of bounds, the resized image
+// is larger than 4096 pixels and the image in either dimension, or it does not fit within max_bytes.
 // - 500 Internal Server Error: If an error occurs during resizing.
 // - 200 OK: If the image is successfully resized.
 func HandleResize(w http.ResponseWriter, r *http.Request) http.Handler {
@@ -119,18 +280,33 @@ func HandleResize(w http.ResponseWriter, r *http.Request) http.Handler {
 
 	// Parse height and width
 	height, err := strconv.Atoi(heightParam)
-	if err != nil {
+	if err != nil || height < 1 {
 		return Error(http.StatusBadRequest, fmt.Errorf("invalid height: %s", heightParam))
 	}
 
 	width, err := strconv.Atoi(widthParam)
-	if err != nil {
+	if err != nil || width < 1 {
 		return Error(http.StatusBadRequest, fmt.Errorf("invalid width: %s", widthParam))
 	}
 
+	// Parse options
+	opts, err := ParseOptions(r)
+	if err != nil {
+		return Error(http.StatusBadRequest, err)
+	}
+	var report Report
+	opts = append(opts, WithReport(&report))
+
+	// Open image
+	body, info, err := RequestImage(r)
+	if err != nil {
+		return SourceError(err)
+	}
+	defer body.Close()
+
 	// Resize image
-	resized, err := ResizeImage(r.Context(), r.Body, height, width)
-	if err == ErrUnsupportedFormat {
+	resized, err := ResizeImage(r.Context(), body, height, width, opts...)
+	if err == ErrUnsupportedFormat || err == ErrTooLarge || err == ErrCropOutOfBounds || err == ErrDerivativeTooLarge {
 		return Error(http.StatusUnprocessableEntity, err)
 	}
 	if err != nil {
@@ -138,12 +314,13 @@ func HandleResize(w http.ResponseWriter, r *http.Request) http.Handler {
 	}
 
 	// Return resized image
-	return Image(http.StatusOK, resized)
+	return Image(http.StatusOK, resized).LastModified(info.ModTime).Encoded(report)
 }
 
 // ResizeImage resizes an image to the specified height and width.
 // It takes a context for cancellation, an io.Reader to read the image,
-// and the desired height and width of the resized image.
+// and the desired height and width of the resized image. The resized image keeps the
+// color model and bit depth of the source, see Resample.
 // It returns the resized image as a byte slice and an error if any occurred.
 //
 // Parameters:
@@ -152,34 +329,47 @@ func HandleResize(w http.ResponseWriter, r *http.Request) http.Handler {
 //	r - io.Reader to read the image
 //	height - desired height of the resized image
 //	width - desired width of the resized image
+//	opts - options controlling how the resized image is encoded
 //
 // Returns:
 //
 //	[]byte - the resized image as a byte slice
 //	error - an error if any occurred during the resizing process
-func ResizeImage(ctx context.Context, r io.Reader, height, width int) ([]byte, error) {
+func ResizeImage(ctx context.Context, r io.Reader, height, width int, opts ...Option) ([]byte, error) {
 	img, format, err := image.Decode(r)
 	if err != nil {
 		return nil, ErrInvalidImage
 	}
 
-	rect := image.Rect(0, 0, width, height)
-	resized := image.NewRGBA(rect)
-
-	draw.CatmullRom.Scale(resized, rect, img, img.Bounds(), draw.Over, nil)
-
-	return EncodeImage(ctx, resized, format)
+	o := newOptions(opts)
+	img, err = o.prepare(img)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDerivativeSize(img.Bounds(), width, height); err != nil {
+		return nil, err
+	}
+	resized := Resample(img, width, height)
+	return o.encode(ctx, o.apply(resized), format)
 }
 
 // HandleConvert handles the image conversion request. It parses the query parameters,
 // validates them, converts the image to the specified format, and returns the converted image.
 //
 // Query Parameters:
-// - format: The desired image format (e.g., "jpeg", "png").
+// - format: The desired image format (e.g., "jpeg", "png"), "auto" to negotiate it from the Accept header,
+// or "smallest" to select the format with the smallest output whose JPEG candidate reaches target_ssim,
+// or an MS-SSIM of 0.98 without it.
+// - src: The key of a source image to convert instead of the request body (optional).
+// - quality: The JPEG quality between 1 and 100 (optional).
+// - max_bytes, downscale, target_ssim: Encoding limits and targets, see ParseOptions (optional). With max_bytes,
+// JPEG images are encoded at the highest quality that fits, up to quality if given and 100 otherwise.
 //
 // Responses:
 // - 400 Bad Request: If the required "format" parameter is missing.
-// - 422 Unprocessable Entity: If the specified format is unsupported.
+// - 404 Not Found: If the source image does not exist.
+// - 422 Unprocessable Entity: If the specified format is unsupported, the crop rectangle is out of bounds, the rotated
+// image is larger than 4096 pixels and the image in either dimension, or it does not fit within max_bytes.
 // - 500 Internal Server Error: If an error occurs during image conversion.
 // - 200 OK: If the image is successfully converted and returned.
 func HandleConvert(w http.ResponseWriter, r *http.Request) http.Handler {
@@ -192,9 +382,24 @@ func HandleConvert(w http.ResponseWriter, r *http.Request) http.Handler {
 		return Error(http.StatusBadRequest, fmt.Errorf("missing required parameter: format"))
 	}
 
+	// Parse options
+	opts, err := ParseOptions(r)
+	if err != nil {
+		return Error(http.StatusBadRequest, err)
+	}
+	var report Report
+	opts = append(opts, WithReport(&report))
+
+	// Open image
+	body, info, err := RequestImage(r)
+	if err != nil {
+		return SourceError(err)
+	}
+	defer body.Close()
+
 	// Convert image
-	converted, err := ConvertImage(r.Context(), r.Body, format)
-	if err == ErrUnsupportedFormat {
+	converted, err := ConvertImage(r.Context(), body, format, opts...)
+	if err == ErrUnsupportedFormat || err == ErrTooLarge || err == ErrCropOutOfBounds || err == ErrDerivativeTooLarge {
 		return Error(http.StatusUnprocessableEntity, err)
 	}
 	if err != nil {
@@ -202,27 +407,37 @@ func HandleConvert(w http.ResponseWriter, r *http.Request) http.Handler {
 	}
 
 	// Return converted image
-	return Image(http.StatusOK, converted)
+	return Image(http.StatusOK, converted).LastModified(info.ModTime).Encoded(report)
 }
 
 // ConvertImage reads an image from the provided io.Reader, decodes it, and then encodes it into the specified format.
 // The function takes a context for managing timeouts and cancellations, an io.Reader from which the image is read,
 // and a string specifying the desired output format (e.g., "jpeg", "png").
 // It returns the encoded image as a byte slice or an error if the decoding or encoding fails.
-func ConvertImage(ctx context.Context, r io.Reader, format string) ([]byte, error) {
+func ConvertImage(ctx context.Context, r io.Reader, format string, opts ...Option) ([]byte, error) {
 	img, _, err := image.Decode(r)
 	if err != nil {
 		return nil, ErrInvalidImage
 	}
 
-	return EncodeImage(ctx, img, format)
+	o := newOptions(opts)
+	o.Format = format
+	img, err = o.prepare(img)
+	if err != nil {
+		return nil, err
+	}
+	return o.encode(ctx, o.apply(img), format)
 }
 
 // HandleThumbnail handles the generation of a thumbnail image based on the provided width query parameter.
-// It expects the width parameter to be present in the query string and to be a valid integer.
+// It expects the width parameter to be present in the query string and to be a positive integer.
 // If the width parameter is missing or invalid, it returns an appropriate error response.
-// It generates the thumbnail image using the provided image data in the request body and the specified width.
-// If the image format is unsupported, it returns an unprocessable entity error.
+// It generates the thumbnail image using the provided image data in the request body, or the source image
+// named by the src query parameter, and the specified width. The optional format parameter selects the
+// output format; "auto" negotiates it from the Accept header. With placeholder=true the BlurHash and
+// ThumbHash of the thumbnail are returned in the X-BlurHash and X-ThumbHash headers.
+// If the image format is unsupported, the thumbnail is larger than 4096 pixels and the image in either
+// dimension, or it does not fit within max_bytes, it returns an unprocessable entity error.
 // If any other error occurs during thumbnail generation, it returns an internal server error.
 // On success, it returns the generated thumbnail image with an HTTP status OK.
 func HandleThumbnail(w http.ResponseWriter, r *http.Request) http.Handler {
@@ -237,13 +452,28 @@ func HandleThumbnail(w http.ResponseWriter, r *http.Request) http.Handler {
 
 	// Parse width
 	width, err := strconv.Atoi(widthParam)
-	if err != nil {
+	if err != nil || width < 1 {
 		return Error(http.StatusBadRequest, fmt.Errorf("invalid width: %s", widthParam))
 	}
 
+	// Parse options
+	opts, err := ParseOptions(r)
+	if err != nil {
+		return Error(http.StatusBadRequest, err)
+	}
+	var report Report
+	opts = append(opts, WithReport(&report))
+
+	// Open image
+	body, info, err := RequestImage(r)
+	if err != nil {
+		return SourceError(err)
+	}
+	defer body.Close()
+
 	// Generate thumbnail
-	thumbnail, err := ThumbnailImage(r.Context(), r.Body, width)
-	if err == ErrUnsupportedFormat {
+	thumbnail, err := ThumbnailImage(r.Context(), body, width, opts...)
+	if err == ErrUnsupportedFormat || err == ErrTooLarge || err == ErrCropOutOfBounds || err == ErrDerivativeTooLarge {
 		return Error(http.StatusUnprocessableEntity, err)
 	}
 	if err != nil {
@@ -251,17 +481,19 @@ func HandleThumbnail(w http.ResponseWriter, r *http.Request) http.Handler {
 	}
 
 	// Return thumbnail
-	return Image(http.StatusOK, thumbnail)
+	return Image(http.StatusOK, thumbnail).LastModified(info.ModTime).Encoded(report)
 }
 
 // ThumbnailImage resizes an image to the specified width while maintaining the aspect ratio.
-// It reads the image from the provided io.Reader, decodes it, and then scales it to the new dimensions.
+// It reads the image from the provided io.Reader, decodes it, and then scales it to the new dimensions,
+// keeping the color model and bit depth of the source.
 // The resized image is then encoded back to the original format and returned as a byte slice.
 //
 // Parameters:
 //   - ctx: The context for managing the lifecycle of the request.
 //   - r: An io.Reader from which the image is read.
 //   - width: The desired width of the resized image.
+//   - opts: Options controlling how the resized image is encoded.
 //
 // Returns:
 //   - A byte slice containing the resized image.
@@ -269,54 +501,90 @@ func HandleThumbnail(w http.ResponseWriter, r *http.Request) http.Handler {
 //
 // Possible errors:
 //   - ErrInvalidImage: If the image cannot be decoded.
-func ThumbnailImage(ctx context.Context, r io.Reader, width int) ([]byte, error) {
+//   - ErrDerivativeTooLarge: If the thumbnail would be larger than maxDerivativeSize and the image.
+func ThumbnailImage(ctx context.Context, r io.Reader, width int, opts ...Option) ([]byte, error) {
 	img, format, err := image.Decode(r)
 	if err != nil {
 		return nil, ErrInvalidImage
 	}
 
+	o := newOptions(opts)
+	img, err = o.prepare(img)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDerivativeSize(img.Bounds(), width, 0); err != nil {
+		return nil, err
+	}
 	rect := img.Bounds()
 	height := rect.Dy() * width / rect.Dx()
-	rect = image.Rect(0, 0, width, height)
-	resized := image.NewRGBA(rect)
-
-	draw.CatmullRom.Scale(resized, rect, img, img.Bounds(), draw.Over, nil)
-
-	return EncodeImage(ctx, resized, format)
+	if err := checkDerivativeSize(rect, width, height); err != nil {
+		return nil, err
+	}
+	resized := Resample(img, width, height)
+	return o.encode(ctx, o.apply(resized), format)
 }
 
 // EncodeImage encodes an image.Image into the specified format and returns the encoded bytes.
-// Supported formats are "jpeg" and "png". If an unsupported format is provided, it returns an error.
+// Supported formats are "jpeg", "png", "png8" and "gif". GIF and PNG8 images are reduced to
+// a palette with Quantize. If an unsupported format is provided, it returns an error.
 //
 // Parameters:
 //
 //	ctx - The context for the encoding operation.
 //	img - The image to be encoded.
-//	format - The format to encode the image in ("jpeg" or "png").
+//	format - The format to encode the image in ("jpeg", "png", "png8" or "gif").
+//	opts - Options controlling the encoder, such as the JPEG quality or the quantizer.
 //
 // Returns:
 //
 //	A byte slice containing the encoded image data, and an error if the encoding fails or the format is unsupported.
-func EncodeImage(ctx context.Context, img image.Image, format string) ([]byte, error) {
+func EncodeImage(ctx context.Context, img image.Image, format string, opts ...Option) ([]byte, error) {
+	o := newOptions(opts)
 	buf := bytes.Buffer{}
 	switch format {
 	case formatJPEG:
-		err := jpeg.Encode(&buf, img, nil)
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: o.quality()})
 		return buf.Bytes(), err
 	case formatPNG:
 		err := png.Encode(&buf, img)
 		return buf.Bytes(), err
+	case formatPNG8:
+		paletted, err := Quantize(img, o.Quantizer, o.Dither, o.colors())
+		if err != nil {
+			return nil, err
+		}
+		err = png.Encode(&buf, paletted)
+		return buf.Bytes(), err
 	case formatGIF:
-		err := gif.Encode(&buf, img, nil)
+		paletted, err := Quantize(img, o.Quantizer, o.Dither, o.colors())
+		if err != nil {
+			return nil, err
+		}
+		err = gif.Encode(&buf, paletted, nil)
 		return buf.Bytes(), err
 	default:
 		return buf.Bytes(), ErrUnsupportedFormat
 	}
 }
 
-// Image returns an http.HandlerFunc that serves the provided data with the specified HTTP status code.
+// ImageResponse is an http.Handler that serves an encoded image. Handlers return it
+// from Image so that middleware can inspect the image before it is written.
+type ImageResponse struct {
+	// Code is the HTTP status code of the response
+	Code int
+	// Data is the encoded image
+	Data []byte
+	// Header holds additional headers to send with the response
+	Header http.Header
+	// ModTime is the time the source of the image was last modified, if known
+	ModTime time.Time
+}
+
+// Image returns an ImageResponse that serves the provided data with the specified HTTP status code.
 // The Content-Type header is set based on the detected content type of the data, and the Content-Length
-// header is set to the length of the data.
+// header is set to the length of the data. Successful responses carry a strong ETag computed from the
+// data and honor conditional request headers.
 //
 // Parameters:
 //   - code: The HTTP status code to be used in the response.
@@ -324,11 +592,97 @@ func EncodeImage(ctx context.Context, img image.Image, format string) ([]byte, e
 //
 // Returns:
 //
-//	An http.HandlerFunc that writes the data to the response with the specified headers and status code.
-func Image(code int, data []byte) http.HandlerFunc {
+//	An ImageResponse that writes the data to the response with the specified headers and status code.
+func Image(code int, data []byte) *ImageResponse {
+	return &ImageResponse{Code: code, Data: data, Header: http.Header{}}
+}
+
+// LastModified sets the time reported in the Last-Modified header and used to
+// evaluate If-Modified-Since, and returns resp.
+func (resp *ImageResponse) LastModified(t time.Time) *ImageResponse {
+	resp.ModTime = t
+	return resp
+}
+
+// ServeHTTP writes the image and its headers to the response. Successful responses
+// are served with http.ServeContent, which answers If-None-Match and If-Modified-Since
+// with 304 Not Modified when the client already has the image.
+func (resp *ImageResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	if resp.Code == http.StatusNotModified {
+		if !resp.ModTime.IsZero() {
+			w.Header().Set("Last-Modified", resp.ModTime.UTC().Format(http.TimeFormat))
+		}
+		w.WriteHeader(resp.Code)
+		return
+	}
+
+	contentType := http.DetectContentType(resp.Data)
+	w.Header().Set("Content-Type", contentType)
+
+	if resp.Code != http.StatusOK {
+		w.Header().Set("Content-Length", strconv.Itoa(len(resp.Data)))
+		w.WriteHeader(resp.Code)
+		w.Write(resp.Data)
+		return
+	}
+
+	if w.Header().Get("ETag") == "" {
+		w.Header().Set("ETag", ETag(resp.Data))
+	}
+	http.ServeContent(w, r, "", resp.ModTime, bytes.NewReader(resp.Data))
+}
+
+// ETag returns a strong entity tag for data.
+func ETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// CacheControl returns a Handler that sets the Cache-Control header of successful
+// and not modified image responses produced by h to value. An empty value leaves
+// responses unchanged.
+func CacheControl(value string, h Handler) Handler {
+	if value == "" {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) http.Handler {
+		next := h(w, r)
+		if resp, ok := next.(*ImageResponse); ok && (resp.Code == http.StatusOK || resp.Code == http.StatusNotModified) {
+			resp.Header.Set("Cache-Control", value)
+		}
+		return next
+	}
+}
+
+// ParseCacheControl parses a list of per-route Cache-Control values of the form
+// "route=value;route=value", e.g. "resize=public, max-age=3600;images=immutable".
+func ParseCacheControl(s string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, entry := range strings.Split(s, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		route, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid cache control: %s", entry)
+		}
+		values[strings.TrimSpace(route)] = strings.TrimSpace(value)
+	}
+	return values, nil
+}
+
+// JSON returns an http.HandlerFunc that serves v encoded as JSON with the specified HTTP status code.
+func JSON(code int, v any) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		contentType := http.DetectContentType(data)
-		w.Header().Set("Content-Type", contentType)
+		data, err := json.Marshal(v)
+		if err != nil {
+			Error(http.StatusInternalServerError, err).ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
 		w.WriteHeader(code)
 		w.Write(data)
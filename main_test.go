@@ -15,6 +15,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -156,6 +157,20 @@ func TestHandleResize(t *testing.T) {
 			expectedStatus: http.StatusBadRequest,
 			expectedError:  "invalid width: abc\n",
 		},
+		{
+			name:           "Negative width",
+			queryParams:    "height=100&width=-100000",
+			imageData:      nil,
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid width: -100000\n",
+		},
+		{
+			name:           "Too large",
+			queryParams:    "height=100000&width=100000",
+			imageData:      createImage(t, "png"),
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedError:  "derivative too large\n",
+		},
 		{
 			name:           "Valid JPEG resize",
 			queryParams:    "height=50&width=50&format=jpeg",
@@ -240,6 +255,34 @@ func TestHandleConvert(t *testing.T) {
 			expectedStatus: http.StatusOK,
 			expectedError:  "",
 		},
+		{
+			name:           "Valid JPEG to PNG8 conversion",
+			queryParams:    "format=png8&quantizer=octree&dither=ordered&colors=16",
+			imageData:      createImage(t, "jpeg"),
+			expectedStatus: http.StatusOK,
+			expectedError:  "",
+		},
+		{
+			name:           "Invalid quantizer",
+			queryParams:    "format=gif&quantizer=kmeans",
+			imageData:      createImage(t, "jpeg"),
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid quantizer: kmeans\n",
+		},
+		{
+			name:           "Invalid dither",
+			queryParams:    "format=gif&dither=random",
+			imageData:      createImage(t, "jpeg"),
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid dither: random\n",
+		},
+		{
+			name:           "Invalid colors",
+			queryParams:    "format=png8&colors=1",
+			imageData:      createImage(t, "jpeg"),
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid colors: 1\n",
+		},
 	}
 
 	for _, tt := range tests {
@@ -282,6 +325,20 @@ func TestHandleThumbnail(t *testing.T) {
 			expectedStatus: http.StatusBadRequest,
 			expectedError:  "invalid width: abc\n",
 		},
+		{
+			name:           "Zero width",
+			queryParams:    "width=0",
+			imageData:      createImage(t, "png"),
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid width: 0\n",
+		},
+		{
+			name:           "Too wide",
+			queryParams:    "width=100000",
+			imageData:      createImage(t, "png"),
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedError:  "derivative too large\n",
+		},
 		{
 			name:           "Valid JPEG thumbnail",
 			queryParams:    "width=50",
@@ -335,8 +392,11 @@ func TestParseFlags(t *testing.T) {
 			envVars: map[string]string{},
 			args:    []string{},
 			expected: Flags{
-				Host: "localhost",
-				Port: 8080,
+				Host:          "localhost",
+				Port:          8080,
+				CacheSize:     64 << 20,
+				DiskCacheSize: 1 << 30,
+				CacheTTL:      24 * time.Hour,
 			},
 		},
 		{
@@ -344,8 +404,11 @@ func TestParseFlags(t *testing.T) {
 			envVars: map[string]string{},
 			args:    []string{"-host", "127.0.0.1", "-port", "9090"},
 			expected: Flags{
-				Host: "127.0.0.1",
-				Port: 9090,
+				Host:          "127.0.0.1",
+				Port:          9090,
+				CacheSize:     64 << 20,
+				DiskCacheSize: 1 << 30,
+				CacheTTL:      24 * time.Hour,
 			},
 		},
 		{
@@ -356,8 +419,11 @@ func TestParseFlags(t *testing.T) {
 			},
 			args: []string{},
 			expected: Flags{
-				Host: "192.168.1.1",
-				Port: 7070,
+				Host:          "192.168.1.1",
+				Port:          7070,
+				CacheSize:     64 << 20,
+				DiskCacheSize: 1 << 30,
+				CacheTTL:      24 * time.Hour,
 			},
 		},
 		{
@@ -368,8 +434,11 @@ func TestParseFlags(t *testing.T) {
 			},
 			args: []string{"-host", "10.0.0.1", "-port", "6060"},
 			expected: Flags{
-				Host: "10.0.0.1",
-				Port: 6060,
+				Host:          "10.0.0.1",
+				Port:          6060,
+				CacheSize:     64 << 20,
+				DiskCacheSize: 1 << 30,
+				CacheTTL:      24 * time.Hour,
 			},
 		},
 	}
@@ -421,3 +490,75 @@ func createImage(t *testing.T, format string) []byte {
 
 	return buf.Bytes()
 }
+
+func TestImageConditional(t *testing.T) {
+	data := createImage(t, "png")
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	etag := ETag(data)
+
+	tests := []struct {
+		name           string
+		method         string
+		header         map[string]string
+		expectedStatus int
+	}{
+		{name: "Unconditional", method: http.MethodGet, expectedStatus: http.StatusOK},
+		{name: "Matching ETag", method: http.MethodGet, header: map[string]string{"If-None-Match": etag}, expectedStatus: http.StatusNotModified},
+		{name: "Matching ETag in list", method: http.MethodGet, header: map[string]string{"If-None-Match": `"other", ` + etag}, expectedStatus: http.StatusNotModified},
+		{name: "Different ETag", method: http.MethodGet, header: map[string]string{"If-None-Match": `"other"`}, expectedStatus: http.StatusOK},
+		{name: "Not modified since", method: http.MethodGet, header: map[string]string{"If-Modified-Since": modTime.Format(http.TimeFormat)}, expectedStatus: http.StatusNotModified},
+		{name: "Modified since", method: http.MethodGet, header: map[string]string{"If-Modified-Since": modTime.Add(-time.Hour).Format(http.TimeFormat)}, expectedStatus: http.StatusOK},
+		{name: "ETag takes precedence", method: http.MethodGet, header: map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": modTime.Format(http.TimeFormat)}, expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", nil)
+			for key, value := range tt.header {
+				req.Header.Set(key, value)
+			}
+			rr := httptest.NewRecorder()
+
+			Image(http.StatusOK, data).LastModified(modTime).ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			assert.Equal(t, etag, rr.Header().Get("ETag"))
+			if tt.expectedStatus == http.StatusOK {
+				assert.Equal(t, modTime.Format(http.TimeFormat), rr.Header().Get("Last-Modified"))
+				assert.Equal(t, "image/png", rr.Header().Get("Content-Type"))
+				assert.Equal(t, data, rr.Body.Bytes())
+			} else {
+				assert.Empty(t, rr.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	handler := CacheControl("public, max-age=60", HandleThumbnail)
+
+	req := httptest.NewRequest(http.MethodPost, "/thumbnail?width=50", bytes.NewReader(createImage(t, "png")))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "public, max-age=60", rr.Header().Get("Cache-Control"))
+
+	// Errors are not cacheable
+	req = httptest.NewRequest(http.MethodPost, "/thumbnail", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Empty(t, rr.Header().Get("Cache-Control"))
+}
+
+func TestParseCacheControl(t *testing.T) {
+	values, err := ParseCacheControl("resize=public, max-age=3600; images = public, max-age=31536000, immutable;")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"resize": "public, max-age=3600",
+		"images": "public, max-age=31536000, immutable",
+	}, values)
+
+	_, err = ParseCacheControl("resize")
+	assert.Error(t, err)
+}
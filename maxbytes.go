@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"image"
+)
+
+const (
+	// downscaleFactor is the factor each downscale step multiplies the dimensions by
+	downscaleFactor = 0.75
+	// maxDownscaleSteps is the number of times an image is scaled down before giving up
+	maxDownscaleSteps = 8
+)
+
+// fit encodes img within o.MaxBytes in the format recorded in report. JPEG images are
+// encoded at the highest quality that fits, found by binary search up to o.Quality, or
+// up to 100 if no quality was requested. If nothing fits and o.Downscale is set, the image is scaled down in
+// steps and tried again. report is updated with the chosen quality. It returns
+// ErrTooLarge if the image cannot be made to fit.
+func (o *Options) fit(ctx context.Context, img image.Image, report *Report) ([]byte, error) {
+	maxQuality := o.Quality
+	if maxQuality == 0 {
+		maxQuality = 100
+	}
+	steps := 0
+	if o.Downscale {
+		steps = maxDownscaleSteps
+	}
+
+	for step := 0; step <= steps; step++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if step > 0 {
+			bounds := img.Bounds()
+			width := int(float64(bounds.Dx()) * downscaleFactor)
+			height := int(float64(bounds.Dy()) * downscaleFactor)
+			if width < 1 || height < 1 {
+				break
+			}
+			img = Resample(img, width, height)
+		}
+
+		if report.Format != formatJPEG {
+			if step == 0 {
+				// Lossless formats have no quality to lower
+				continue
+			}
+			data, err := EncodeImage(ctx, img, report.Format, o.encoder())
+			if err != nil {
+				return nil, err
+			}
+			if len(data) <= o.MaxBytes {
+				return data, nil
+			}
+			continue
+		}
+
+		data, quality, err := searchQuality(ctx, img, maxQuality, o.MaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			report.Quality = quality
+			return data, nil
+		}
+	}
+
+	return nil, ErrTooLarge
+}
+
+// searchQuality returns the JPEG encoding of img with the highest quality up to
+// maxQuality that is at most maxBytes long, and that quality. It returns nil data
+// if the image does not fit even at the lowest quality.
+func searchQuality(ctx context.Context, img image.Image, maxQuality, maxBytes int) ([]byte, int, error) {
+	var best []byte
+	bestQuality := 0
+	lo, hi := 1, maxQuality
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		data, err := EncodeImage(ctx, img, formatJPEG, WithQuality(mid))
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(data) <= maxBytes {
+			best, bestQuality = data, mid
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	return best, bestQuality, nil
+}
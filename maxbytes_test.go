@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeMaxBytes(t *testing.T) {
+	full, err := EncodeImage(context.Background(), noisyImage(), "jpeg", WithQuality(90))
+	assert.NoError(t, err)
+	smallest, err := EncodeImage(context.Background(), noisyImage(), "jpeg", WithQuality(1))
+	assert.NoError(t, err)
+	lossless, err := EncodeImage(context.Background(), noisyImage(), "png")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		format    string
+		maxBytes  int
+		downscale bool
+		err       error
+		scaled    bool
+	}{
+		{name: "Fits at requested quality", format: "jpeg", maxBytes: len(full)},
+		{name: "Lowers quality", format: "jpeg", maxBytes: len(full) / 2},
+		{name: "Too large", format: "jpeg", maxBytes: len(smallest) - 1, err: ErrTooLarge},
+		{name: "Downscales", format: "jpeg", maxBytes: len(smallest) - 1, downscale: true, scaled: true},
+		{name: "Downscales lossless format", format: "png", maxBytes: len(lossless) - 1, downscale: true, scaled: true},
+		{name: "Lossless format too large", format: "png", maxBytes: len(lossless) - 1, err: ErrTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var report Report
+			o := newOptions([]Option{WithFormat(tt.format), WithQuality(90), WithMaxBytes(tt.maxBytes, tt.downscale), WithReport(&report)})
+			data, err := o.encode(context.Background(), noisyImage(), "png")
+			assert.Equal(t, tt.err, err)
+			if tt.err != nil {
+				return
+			}
+			assert.LessOrEqual(t, len(data), tt.maxBytes)
+
+			img, _, err := image.Decode(bytes.NewReader(data))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.scaled, img.Bounds().Dx() < 100)
+			if tt.format == "jpeg" {
+				assert.GreaterOrEqual(t, report.Quality, 1)
+				assert.LessOrEqual(t, report.Quality, 90)
+			}
+		})
+	}
+}
+
+func TestSearchQuality(t *testing.T) {
+	img := noisyImage()
+	limit, err := EncodeImage(context.Background(), img, "jpeg", WithQuality(50))
+	assert.NoError(t, err)
+
+	data, quality, err := searchQuality(context.Background(), img, 100, len(limit))
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, quality, 50)
+	assert.LessOrEqual(t, len(data), len(limit))
+
+	// The next quality up must not fit
+	if quality < 100 {
+		next, err := EncodeImage(context.Background(), img, "jpeg", WithQuality(quality+1))
+		assert.NoError(t, err)
+		assert.Greater(t, len(next), len(limit))
+	}
+
+	data, _, err = searchQuality(context.Background(), img, 100, 10)
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+func TestHandleConvertMaxBytes(t *testing.T) {
+	data, err := EncodeImage(context.Background(), noisyImage(), "png")
+	assert.NoError(t, err)
+
+	full, err := EncodeImage(context.Background(), noisyImage(), "jpeg", WithQuality(100))
+	assert.NoError(t, err)
+	fullSize := strconv.Itoa(len(full))
+
+	tests := []struct {
+		name       string
+		query      string
+		code       int
+		maxQuality int
+		quality    int
+	}{
+		{name: "Fits", query: "format=jpeg&max_bytes=3000", code: http.StatusOK, maxQuality: 100},
+		{name: "Fits at full quality", query: "format=jpeg&max_bytes=" + fullSize, code: http.StatusOK, maxQuality: 100, quality: 100},
+		{name: "Fits at requested quality", query: "format=jpeg&quality=60&max_bytes=" + fullSize, code: http.StatusOK, maxQuality: 60, quality: 60},
+		{name: "Does not fit", query: "format=jpeg&max_bytes=10", code: http.StatusUnprocessableEntity},
+		{name: "Downscale", query: "format=jpeg&max_bytes=1000&downscale=true", code: http.StatusOK, maxQuality: 100},
+		{name: "Invalid max_bytes", query: "format=jpeg&max_bytes=0", code: http.StatusBadRequest},
+		{name: "Invalid downscale", query: "format=jpeg&max_bytes=1000&downscale=maybe", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/convert?"+tt.query, bytes.NewReader(data))
+			rr := httptest.NewRecorder()
+
+			handler := Handler(HandleConvert)
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			maxBytes, _ := strconv.Atoi(req.URL.Query().Get("max_bytes"))
+			assert.LessOrEqual(t, rr.Body.Len(), maxBytes)
+			quality, err := strconv.Atoi(rr.Header().Get("X-Image-Quality"))
+			assert.NoError(t, err)
+			assert.LessOrEqual(t, quality, tt.maxQuality)
+			if tt.quality != 0 {
+				assert.Equal(t, tt.quality, quality)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"image"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// negotiableFormats maps the formats EncodeImage supports to their media types.
+// WebP and AVIF are not listed because no encoder for them is available.
+var negotiableFormats = []struct {
+	format    string
+	mediaType string
+}{
+	{formatJPEG, "image/jpeg"},
+	{formatPNG, "image/png"},
+	{formatGIF, "image/gif"},
+}
+
+// NegotiateFormat returns the output format that best matches an Accept header.
+// Among the formats the client accepts with the highest quality value, lossy JPEG
+// is preferred for opaque images and PNG otherwise. Images with transparency are
+// never encoded as JPEG, which has no alpha channel. If the client accepts none of
+// the supported formats, the preferred format is returned anyway.
+func NegotiateFormat(accept string, opaque bool) string {
+	preferred := []string{formatPNG, formatGIF}
+	if opaque {
+		preferred = []string{formatJPEG, formatPNG, formatGIF}
+	}
+
+	ranges := parseAccept(accept)
+	best, bestQ := preferred[0], 0.0
+	for _, format := range preferred {
+		if q := acceptQuality(ranges, mediaTypeOf(format)); q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// acceptedFormats returns the supported formats accepted by an Accept header, ordered
+// by preference. Requests with the same accepted formats negotiate the same format.
+func acceptedFormats(accept string) []string {
+	ranges := parseAccept(accept)
+	type accepted struct {
+		format string
+		q      float64
+	}
+	var formats []accepted
+	for _, f := range negotiableFormats {
+		if q := acceptQuality(ranges, f.mediaType); q > 0 {
+			formats = append(formats, accepted{f.format, q})
+		}
+	}
+	sort.SliceStable(formats, func(i, j int) bool { return formats[i].q > formats[j].q })
+
+	names := make([]string, len(formats))
+	for i, f := range formats {
+		names[i] = f.format + "=" + strconv.FormatFloat(f.q, 'f', -1, 64)
+	}
+	return names
+}
+
+// acceptRange is a media range of an Accept header and its quality value.
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept parses an Accept header. An empty header accepts everything.
+func parseAccept(accept string) []acceptRange {
+	if strings.TrimSpace(accept) == "" {
+		return []acceptRange{{"*/*", 1}}
+	}
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil && parsed >= 0 && parsed <= 1 {
+				q = parsed
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType, q})
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality value the most specific matching range in ranges
+// assigns to mediaType, or zero if it is not accepted.
+func acceptQuality(ranges []acceptRange, mediaType string) float64 {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, -1
+	for _, r := range ranges {
+		var s int
+		switch r.mediaType {
+		case mediaType:
+			s = 2
+		case typ + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
+
+// mediaTypeOf returns the media type of a supported format.
+func mediaTypeOf(format string) string {
+	if format == formatPNG8 {
+		return "image/png"
+	}
+	for _, f := range negotiableFormats {
+		if f.format == format {
+			return f.mediaType
+		}
+	}
+	return ""
+}
+
+// isOpaque reports whether img is fully opaque.
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
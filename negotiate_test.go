@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		accept   string
+		opaque   bool
+		expected string
+	}{
+		{name: "Empty header, opaque", accept: "", opaque: true, expected: "jpeg"},
+		{name: "Empty header, transparent", accept: "", opaque: false, expected: "png"},
+		{name: "Browser header, opaque", accept: "image/avif,image/webp,image/apng,image/*,*/*;q=0.8", opaque: true, expected: "jpeg"},
+		{name: "PNG preferred", accept: "image/png,image/jpeg;q=0.5", opaque: true, expected: "png"},
+		{name: "JPEG only, transparent", accept: "image/jpeg", opaque: false, expected: "png"},
+		{name: "GIF only", accept: "image/gif", opaque: true, expected: "gif"},
+		{name: "GIF only, transparent", accept: "image/gif", opaque: false, expected: "gif"},
+		{name: "Excluded format", accept: "image/*,image/jpeg;q=0", opaque: true, expected: "png"},
+		{name: "Nothing supported", accept: "image/webp", opaque: true, expected: "jpeg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, NegotiateFormat(tt.accept, tt.opaque))
+		})
+	}
+}
+
+func TestAcceptedFormats(t *testing.T) {
+	assert.Equal(t, []string{"jpeg=1", "png=1", "gif=1"}, acceptedFormats(""))
+	assert.Equal(t, []string{"png=1", "jpeg=0.5"}, acceptedFormats("image/png, image/jpeg;q=0.5, image/webp"))
+	assert.Empty(t, acceptedFormats("image/webp"))
+}
+
+func TestHandleConvertAuto(t *testing.T) {
+	tests := []struct {
+		name           string
+		imageData      []byte
+		accept         string
+		expectedFormat string
+	}{
+		{name: "Opaque image", imageData: createImage(t, "jpeg"), accept: "image/webp,image/*", expectedFormat: "jpeg"},
+		{name: "Opaque image, PNG preferred", imageData: createImage(t, "jpeg"), accept: "image/png", expectedFormat: "png"},
+		{name: "Transparent image", imageData: createImage(t, "png"), accept: "image/jpeg", expectedFormat: "png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/convert?format=auto", bytes.NewReader(tt.imageData))
+			req.Header.Set("Accept", tt.accept)
+			rr := httptest.NewRecorder()
+
+			handler := Handler(HandleConvert)
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, "Accept", rr.Header().Get("Vary"))
+			_, format, err := image.DecodeConfig(rr.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedFormat, format)
+		})
+	}
+}
+
+func TestCachedAuto(t *testing.T) {
+	handler := Cached(NewMemoryCache(1<<20), HandleThumbnail)
+	data := createImage(t, "jpeg")
+
+	tests := []struct {
+		name           string
+		accept         string
+		expectedCache  string
+		expectedFormat string
+	}{
+		{name: "First client", accept: "image/jpeg", expectedCache: "MISS", expectedFormat: "jpeg"},
+		{name: "Same accepted formats", accept: "image/jpeg, image/webp", expectedCache: "HIT", expectedFormat: "jpeg"},
+		{name: "Different accepted formats", accept: "image/png", expectedCache: "MISS", expectedFormat: "png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/thumbnail?width=50&format=auto", bytes.NewReader(data))
+			req.Header.Set("Accept", tt.accept)
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.expectedCache, rr.Header().Get("X-Cache"))
+			assert.Equal(t, "Accept", rr.Header().Get("Vary"))
+			_, format, err := image.DecodeConfig(rr.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedFormat, format)
+		})
+	}
+}
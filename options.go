@@ -0,0 +1,715 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Options controls how images are processed and encoded. Handlers build them from
+// query parameters with ParseOptions and pass them to ResizeImage, ConvertImage and
+// ThumbnailImage.
+type Options struct {
+	// Format is the format to encode the image in. Empty keeps the source format and
+	// "auto" negotiates it from Accept.
+	Format string
+	// Accept is the Accept header used to negotiate the "auto" format
+	Accept string
+	// Quality is the JPEG quality between 1 and 100; zero uses the default
+	Quality int
+	// MaxBytes is the maximum size of the encoded image; zero is unlimited
+	MaxBytes int
+	// Downscale allows the image to be scaled down to fit within MaxBytes
+	Downscale bool
+	// TargetSSIM is the MS-SSIM JPEG images must reach against the unencoded image,
+	// found by lowering the quality from Quality or 100; zero disables the search
+	TargetSSIM float64
+	// BlurHashComponents, if set, requests the placeholder hashes of the image with
+	// this many horizontal and vertical BlurHash components
+	BlurHashComponents image.Point
+	// Quantizer is the quantizer that reduces GIF and PNG8 images to a palette; empty
+	// selects Wu's
+	Quantizer string
+	// Dither is the dithering method of GIF and PNG8 images; empty selects
+	// Floyd-Steinberg
+	Dither string
+	// Colors is the size of the palette of GIF and PNG8 images; zero uses 256
+	Colors int
+	// Background is the color images with transparency are flattened onto when they
+	// are encoded as JPEG, which has no alpha channel, and that fills the areas a
+	// rotation uncovers; nil uses white and transparent respectively
+	Background color.Color
+	// Trim trims a uniform border off the source image after it is rotated
+	Trim bool
+	// TrimColor is the color of the border to trim; nil detects it from the corners
+	TrimColor color.Color
+	// TrimTolerance is the largest channel difference from TrimColor of border pixels
+	TrimTolerance int
+	// TrimPadding is the number of pixels of border kept around the trimmed image
+	TrimPadding int
+	// Crop, if set, is the rectangle the source image is cropped to after it is
+	// rotated and trimmed
+	Crop *CropRect
+	// Angle is the clockwise rotation in degrees applied to the source image
+	Angle float64
+	// Flip flips the source image before it is rotated: "horizontal", "vertical" or "both"
+	Flip string
+	// Kernel is the interpolation kernel of rotations by angles other than multiples
+	// of 90 degrees; empty selects "catmullrom"
+	Kernel string
+	// Expand grows rotated images to hold all of the source image instead of cropping it
+	Expand bool
+	// Blur is the standard deviation of a Gaussian blur applied to the processed
+	// image; zero disables it
+	Blur float64
+	// BoxBlur is the radius of a box blur applied to the processed image after the
+	// Gaussian blur; zero disables it
+	BoxBlur int
+	// Sharpen is the amount of an unsharp mask applied to the processed image after it
+	// is blurred; zero disables it
+	Sharpen float64
+	// SharpenRadius is the standard deviation of the blur the unsharp mask subtracts
+	SharpenRadius float64
+	// SharpenThreshold is the largest channel difference the unsharp mask leaves unchanged
+	SharpenThreshold int
+	// Watermark, if set, is composited over the processed image after it is blurred
+	// and sharpened
+	Watermark *Watermark
+	// Text, if set, is drawn over the processed image after it is watermarked
+	Text *Text
+	// Report, if set, receives a description of how the image was encoded
+	Report *Report
+}
+
+// Option configures Options.
+type Option func(*Options)
+
+// WithFormat sets the format the image is encoded in.
+func WithFormat(format string) Option {
+	return func(o *Options) { o.Format = format }
+}
+
+// WithAccept sets the Accept header used to negotiate the "auto" format.
+func WithAccept(accept string) Option {
+	return func(o *Options) { o.Accept = accept }
+}
+
+// WithQuality sets the JPEG quality between 1 and 100.
+func WithQuality(quality int) Option {
+	return func(o *Options) { o.Quality = quality }
+}
+
+// WithMaxBytes limits the size of the encoded image to maxBytes. JPEG images are
+// encoded at the highest quality that fits, up to the one set by WithQuality or 100; if downscale is set, images that do not
+// fit at any quality are scaled down until they do.
+func WithMaxBytes(maxBytes int, downscale bool) Option {
+	return func(o *Options) {
+		o.MaxBytes = maxBytes
+		o.Downscale = downscale
+	}
+}
+
+// WithTargetSSIM encodes JPEG images at the lowest quality whose MS-SSIM against the
+// unencoded image is at least target.
+func WithTargetSSIM(target float64) Option {
+	return func(o *Options) { o.TargetSSIM = target }
+}
+
+// WithPlaceholder requests the BlurHash, with xComponents horizontal and yComponents
+// vertical components, and the ThumbHash of the processed image in the Report.
+func WithPlaceholder(xComponents, yComponents int) Option {
+	return func(o *Options) { o.BlurHashComponents = image.Pt(xComponents, yComponents) }
+}
+
+// WithQuantizer reduces GIF and PNG8 images to a palette of at most colors colors with
+// the named quantizer: "mediancut", "octree" or "wu".
+func WithQuantizer(quantizer string, colors int) Option {
+	return func(o *Options) {
+		o.Quantizer = quantizer
+		o.Colors = colors
+	}
+}
+
+// WithDither draws GIF and PNG8 images with the named dithering method: "none",
+// "floydsteinberg" or "ordered".
+func WithDither(dither string) Option {
+	return func(o *Options) { o.Dither = dither }
+}
+
+// WithBackground sets the color images with transparency are flattened onto when they
+// are encoded in a format without alpha.
+func WithBackground(background color.Color) Option {
+	return func(o *Options) { o.Background = background }
+}
+
+// WithRotation rotates the source image clockwise by angle degrees, interpolating
+// angles other than multiples of 90 degrees with the named kernel. If expand is set,
+// the image grows to hold all of the rotated image.
+func WithRotation(angle float64, kernel string, expand bool) Option {
+	return func(o *Options) {
+		o.Angle = angle
+		o.Kernel = kernel
+		o.Expand = expand
+	}
+}
+
+// WithFlip flips the source image before it is rotated: "horizontal", "vertical" or "both".
+func WithFlip(flip string) Option {
+	return func(o *Options) { o.Flip = flip }
+}
+
+// WithTrim trims the border of the given color off the source image after it is
+// rotated, keeping padding pixels of it. Pixels whose channels differ from the border
+// color by at most tolerance belong to the border. A nil border is detected from the
+// corners of the image.
+func WithTrim(border color.Color, tolerance, padding int) Option {
+	return func(o *Options) {
+		o.Trim = true
+		o.TrimColor = border
+		o.TrimTolerance = tolerance
+		o.TrimPadding = padding
+	}
+}
+
+// WithCrop crops the source image to rect after it is rotated and trimmed.
+func WithCrop(rect CropRect) Option {
+	return func(o *Options) { o.Crop = &rect }
+}
+
+// WithBlur blurs the processed image with a Gaussian of standard deviation sigma.
+func WithBlur(sigma float64) Option {
+	return func(o *Options) { o.Blur = sigma }
+}
+
+// WithBoxBlur blurs the processed image with a box of the given radius.
+func WithBoxBlur(radius int) Option {
+	return func(o *Options) { o.BoxBlur = radius }
+}
+
+// WithSharpen sharpens the processed image with an unsharp mask of the given amount,
+// which subtracts a Gaussian blur of standard deviation radius. Channels that differ
+// from the blurred image by at most threshold are left unchanged.
+func WithSharpen(amount, radius float64, threshold int) Option {
+	return func(o *Options) {
+		o.Sharpen = amount
+		o.SharpenRadius = radius
+		o.SharpenThreshold = threshold
+	}
+}
+
+// WithWatermark composites the overlay of wm over the processed image.
+func WithWatermark(wm Watermark) Option {
+	return func(o *Options) { o.Watermark = &wm }
+}
+
+// WithText draws t over the processed image.
+func WithText(t Text) Option {
+	return func(o *Options) { o.Text = &t }
+}
+
+// WithReport sets the Report that receives a description of how the image was encoded.
+func WithReport(report *Report) Option {
+	return func(o *Options) { o.Report = report }
+}
+
+// newOptions applies opts to the default Options.
+func newOptions(opts []Option) *Options {
+	o := &Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// ParseOptions returns the Options requested by the query parameters of r.
+//
+// Query Parameters:
+// - format: The output format, "auto" to negotiate it from the Accept header, or
+// "smallest" to select the format with the smallest output whose JPEG candidate reaches
+// target_ssim, or an MS-SSIM of 0.98 without it (optional).
+// - quality: The JPEG quality between 1 and 100 (optional).
+// - max_bytes: The maximum size of the encoded image in bytes; JPEG images are encoded at the
+// highest quality that fits, up to quality if given and 100 otherwise (optional).
+// - downscale: Whether the image may be scaled down to fit within max_bytes (optional).
+// - target_ssim: The MS-SSIM between 0 and 1 JPEG images must reach (optional).
+// - placeholder: Whether to report the BlurHash and ThumbHash of the image (optional).
+// - components: The BlurHash component counts as "XxY" (optional, defaults to "4x3").
+// - quantizer: The quantizer of GIF and PNG8 images, "mediancut", "octree" or "wu" (optional, defaults to "wu").
+// - dither: The dithering of GIF and PNG8 images, "none", "floydsteinberg" or "ordered"
+// (optional, defaults to "floydsteinberg").
+// - colors: The palette size of GIF and PNG8 images between 2 and 256 (optional, defaults to 256).
+// - background: The hex color JPEG images with transparency are flattened onto and rotations
+// fill uncovered areas with (optional, defaults to "ffffff" and transparent respectively).
+// - angle: The clockwise rotation of the source image in degrees (optional).
+// - flip: Flips the source image before rotating it, "horizontal", "vertical" or "both" (optional).
+// - kernel: The interpolation of rotations by angles other than multiples of 90 degrees,
+// "nearest", "approxbilinear", "bilinear" or "catmullrom" (optional, defaults to "catmullrom").
+// - expand: Whether rotated images grow to hold all of the source image (optional).
+// - trim: Whether to trim a uniform border off the source image after rotating it (optional).
+// - trim_color: The hex color of the border to trim (optional, defaults to the most common corner color).
+// - trim_tolerance: The largest channel difference between 0 and 255 from the border color of
+// trimmed pixels (optional, defaults to 10).
+// - trim_padding: The number of pixels of border between 0 and 2048 to keep around the trimmed
+// image (optional).
+// - crop: The rectangle to crop the source image to after rotating and trimming it, as "x,y,width,height"
+// in pixels or percentages, such as "10%,0,50%,300" (optional).
+// - blur: The standard deviation between 0 and 100 of a Gaussian blur of the processed image (optional).
+// - box_blur: The radius between 0 and 300 of a box blur of the processed image (optional).
+// - sharpen: The amount between 0 and 10 of an unsharp mask sharpening the processed image (optional).
+// - sharpen_radius: The standard deviation between 0 and 100 of the blur of the unsharp mask (optional, defaults to 1).
+// - sharpen_threshold: The largest channel difference between 0 and 255 from the blurred image the unsharp
+// mask leaves unchanged (optional, defaults to 0).
+// - watermark: Whether to composite the watermark configured at startup over the processed image (optional).
+// - watermark_gravity, watermark_offset, watermark_scale, watermark_opacity, watermark_tile: The placement
+// of the watermark, see HandleWatermark (optional).
+// - text: The text of at most 1000 characters to draw over the processed image; line breaks start
+// new lines (optional).
+// - text_font: The font of the text, "regular", "bold", "italic", "bolditalic", "mono", "monobold" or the
+// name of a font configured at startup (optional, defaults to "regular").
+// - text_size: The size of the text in pixels between 1 and 1000 (optional, defaults to 24).
+// - text_color: The hex color of the text (optional, defaults to "000000").
+// - text_stroke: The width in pixels between 0 and 20 of the outline around the text (optional).
+// - text_stroke_color: The hex color of the outline (optional, defaults to "ffffff").
+// - text_align: The alignment of the lines, "left", "center" or "right" (optional, defaults to "left").
+// - text_width: The width in pixels of the box lines are wrapped within (optional, defaults to the image width).
+// - text_gravity, text_offset: The position of the text, see HandleWatermark (optional, gravity defaults to "center").
+func ParseOptions(r *http.Request) ([]Option, error) {
+	params := r.URL.Query()
+	var opts []Option
+
+	if value := params.Get("quality"); value != "" {
+		quality, err := strconv.Atoi(value)
+		if err != nil || quality < 1 || quality > 100 {
+			return nil, fmt.Errorf("invalid quality: %s", value)
+		}
+		opts = append(opts, WithQuality(quality))
+	}
+
+	if value := params.Get("max_bytes"); value != "" {
+		maxBytes, err := strconv.Atoi(value)
+		if err != nil || maxBytes < 1 {
+			return nil, fmt.Errorf("invalid max_bytes: %s", value)
+		}
+		downscale, err := boolParam(params.Get("downscale"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid downscale: %s", params.Get("downscale"))
+		}
+		opts = append(opts, WithMaxBytes(maxBytes, downscale))
+	}
+
+	if value := params.Get("target_ssim"); value != "" {
+		target, err := strconv.ParseFloat(value, 64)
+		if err != nil || !(target > 0 && target <= 1) {
+			return nil, fmt.Errorf("invalid target_ssim: %s", value)
+		}
+		opts = append(opts, WithTargetSSIM(target))
+	}
+
+	placeholder, err := boolParam(params.Get("placeholder"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid placeholder: %s", params.Get("placeholder"))
+	}
+	if placeholder {
+		x, y, err := parseComponents(params.Get("components"))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithPlaceholder(x, y))
+	}
+
+	quantizer := params.Get("quantizer")
+	if _, ok := quantizers[quantizer]; quantizer != "" && !ok {
+		return nil, fmt.Errorf("invalid quantizer: %s", quantizer)
+	}
+	colors := 0
+	if value := params.Get("colors"); value != "" {
+		colors, err = strconv.Atoi(value)
+		if err != nil || colors < 2 || colors > maxIndexedColors {
+			return nil, fmt.Errorf("invalid colors: %s", value)
+		}
+	}
+	if quantizer != "" || colors != 0 {
+		opts = append(opts, WithQuantizer(quantizer, colors))
+	}
+	if dither := params.Get("dither"); dither != "" {
+		if _, ok := ditherers[dither]; !ok {
+			return nil, fmt.Errorf("invalid dither: %s", dither)
+		}
+		opts = append(opts, WithDither(dither))
+	}
+
+	if value := params.Get("background"); value != "" {
+		background, err := ParseColor(value)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithBackground(background))
+	}
+
+	angle := 0.0
+	if value := params.Get("angle"); value != "" {
+		angle, err = strconv.ParseFloat(value, 64)
+		if err != nil || math.IsInf(angle, 0) || math.IsNaN(angle) {
+			return nil, fmt.Errorf("invalid angle: %s", value)
+		}
+	}
+	kernel := params.Get("kernel")
+	if _, ok := kernels[kernel]; kernel != "" && !ok {
+		return nil, fmt.Errorf("invalid kernel: %s", kernel)
+	}
+	expand, err := boolParam(params.Get("expand"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid expand: %s", params.Get("expand"))
+	}
+	if angle != 0 || kernel != "" || expand {
+		opts = append(opts, WithRotation(angle, kernel, expand))
+	}
+	switch flip := params.Get("flip"); flip {
+	case "":
+	case flipHorizontal, flipVertical, flipBoth:
+		opts = append(opts, WithFlip(flip))
+	default:
+		return nil, fmt.Errorf("invalid flip: %s", flip)
+	}
+
+	trim, err := boolParam(params.Get("trim"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid trim: %s", params.Get("trim"))
+	}
+	if trim {
+		var border color.Color
+		if value := params.Get("trim_color"); value != "" {
+			c, err := ParseColor(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trim_color: %s", value)
+			}
+			border = c
+		}
+		tolerance := defaultTrimTolerance
+		if value := params.Get("trim_tolerance"); value != "" {
+			tolerance, err = strconv.Atoi(value)
+			if err != nil || tolerance < 0 || tolerance > 255 {
+				return nil, fmt.Errorf("invalid trim_tolerance: %s", value)
+			}
+		}
+		padding := 0
+		if value := params.Get("trim_padding"); value != "" {
+			padding, err = strconv.Atoi(value)
+			if err != nil || padding < 0 || padding > maxTrimPadding {
+				return nil, fmt.Errorf("invalid trim_padding: %s", value)
+			}
+		}
+		opts = append(opts, WithTrim(border, tolerance, padding))
+	}
+
+	if value := params.Get("crop"); value != "" {
+		fields := strings.Split(value, ",")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid crop: %s", value)
+		}
+		rect, err := ParseCropRect(fields[0], fields[1], fields[2], fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid crop: %s", value)
+		}
+		opts = append(opts, WithCrop(rect))
+	}
+
+	if value := params.Get("blur"); value != "" {
+		sigma, err := strconv.ParseFloat(value, 64)
+		if err != nil || !(sigma >= 0 && sigma <= maxBlurSigma) {
+			return nil, fmt.Errorf("invalid blur: %s", value)
+		}
+		opts = append(opts, WithBlur(sigma))
+	}
+	if value := params.Get("box_blur"); value != "" {
+		radius, err := strconv.Atoi(value)
+		if err != nil || radius < 0 || radius > maxBoxBlurRadius {
+			return nil, fmt.Errorf("invalid box_blur: %s", value)
+		}
+		opts = append(opts, WithBoxBlur(radius))
+	}
+	if value := params.Get("sharpen"); value != "" {
+		amount, err := strconv.ParseFloat(value, 64)
+		if err != nil || !(amount >= 0 && amount <= maxSharpenAmount) {
+			return nil, fmt.Errorf("invalid sharpen: %s", value)
+		}
+		radius := float64(defaultSharpenRadius)
+		if value := params.Get("sharpen_radius"); value != "" {
+			radius, err = strconv.ParseFloat(value, 64)
+			if err != nil || !(radius > 0 && radius <= maxBlurSigma) {
+				return nil, fmt.Errorf("invalid sharpen_radius: %s", value)
+			}
+		}
+		threshold := 0
+		if value := params.Get("sharpen_threshold"); value != "" {
+			threshold, err = strconv.Atoi(value)
+			if err != nil || threshold < 0 || threshold > 255 {
+				return nil, fmt.Errorf("invalid sharpen_threshold: %s", value)
+			}
+		}
+		opts = append(opts, WithSharpen(amount, radius, threshold))
+	}
+
+	watermark, err := boolParam(params.Get("watermark"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid watermark: %s", params.Get("watermark"))
+	}
+	if watermark {
+		wm, err := parseWatermark(params, "watermark_")
+		if err != nil {
+			return nil, err
+		}
+		if wm.Image = requestOverlay(r); wm.Image == nil {
+			return nil, ErrNoWatermark
+		}
+		opts = append(opts, WithWatermark(wm))
+	}
+
+	if value := params.Get("text"); value != "" {
+		t, err := parseText(r, value)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithText(t))
+	}
+
+	if format := params.Get("format"); format != "" {
+		opts = append(opts, WithFormat(format))
+		if format == formatAuto {
+			opts = append(opts, WithAccept(r.Header.Get("Accept")))
+		}
+	}
+
+	return opts, nil
+}
+
+// boolParam parses an optional boolean query parameter. An empty value is false.
+func boolParam(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// maxDerivativeSize is the largest width and height of images derived from smaller
+// images; images derived from larger images may be as large as the image
+const maxDerivativeSize = 4096
+
+// maxTrimPadding is the largest padding kept around trimmed images, so that the
+// padding on both sides fits within maxDerivativeSize
+const maxTrimPadding = maxDerivativeSize / 2
+
+// checkDerivativeSize returns ErrDerivativeTooLarge if an image of width by height
+// pixels derived from an image with the given bounds would be larger than
+// maxDerivativeSize and the image in either dimension.
+func checkDerivativeSize(bounds image.Rectangle, width, height int) error {
+	if width > max(bounds.Dx(), maxDerivativeSize) || height > max(bounds.Dy(), maxDerivativeSize) {
+		return ErrDerivativeTooLarge
+	}
+	return nil
+}
+
+// derivativeSize returns the size of an image with the given bounds scaled to width by
+// height pixels. A zero width or height is computed from the other to preserve the
+// aspect ratio. It returns ErrDerivativeTooLarge if the scaled image would be too large,
+// see checkDerivativeSize.
+func derivativeSize(bounds image.Rectangle, width, height int) (int, int, error) {
+	// Check the given dimensions first, so that computing the other cannot overflow
+	if err := checkDerivativeSize(bounds, width, height); err != nil {
+		return 0, 0, err
+	}
+	switch {
+	case height == 0:
+		height = max(1, bounds.Dy()*width/max(1, bounds.Dx()))
+	case width == 0:
+		width = max(1, bounds.Dx()*height/max(1, bounds.Dy()))
+	}
+	if err := checkDerivativeSize(bounds, width, height); err != nil {
+		return 0, 0, err
+	}
+	return width, height, nil
+}
+
+// prepare applies the operations requested by o to the source image img before it is
+// resized: rotation, trimming and cropping, in that order. It returns
+// ErrCropOutOfBounds if the crop rectangle does not lie within the trimmed image, and
+// ErrDerivativeTooLarge if the rotated image would be too large.
+func (o *Options) prepare(img image.Image) (image.Image, error) {
+	if o.Angle != 0 || o.Flip != "" {
+		size := rotatedSize(img.Bounds(), o.Angle, o.Expand)
+		if err := checkDerivativeSize(img.Bounds(), size.X, size.Y); err != nil {
+			return nil, err
+		}
+		kernel := o.Kernel
+		if kernel == "" {
+			kernel = defaultKernel
+		}
+		background := o.Background
+		if background == nil {
+			background = color.Transparent
+		}
+		img = Rotate(img, o.Angle, o.Flip, kernels[kernel], background, o.Expand)
+	}
+	if o.Trim {
+		img = Trim(img, o.TrimColor, o.TrimTolerance, o.TrimPadding)
+	}
+	if o.Crop != nil {
+		rect, err := o.Crop.Bounds(img.Bounds())
+		if err != nil {
+			return nil, err
+		}
+		img = subImage(img, rect)
+	}
+	return img, nil
+}
+
+// apply applies the operations requested by o to the processed image img: Gaussian
+// and box blurring, sharpening, watermarking and drawing text, in that order.
+func (o *Options) apply(img image.Image) image.Image {
+	if o.Blur > 0 {
+		img = GaussianBlur(img, o.Blur)
+	}
+	if o.BoxBlur > 0 {
+		img = BoxBlur(img, o.BoxBlur)
+	}
+	if o.Sharpen > 0 {
+		img = UnsharpMask(img, o.Sharpen, o.SharpenRadius, o.SharpenThreshold)
+	}
+	if o.Watermark != nil {
+		img = Composite(img, *o.Watermark)
+	}
+	if o.Text != nil {
+		img = DrawText(img, *o.Text)
+	}
+	return img
+}
+
+// encode encodes img according to o. srcFormat is the format img was decoded from and
+// is used when o does not name a format.
+func (o *Options) encode(ctx context.Context, img image.Image, srcFormat string) ([]byte, error) {
+	report := Report{Format: o.Format}
+	var data []byte
+	var err error
+
+	switch o.Format {
+	case "":
+		report.Format = srcFormat
+	case formatAuto:
+		report.Format = NegotiateFormat(o.Accept, isOpaque(img))
+		report.Negotiated = true
+	case formatSmallest:
+		data, err = encodeSmallest(ctx, img, o, &report)
+	}
+	if report.Format == formatJPEG && !isOpaque(img) {
+		// JPEG has no alpha channel, so transparent areas would turn black
+		img = Flatten(img, o.background())
+	}
+	switch {
+	case data != nil || err != nil:
+	case report.Format == formatJPEG && o.TargetSSIM > 0:
+		maxQuality := o.Quality
+		if maxQuality == 0 {
+			maxQuality = 100
+		}
+		data, report.Quality, report.SSIM, err = searchSSIM(ctx, img, maxQuality, o.TargetSSIM)
+	default:
+		data, err = EncodeImage(ctx, img, report.Format, o.encoder())
+	}
+	if report.Format == formatJPEG && report.Quality == 0 {
+		report.Quality = o.quality()
+	}
+
+	// Without a requested quality or target, JPEG images take the highest quality that fits
+	raise := report.Format == formatJPEG && o.Quality == 0 && o.TargetSSIM == 0 && o.Format != formatSmallest
+	if err == nil && o.MaxBytes > 0 && (len(data) > o.MaxBytes || raise) {
+		// The size limit takes precedence over the target SSIM
+		report.SSIM = 0
+		data, err = o.fit(ctx, img, &report)
+	}
+	if err == nil && o.BlurHashComponents != (image.Point{}) {
+		var placeholder Placeholder
+		placeholder, err = Placeholders(img, o.BlurHashComponents.X, o.BlurHashComponents.Y)
+		report.BlurHash, report.ThumbHash = placeholder.BlurHash, placeholder.ThumbHash
+	}
+	if err == nil && o.Report != nil {
+		*o.Report = report
+	}
+	return data, err
+}
+
+// quality returns the JPEG quality to encode with.
+func (o *Options) quality() int {
+	if o.Quality == 0 {
+		return jpeg.DefaultQuality
+	}
+	return o.Quality
+}
+
+// colors returns the size of the palette of GIF and PNG8 images.
+func (o *Options) colors() int {
+	if o.Colors == 0 {
+		return maxIndexedColors
+	}
+	return o.Colors
+}
+
+// background returns the color images with transparency are flattened onto.
+func (o *Options) background() color.Color {
+	if o.Background == nil {
+		return defaultBackground
+	}
+	return o.Background
+}
+
+// encoder returns an Option that copies the encoder settings of o, for encoding the
+// image again in another format or size.
+func (o *Options) encoder() Option {
+	return func(e *Options) {
+		e.Quality = o.Quality
+		e.Quantizer, e.Dither, e.Colors = o.Quantizer, o.Dither, o.Colors
+	}
+}
+
+// Report describes how an image was encoded.
+type Report struct {
+	// Format is the format the image was encoded in
+	Format string
+	// Negotiated is set when Format was negotiated from the Accept header
+	Negotiated bool
+	// Quality is the JPEG quality the image was encoded with
+	Quality int
+	// SSIM is the MS-SSIM of the encoded image when it was encoded to a target SSIM
+	SSIM float64
+	// BlurHash and ThumbHash are the placeholder hashes of the image, if requested
+	BlurHash, ThumbHash string
+}
+
+// Encoded records report in the headers of resp and returns resp. The X-Image-Format
+// header names the output format, X-Image-Quality the JPEG quality and X-Image-SSIM the
+// MS-SSIM reached. X-BlurHash and X-ThumbHash carry the placeholder hashes. Responses
+// whose format was negotiated vary by the Accept header.
+func (resp *ImageResponse) Encoded(report Report) *ImageResponse {
+	if report.Format != "" {
+		resp.Header.Set("X-Image-Format", report.Format)
+	}
+	if report.Quality != 0 {
+		resp.Header.Set("X-Image-Quality", strconv.Itoa(report.Quality))
+	}
+	if report.SSIM != 0 {
+		resp.Header.Set("X-Image-SSIM", strconv.FormatFloat(report.SSIM, 'f', 4, 64))
+	}
+	if report.BlurHash != "" {
+		resp.Header.Set("X-BlurHash", report.BlurHash)
+		resp.Header.Set("X-ThumbHash", report.ThumbHash)
+	}
+	if report.Negotiated {
+		resp.Header.Add("Vary", "Accept")
+	}
+	return resp
+}
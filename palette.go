@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// defaultPaletteColors is the default number of colors in a palette
+	defaultPaletteColors = 5
+	// maxPaletteColors is the largest number of colors in a palette
+	maxPaletteColors = 16
+	// paletteSampleSize is the largest width and height images are scaled down to before
+	// their palette is extracted
+	paletteSampleSize = 64
+
+	classVibrant = "vibrant"
+	classMuted   = "muted"
+)
+
+// ErrTransparent is returned when an image has no opaque pixels to extract colors from
+var ErrTransparent = fmt.Errorf("image has no opaque pixels")
+
+// PaletteColor is a color of a Palette.
+type PaletteColor struct {
+	// Hex is the color as a CSS hex color
+	Hex string `json:"hex"`
+	// RGB holds the red, green and blue components of the color
+	RGB [3]uint8 `json:"rgb"`
+	// Proportion is the fraction of the opaque pixels of the image the color stands for
+	Proportion float64 `json:"proportion"`
+	// Class is "vibrant" for saturated colors of medium lightness and "muted" otherwise
+	Class string `json:"class"`
+}
+
+// Palette holds the main colors of an image.
+type Palette struct {
+	// Colors are the main colors of the image, most common first
+	Colors []PaletteColor `json:"colors"`
+	// Dominant is the most common color of the image
+	Dominant PaletteColor `json:"dominant"`
+	// Class is the class of the colors covering most of the image
+	Class string `json:"class"`
+}
+
+// ExtractPalette returns the n main colors of img, found by median cut over a copy of
+// img scaled down to fit within 64x64 pixels. Mostly transparent pixels are ignored.
+// It returns ErrTransparent if img has no opaque pixels.
+func ExtractPalette(img image.Image, n int) (Palette, error) {
+	bounds := img.Bounds()
+	if bounds.Dx() > paletteSampleSize || bounds.Dy() > paletteSampleSize {
+		scale := float64(paletteSampleSize) / float64(max(bounds.Dx(), bounds.Dy()))
+		img = Resample(img, max(1, int(float64(bounds.Dx())*scale)), max(1, int(float64(bounds.Dy())*scale)))
+	}
+
+	pixels := opaquePixels(img)
+	if len(pixels) == 0 {
+		return Palette{}, ErrTransparent
+	}
+
+	var palette Palette
+	vibrant := 0.0
+	for _, c := range MedianCut(pixels, n) {
+		pc := PaletteColor{
+			Hex:        fmt.Sprintf("#%02x%02x%02x", c.color.R, c.color.G, c.color.B),
+			RGB:        [3]uint8{c.color.R, c.color.G, c.color.B},
+			Proportion: float64(c.count) / float64(len(pixels)),
+			Class:      classifyColor(c.color),
+		}
+		if pc.Class == classVibrant {
+			vibrant += pc.Proportion
+		}
+		palette.Colors = append(palette.Colors, pc)
+	}
+	palette.Dominant = palette.Colors[0]
+	palette.Class = classMuted
+	if vibrant > 0.5 {
+		palette.Class = classVibrant
+	}
+	return palette, nil
+}
+
+// classifyColor returns "vibrant" if c is saturated and neither very dark nor very
+// light in HSL, and "muted" otherwise.
+func classifyColor(c color.RGBA) string {
+	hi := float64(max(c.R, c.G, c.B)) / 255
+	lo := float64(min(c.R, c.G, c.B)) / 255
+	lightness := (hi + lo) / 2
+	saturation := 0.0
+	if hi != lo {
+		saturation = (hi - lo) / (1 - math.Abs(2*lightness-1))
+	}
+	if saturation >= 0.35 && lightness >= 0.25 && lightness <= 0.8 {
+		return classVibrant
+	}
+	return classMuted
+}
+
+// HandlePalette returns the palette of the image in the request body, or of the
+// source image named by the src query parameter.
+//
+// Query Parameters:
+// - colors: The number of colors between 1 and 16 (optional, defaults to 5).
+// - src: The key of a source image to use instead of the request body (optional).
+//
+// Responses:
+// - 400 Bad Request: If colors is invalid.
+// - 404 Not Found: If the source image does not exist.
+// - 422 Unprocessable Entity: If the image is invalid or fully transparent.
+// - 200 OK: The Palette.
+func HandlePalette(w http.ResponseWriter, r *http.Request) http.Handler {
+	n := defaultPaletteColors
+	if value := r.URL.Query().Get("colors"); value != "" {
+		var err error
+		n, err = strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPaletteColors {
+			return Error(http.StatusBadRequest, fmt.Errorf("invalid colors: %s", value))
+		}
+	}
+
+	body, _, err := RequestImage(r)
+	if err != nil {
+		return SourceError(err)
+	}
+	defer body.Close()
+
+	img, _, err := image.Decode(body)
+	if err != nil {
+		return Error(http.StatusUnprocessableEntity, ErrInvalidImage)
+	}
+	palette, err := ExtractPalette(img, n)
+	if err != nil {
+		return Error(http.StatusUnprocessableEntity, err)
+	}
+	return JSON(http.StatusOK, palette)
+}
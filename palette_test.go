@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractPalette(t *testing.T) {
+	// Three quarters saturated orange, one quarter grey
+	img := solidImage(200, 200, color.RGBA{240, 120, 20, 255})
+	draw.Draw(img, image.Rect(0, 150, 200, 200), image.NewUniform(color.RGBA{100, 100, 100, 255}), image.Point{}, draw.Src)
+
+	palette, err := ExtractPalette(img, 2)
+	assert.NoError(t, err)
+	assert.Len(t, palette.Colors, 2)
+	assert.Equal(t, palette.Colors[0], palette.Dominant)
+	assert.Equal(t, "#f07814", palette.Dominant.Hex)
+	assert.Equal(t, [3]uint8{240, 120, 20}, palette.Dominant.RGB)
+	assert.InDelta(t, 0.75, palette.Dominant.Proportion, 0.03)
+	assert.Equal(t, classVibrant, palette.Dominant.Class)
+	// The second color mixes in pixels blended across the edge between the regions
+	assert.InDelta(t, 100, int(palette.Colors[1].RGB[0]), 16)
+	assert.Equal(t, classMuted, palette.Colors[1].Class)
+	assert.Equal(t, classVibrant, palette.Class)
+
+	// Transparent pixels are ignored
+	draw.Draw(img, image.Rect(0, 0, 200, 150), image.Transparent, image.Point{}, draw.Src)
+	palette, err = ExtractPalette(img, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "#646464", palette.Dominant.Hex)
+	assert.Equal(t, classMuted, palette.Class)
+
+	_, err = ExtractPalette(image.NewRGBA(image.Rect(0, 0, 10, 10)), 2)
+	assert.Equal(t, ErrTransparent, err)
+}
+
+func TestClassifyColor(t *testing.T) {
+	tests := []struct {
+		color    color.RGBA
+		expected string
+	}{
+		{color: color.RGBA{255, 0, 0, 255}, expected: classVibrant},
+		{color: color.RGBA{30, 144, 255, 255}, expected: classVibrant},
+		{color: color.RGBA{128, 128, 128, 255}, expected: classMuted},
+		{color: color.RGBA{120, 110, 100, 255}, expected: classMuted},
+		{color: color.RGBA{40, 0, 0, 255}, expected: classMuted},
+		{color: color.RGBA{255, 230, 230, 255}, expected: classMuted},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, classifyColor(tt.color), tt.color)
+	}
+}
+
+func TestHandlePalette(t *testing.T) {
+	data, err := EncodeImage(context.Background(), photoImage(200, 150), "png")
+	assert.NoError(t, err)
+	transparent, err := EncodeImage(context.Background(), image.NewRGBA(image.Rect(0, 0, 10, 10)), "png")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		query  string
+		body   []byte
+		code   int
+		colors int
+	}{
+		{name: "Default colors", body: data, code: http.StatusOK, colors: 5},
+		{name: "Custom colors", query: "colors=8", body: data, code: http.StatusOK, colors: 8},
+		{name: "Invalid colors", query: "colors=17", body: data, code: http.StatusBadRequest},
+		{name: "Invalid image", body: []byte("not an image"), code: http.StatusUnprocessableEntity},
+		{name: "Transparent image", body: transparent, code: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/palette?"+tt.query, bytes.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+
+			handler := Handler(HandlePalette)
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			var palette Palette
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &palette))
+			assert.Len(t, palette.Colors, tt.colors)
+			total := 0.0
+			for i, c := range palette.Colors {
+				total += c.Proportion
+				if i > 0 {
+					assert.LessOrEqual(t, c.Proportion, palette.Colors[i-1].Proportion)
+				}
+			}
+			assert.InDelta(t, 1, total, 1e-9)
+			assert.Contains(t, []string{classVibrant, classMuted}, palette.Class)
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	hashAverage    = "ahash"
+	hashDifference = "dhash"
+	hashPerceptual = "phash"
+
+	// defaultHashDistance is the Hamming distance up to which images are considered near-duplicates
+	defaultHashDistance = 10
+	// phashSize is the width and height of the image the pHash DCT is computed from
+	phashSize = 32
+)
+
+// Hash is a 64-bit perceptual hash. It is encoded as 16 hexadecimal digits.
+type Hash uint64
+
+// Distance returns the Hamming distance between h and other.
+func (h Hash) Distance(other Hash) int {
+	return bits.OnesCount64(uint64(h ^ other))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (h Hash) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%016x", uint64(h))), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (h *Hash) UnmarshalText(text []byte) error {
+	n, err := strconv.ParseUint(string(text), 16, 64)
+	*h = Hash(n)
+	return err
+}
+
+// Hashes holds the perceptual hashes of an image.
+type Hashes struct {
+	// AHash is the average hash
+	AHash Hash `json:"ahash"`
+	// DHash is the difference hash
+	DHash Hash `json:"dhash"`
+	// PHash is the DCT-based perceptual hash
+	PHash Hash `json:"phash"`
+}
+
+// get returns the hash of the given kind.
+func (h Hashes) get(kind string) Hash {
+	switch kind {
+	case hashAverage:
+		return h.AHash
+	case hashDifference:
+		return h.DHash
+	default:
+		return h.PHash
+	}
+}
+
+// HashImage computes the perceptual hashes of img.
+func HashImage(img image.Image) Hashes {
+	return Hashes{AHash: AverageHash(img), DHash: DifferenceHash(img), PHash: PerceptualHash(img)}
+}
+
+// grayscale returns img scaled to width and height in grayscale.
+func grayscale(img image.Image, width, height int) *image.Gray {
+	gray := image.NewGray(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(gray, gray.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return gray
+}
+
+// AverageHash returns the aHash of img: each bit of its 8x8 grayscale thumbnail is
+// set if the pixel is brighter than the mean.
+func AverageHash(img image.Image) Hash {
+	gray := grayscale(img, 8, 8)
+	sum := 0
+	for _, v := range gray.Pix {
+		sum += int(v)
+	}
+	var h Hash
+	for i, v := range gray.Pix {
+		if int(v)*len(gray.Pix) > sum {
+			h |= 1 << i
+		}
+	}
+	return h
+}
+
+// DifferenceHash returns the dHash of img: each bit of its 9x8 grayscale thumbnail
+// is set if the pixel is brighter than its right neighbor.
+func DifferenceHash(img image.Image) Hash {
+	gray := grayscale(img, 9, 8)
+	var h Hash
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if gray.GrayAt(x, y).Y > gray.GrayAt(x+1, y).Y {
+				h |= 1 << (y*8 + x)
+			}
+		}
+	}
+	return h
+}
+
+// PerceptualHash returns the pHash of img: each bit of the lowest 8x8 frequencies
+// of the DCT of its 32x32 grayscale thumbnail is set if the coefficient is above
+// their median, excluding the DC term.
+func PerceptualHash(img image.Image) Hash {
+	gray := grayscale(img, phashSize, phashSize)
+
+	// cosines[u][x] is the DCT-II basis function u at sample x
+	var cosines [8][phashSize]float64
+	for u := range cosines {
+		for x := range cosines[u] {
+			cosines[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * phashSize))
+		}
+	}
+
+	// Transform rows, keeping only the lowest frequencies
+	var rows [phashSize][8]float64
+	for y := 0; y < phashSize; y++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for x := 0; x < phashSize; x++ {
+				sum += float64(gray.Pix[y*gray.Stride+x]) * cosines[u][x]
+			}
+			rows[y][u] = sum
+		}
+	}
+	// Transform columns
+	var coefficients [64]float64
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for y := 0; y < phashSize; y++ {
+				sum += rows[y][u] * cosines[v][y]
+			}
+			coefficients[v*8+u] = sum
+		}
+	}
+
+	sorted := append([]float64(nil), coefficients[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var h Hash
+	for i, c := range coefficients {
+		if i > 0 && c > median {
+			h |= 1 << i
+		}
+	}
+	return h
+}
+
+// HashMatch is an image found in a HashIndex.
+type HashMatch struct {
+	// ID is the ID the image was indexed under
+	ID string `json:"id"`
+	// Distance is the Hamming distance between the hashes
+	Distance int `json:"distance"`
+}
+
+// HashIndex is an in-memory index of perceptual hashes supporting lookups by Hamming
+// distance. Lookups scan every entry, which is fast enough for the number of images a
+// single instance stores. The zero value is ready to use.
+type HashIndex struct {
+	mu     sync.RWMutex
+	hashes map[string]Hashes
+}
+
+// Add indexes hashes under id, replacing any hashes already indexed under it.
+func (x *HashIndex) Add(id string, hashes Hashes) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.hashes == nil {
+		x.hashes = map[string]Hashes{}
+	}
+	x.hashes[id] = hashes
+}
+
+// Remove removes the hashes indexed under id.
+func (x *HashIndex) Remove(id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.hashes, id)
+}
+
+// Search returns the images whose hash of the given kind is within maxDistance of the
+// same hash in hashes, closest first.
+func (x *HashIndex) Search(hashes Hashes, kind string, maxDistance int) []HashMatch {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	target := hashes.get(kind)
+	matches := []HashMatch{}
+	for id, indexed := range x.hashes {
+		if d := target.Distance(indexed.get(kind)); d <= maxDistance {
+			matches = append(matches, HashMatch{ID: id, Distance: d})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].ID < matches[j].ID
+	})
+	return matches
+}
+
+// HandleHash returns the perceptual hashes of the image in the request body, or of
+// the source image named by the src query parameter.
+//
+// Query Parameters:
+// - src: The key of a source image to hash instead of the request body (optional).
+//
+// Responses:
+// - 404 Not Found: If the source image does not exist.
+// - 422 Unprocessable Entity: If the image is invalid.
+// - 200 OK: The Hashes.
+func HandleHash(w http.ResponseWriter, r *http.Request) http.Handler {
+	body, _, err := RequestImage(r)
+	if err != nil {
+		return SourceError(err)
+	}
+	defer body.Close()
+
+	img, _, err := image.Decode(body)
+	if err != nil {
+		return Error(http.StatusUnprocessableEntity, ErrInvalidImage)
+	}
+	return JSON(http.StatusOK, HashImage(img))
+}
+
+// Duplicates holds the stored images that are near-duplicates of an image.
+type Duplicates struct {
+	// Hashes are the perceptual hashes of the submitted image
+	Hashes Hashes `json:"hashes"`
+	// Matches are the stored images within the requested distance, closest first
+	Matches []HashMatch `json:"matches"`
+}
+
+// HandleDuplicates returns the stored images that are near-duplicates of the image
+// in the request body.
+//
+// Query Parameters:
+// - hash: The hash to compare, "ahash", "dhash" or "phash" (optional, defaults to "phash").
+// - distance: The largest Hamming distance between 0 and 64 of a near-duplicate (optional, defaults to 10).
+//
+// Responses:
+// - 400 Bad Request: If hash or distance is invalid.
+// - 413 Request Entity Too Large: If the image is larger than 32 MiB.
+// - 422 Unprocessable Entity: If the body is not a supported image.
+// - 200 OK: The Duplicates.
+func (s *ImageService) HandleDuplicates(w http.ResponseWriter, r *http.Request) http.Handler {
+	// Parse query parameters
+	params := r.URL.Query()
+	kind := params.Get("hash")
+	switch kind {
+	case "":
+		kind = hashPerceptual
+	case hashAverage, hashDifference, hashPerceptual:
+	default:
+		return Error(http.StatusBadRequest, fmt.Errorf("invalid hash: %s", kind))
+	}
+	distance := defaultHashDistance
+	if value := params.Get("distance"); value != "" {
+		var err error
+		distance, err = strconv.Atoi(value)
+		if err != nil || distance < 0 || distance > 64 {
+			return Error(http.StatusBadRequest, fmt.Errorf("invalid distance: %s", value))
+		}
+	}
+
+	// Decode image
+	img, _, err := image.Decode(http.MaxBytesReader(w, r.Body, maxUploadSize))
+	if _, ok := err.(*http.MaxBytesError); ok {
+		return Error(http.StatusRequestEntityTooLarge, fmt.Errorf("image too large"))
+	}
+	if err != nil {
+		return Error(http.StatusUnprocessableEntity, ErrInvalidImage)
+	}
+
+	hashes := HashImage(img)
+	return JSON(http.StatusOK, Duplicates{Hashes: hashes, Matches: s.index.Search(hashes, kind, distance)})
+}
+
+// Reindex rebuilds the near-duplicate index from the images in storage. Images that
+// cannot be read or decoded are logged and left out of the index.
+func (s *ImageService) Reindex(ctx context.Context) error {
+	metas, err := s.storage.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, meta := range metas {
+		data, _, err := s.storage.Get(ctx, meta.ID)
+		if err == ErrNotFound {
+			// Deleted while indexing
+			continue
+		}
+		if err != nil {
+			log.Printf("Error indexing image %s: %v\n", meta.ID, err)
+			continue
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			log.Printf("Error indexing image %s: %v\n", meta.ID, err)
+			continue
+		}
+		s.index.Add(meta.ID, HashImage(img))
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// photoImage returns an opaque image with large smooth features, which survive
+// scaling and compression like the content of a photo.
+func photoImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			u, v := x*255/width, y*255/height
+			c := color.RGBA{uint8(u), uint8(v), 128, 255}
+			if (x*4/width+y*4/height)%2 == 0 {
+				c.B = 255
+				c.R = uint8(255 - u)
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestHashImage(t *testing.T) {
+	original := photoImage(200, 150)
+	compressed, err := EncodeImage(context.Background(), original, "jpeg", WithQuality(20))
+	assert.NoError(t, err)
+	degraded, _, err := image.Decode(bytes.NewReader(compressed))
+	assert.NoError(t, err)
+
+	hashes := HashImage(original)
+	tests := []struct {
+		name    string
+		img     image.Image
+		similar bool
+	}{
+		{name: "Same image", img: original, similar: true},
+		{name: "Scaled", img: scaleImage(original, 80, 60), similar: true},
+		{name: "Compressed", img: degraded, similar: true},
+		{name: "Different image", img: noisyImage()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other := HashImage(tt.img)
+			for _, kind := range []string{hashAverage, hashDifference, hashPerceptual} {
+				d := hashes.get(kind).Distance(other.get(kind))
+				if tt.similar {
+					assert.LessOrEqual(t, d, defaultHashDistance, kind)
+				} else {
+					assert.Greater(t, d, defaultHashDistance, kind)
+				}
+			}
+		})
+	}
+}
+
+func TestHashText(t *testing.T) {
+	data, err := json.Marshal(Hashes{AHash: 1, DHash: 0xff00, PHash: 0xffffffffffffffff})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"ahash":"0000000000000001","dhash":"000000000000ff00","phash":"ffffffffffffffff"}`, string(data))
+
+	var hashes Hashes
+	assert.NoError(t, json.Unmarshal(data, &hashes))
+	assert.Equal(t, Hashes{AHash: 1, DHash: 0xff00, PHash: 0xffffffffffffffff}, hashes)
+	assert.Error(t, json.Unmarshal([]byte(`{"ahash":"xyz"}`), &hashes))
+}
+
+func TestHashIndex(t *testing.T) {
+	var index HashIndex
+	assert.Empty(t, index.Search(Hashes{}, hashPerceptual, 64))
+
+	index.Add("a", Hashes{PHash: 0b0000})
+	index.Add("b", Hashes{PHash: 0b0111})
+	index.Add("c", Hashes{PHash: 0b0001, AHash: 0b1111})
+
+	assert.Equal(t, []HashMatch{{ID: "a", Distance: 0}, {ID: "c", Distance: 1}}, index.Search(Hashes{}, hashPerceptual, 2))
+	assert.Equal(t, []HashMatch{{ID: "a", Distance: 0}, {ID: "b", Distance: 0}}, index.Search(Hashes{}, hashAverage, 2))
+
+	index.Remove("a")
+	assert.Equal(t, []HashMatch{{ID: "c", Distance: 1}}, index.Search(Hashes{}, hashPerceptual, 2))
+}
+
+func TestHandleHash(t *testing.T) {
+	data, err := EncodeImage(context.Background(), photoImage(200, 150), "png")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name string
+		body []byte
+		code int
+	}{
+		{name: "Valid image", body: data, code: http.StatusOK},
+		{name: "Invalid image", body: []byte("not an image"), code: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/hash", bytes.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+
+			handler := Handler(HandleHash)
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			var hashes Hashes
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &hashes))
+			assert.Equal(t, HashImage(photoImage(200, 150)), hashes)
+		})
+	}
+}
+
+func TestImageServiceDuplicates(t *testing.T) {
+	storage := NewMemoryStorage()
+	svc := NewImageService(storage, nil)
+	mux := newImageServiceMux(svc)
+	mux.Handle("POST /images/duplicates", Handler(svc.HandleDuplicates))
+
+	original, err := EncodeImage(context.Background(), photoImage(200, 150), "png")
+	assert.NoError(t, err)
+	reupload, err := EncodeImage(context.Background(), scaleImage(photoImage(200, 150), 100, 75), "jpeg", WithQuality(50))
+	assert.NoError(t, err)
+	other, err := EncodeImage(context.Background(), noisyImage(), "png")
+	assert.NoError(t, err)
+
+	var metas []ImageMeta
+	for _, data := range [][]byte{original, other} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/images", bytes.NewReader(data)))
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		var meta ImageMeta
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &meta))
+		metas = append(metas, meta)
+	}
+
+	search := func(query string, body []byte) (int, Duplicates) {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/images/duplicates"+query, bytes.NewReader(body)))
+		var duplicates Duplicates
+		if rr.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &duplicates))
+		}
+		return rr.Code, duplicates
+	}
+
+	// Re-upload at a different size and compression
+	code, duplicates := search("", reupload)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, duplicates.Matches, 1)
+	assert.Equal(t, metas[0].ID, duplicates.Matches[0].ID)
+
+	code, duplicates = search("?hash=dhash&distance=64", reupload)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, duplicates.Matches, 2)
+
+	code, _ = search("?hash=md5", reupload)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = search("?distance=65", reupload)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = search("", []byte("not an image"))
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// Rebuild the index of a new service from storage
+	rebuilt := NewImageService(storage, nil)
+	assert.Empty(t, rebuilt.index.Search(duplicates.Hashes, hashPerceptual, defaultHashDistance))
+	assert.NoError(t, storage.Put(context.Background(), ImageMeta{ID: "corrupt"}, []byte("not an image")))
+	assert.NoError(t, rebuilt.Reindex(context.Background()))
+	assert.Len(t, rebuilt.index.Search(duplicates.Hashes, hashPerceptual, defaultHashDistance), 1)
+
+	// Deleted images are no longer found
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/images/"+metas[0].ID, nil))
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	code, duplicates = search("", reupload)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, duplicates.Matches)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// defaultBlurHashX and defaultBlurHashY are the default BlurHash component counts
+	defaultBlurHashX = 4
+	defaultBlurHashY = 3
+	// maxPlaceholderSize is the largest width and height a BlurHash is rendered at
+	maxPlaceholderSize = 256
+)
+
+// Placeholder holds the placeholder hashes of an image.
+type Placeholder struct {
+	// BlurHash is the BlurHash of the image
+	BlurHash string `json:"blurhash"`
+	// ThumbHash is the base64 encoded ThumbHash of the image
+	ThumbHash string `json:"thumbhash"`
+	// Width is the width of the image
+	Width int `json:"width"`
+	// Height is the height of the image
+	Height int `json:"height"`
+}
+
+// Placeholders computes the placeholder hashes of img, with xComponents and
+// yComponents BlurHash components. The hashes are computed from a copy of img scaled
+// down to fit within 100x100 pixels.
+func Placeholders(img image.Image, xComponents, yComponents int) (Placeholder, error) {
+	bounds := img.Bounds()
+	small := img
+	if bounds.Dx() > maxThumbHashSize || bounds.Dy() > maxThumbHashSize {
+		scale := float64(maxThumbHashSize) / float64(max(bounds.Dx(), bounds.Dy()))
+		rect := image.Rect(0, 0, max(1, int(float64(bounds.Dx())*scale)), max(1, int(float64(bounds.Dy())*scale)))
+		scaled := image.NewNRGBA(rect)
+		draw.CatmullRom.Scale(scaled, rect, img, bounds, draw.Src, nil)
+		small = scaled
+	}
+
+	blurHash, err := BlurHash(small, xComponents, yComponents)
+	if err != nil {
+		return Placeholder{}, err
+	}
+	return Placeholder{BlurHash: blurHash, ThumbHash: ThumbHash(small), Width: bounds.Dx(), Height: bounds.Dy()}, nil
+}
+
+// parseComponents parses BlurHash component counts given as "XxY", such as "4x3".
+// An empty value yields the default counts.
+func parseComponents(value string) (int, int, error) {
+	if value == "" {
+		return defaultBlurHashX, defaultBlurHashY, nil
+	}
+	xs, ys, ok := strings.Cut(value, "x")
+	x, errX := strconv.Atoi(xs)
+	y, errY := strconv.Atoi(ys)
+	if !ok || errX != nil || errY != nil || x < 1 || x > maxBlurHashComponents || y < 1 || y > maxBlurHashComponents {
+		return 0, 0, fmt.Errorf("invalid components: %s", value)
+	}
+	return x, y, nil
+}
+
+// HandlePlaceholder returns the placeholder hashes of the image in the request body,
+// or of the source image named by the src query parameter.
+//
+// Query Parameters:
+// - components: The BlurHash component counts as "XxY", each between 1 and 9 (optional, defaults to "4x3").
+// - src: The key of a source image to hash instead of the request body (optional).
+//
+// Responses:
+// - 400 Bad Request: If components is invalid.
+// - 404 Not Found: If the source image does not exist.
+// - 422 Unprocessable Entity: If the image is invalid.
+// - 200 OK: The Placeholder.
+func HandlePlaceholder(w http.ResponseWriter, r *http.Request) http.Handler {
+	x, y, err := parseComponents(r.URL.Query().Get("components"))
+	if err != nil {
+		return Error(http.StatusBadRequest, err)
+	}
+
+	body, _, err := RequestImage(r)
+	if err != nil {
+		return SourceError(err)
+	}
+	defer body.Close()
+
+	img, _, err := image.Decode(body)
+	if err != nil {
+		return Error(http.StatusUnprocessableEntity, ErrInvalidImage)
+	}
+	placeholder, err := Placeholders(img, x, y)
+	if err != nil {
+		return Error(http.StatusInternalServerError, err)
+	}
+	return JSON(http.StatusOK, placeholder)
+}
+
+// HandleDecodeBlurHash renders a BlurHash as a PNG image.
+//
+// Query Parameters:
+// - hash: The BlurHash (required).
+// - width: The width of the image between 1 and 256 (optional, defaults to 32).
+// - height: The height of the image between 1 and 256 (optional, defaults to 32).
+// - punch: The contrast of the image (optional, defaults to 1).
+//
+// Responses:
+// - 400 Bad Request: If a parameter is missing or invalid.
+// - 422 Unprocessable Entity: If the hash is invalid.
+// - 200 OK: The rendered PNG image.
+func HandleDecodeBlurHash(w http.ResponseWriter, r *http.Request) http.Handler {
+	// Parse query parameters
+	params := r.URL.Query()
+	hash := params.Get("hash")
+	if hash == "" {
+		return Error(http.StatusBadRequest, fmt.Errorf("missing required parameter: hash"))
+	}
+	width, err := placeholderDimension(params.Get("width"))
+	if err != nil {
+		return Error(http.StatusBadRequest, fmt.Errorf("invalid width: %s", params.Get("width")))
+	}
+	height, err := placeholderDimension(params.Get("height"))
+	if err != nil {
+		return Error(http.StatusBadRequest, fmt.Errorf("invalid height: %s", params.Get("height")))
+	}
+	punch := 1.0
+	if value := params.Get("punch"); value != "" {
+		punch, err = strconv.ParseFloat(value, 64)
+		if err != nil || punch <= 0 {
+			return Error(http.StatusBadRequest, fmt.Errorf("invalid punch: %s", value))
+		}
+	}
+
+	img, err := DecodeBlurHash(hash, width, height, punch)
+	if err != nil {
+		return Error(http.StatusUnprocessableEntity, err)
+	}
+	return placeholderImage(r, img)
+}
+
+// HandleDecodeThumbHash renders a base64 encoded ThumbHash as a PNG image of at most
+// 32x32 pixels.
+//
+// Query Parameters:
+// - hash: The ThumbHash (required).
+//
+// Responses:
+// - 400 Bad Request: If hash is missing.
+// - 422 Unprocessable Entity: If the hash is invalid.
+// - 200 OK: The rendered PNG image.
+func HandleDecodeThumbHash(w http.ResponseWriter, r *http.Request) http.Handler {
+	hash := r.URL.Query().Get("hash")
+	if hash == "" {
+		return Error(http.StatusBadRequest, fmt.Errorf("missing required parameter: hash"))
+	}
+
+	img, err := DecodeThumbHash(hash)
+	if err != nil {
+		return Error(http.StatusUnprocessableEntity, err)
+	}
+	return placeholderImage(r, img)
+}
+
+// placeholderImage returns img encoded as PNG.
+func placeholderImage(r *http.Request, img image.Image) http.Handler {
+	data, err := EncodeImage(r.Context(), img, formatPNG)
+	if err != nil {
+		return Error(http.StatusInternalServerError, err)
+	}
+	return Image(http.StatusOK, data)
+}
+
+// placeholderDimension parses an optional placeholder dimension between 1 and 256. An
+// empty value yields 32.
+func placeholderDimension(value string) (int, error) {
+	if value == "" {
+		return 32, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > maxPlaceholderSize {
+		return 0, fmt.Errorf("invalid dimension: %s", value)
+	}
+	return n, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlaceholders(t *testing.T) {
+	small := patternImage(true)
+	placeholder, err := Placeholders(small, 4, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, Placeholder{BlurHash: "L#HU?[2lwtX3l[WUjvfAgFflfTfk", ThumbHash: "3AgOHJpgdodwiIiGiIbyow/3hw==", Width: 37, Height: 23}, placeholder)
+
+	// Large images are scaled down first
+	placeholder, err = Placeholders(photoImage(400, 200), 9, 9)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, placeholder.Width)
+	assert.Equal(t, 200, placeholder.Height)
+	assert.Len(t, placeholder.BlurHash, 4+2*9*9)
+	decoded, err := DecodeThumbHash(placeholder.ThumbHash)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 32, 18), decoded.Bounds())
+
+	_, err = Placeholders(small, 10, 1)
+	assert.Error(t, err)
+}
+
+func TestParseComponents(t *testing.T) {
+	tests := []struct {
+		value string
+		x, y  int
+		err   bool
+	}{
+		{value: "", x: 4, y: 3},
+		{value: "1x9", x: 1, y: 9},
+		{value: "0x3", err: true},
+		{value: "4x10", err: true},
+		{value: "4", err: true},
+		{value: "axb", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			x, y, err := parseComponents(tt.value)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.x, x)
+			assert.Equal(t, tt.y, y)
+		})
+	}
+}
+
+func TestHandlePlaceholder(t *testing.T) {
+	data, err := EncodeImage(context.Background(), patternImage(true), "png")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		query    string
+		body     []byte
+		code     int
+		blurHash string
+	}{
+		{name: "Default components", body: data, code: http.StatusOK, blurHash: "L#HU?[2lwtX3l[WUjvfAgFflfTfk"},
+		{name: "Custom components", query: "components=5x2", body: data, code: http.StatusOK, blurHash: "D#HU?[2lwtX3jrl[WUjvfAfS"},
+		{name: "Invalid components", query: "components=0x0", body: data, code: http.StatusBadRequest},
+		{name: "Invalid image", body: []byte("not an image"), code: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/placeholder?"+tt.query, bytes.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+
+			handler := Handler(HandlePlaceholder)
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			var placeholder Placeholder
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &placeholder))
+			assert.Equal(t, tt.blurHash, placeholder.BlurHash)
+			assert.Equal(t, "3AgOHJpgdodwiIiGiIbyow/3hw==", placeholder.ThumbHash)
+		})
+	}
+}
+
+func TestHandleDecodePlaceholder(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler Handler
+		query   url.Values
+		code    int
+		bounds  image.Rectangle
+	}{
+		{name: "BlurHash", handler: HandleDecodeBlurHash, query: url.Values{"hash": {"L#HU?[2lwtX3l[WUjvfAgFflfTfk"}}, code: http.StatusOK, bounds: image.Rect(0, 0, 32, 32)},
+		{name: "BlurHash with size", handler: HandleDecodeBlurHash, query: url.Values{"hash": {"L#HU?[2lwtX3l[WUjvfAgFflfTfk"}, "width": {"20"}, "height": {"10"}, "punch": {"2"}}, code: http.StatusOK, bounds: image.Rect(0, 0, 20, 10)},
+		{name: "BlurHash too large", handler: HandleDecodeBlurHash, query: url.Values{"hash": {"L#HU?[2lwtX3l[WUjvfAgFflfTfk"}, "width": {"257"}}, code: http.StatusBadRequest},
+		{name: "BlurHash invalid punch", handler: HandleDecodeBlurHash, query: url.Values{"hash": {"L#HU?[2lwtX3l[WUjvfAgFflfTfk"}, "punch": {"0"}}, code: http.StatusBadRequest},
+		{name: "BlurHash missing", handler: HandleDecodeBlurHash, code: http.StatusBadRequest},
+		{name: "BlurHash invalid", handler: HandleDecodeBlurHash, query: url.Values{"hash": {"LEHV6n"}}, code: http.StatusUnprocessableEntity},
+		{name: "ThumbHash", handler: HandleDecodeThumbHash, query: url.Values{"hash": {"3AgOHJpgdodwiIiGiIbyow/3hw=="}}, code: http.StatusOK, bounds: image.Rect(0, 0, 32, 18)},
+		{name: "ThumbHash missing", handler: HandleDecodeThumbHash, code: http.StatusBadRequest},
+		{name: "ThumbHash invalid", handler: HandleDecodeThumbHash, query: url.Values{"hash": {"3Ag="}}, code: http.StatusUnprocessableEntity},
+		{name: "ThumbHash zero width", handler: HandleDecodeThumbHash, query: url.Values{"hash": {"PwgCAABoend4iHB3qIgAAAAAAA=="}}, code: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/placeholder?"+tt.query.Encode(), nil)
+			rr := httptest.NewRecorder()
+
+			tt.handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			assert.Equal(t, "image/png", rr.Header().Get("Content-Type"))
+			img, err := png.Decode(rr.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.bounds, img.Bounds())
+		})
+	}
+}
+
+func TestHandleThumbnailPlaceholder(t *testing.T) {
+	data, err := EncodeImage(context.Background(), photoImage(200, 100), "png")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		query       string
+		code        int
+		placeholder bool
+	}{
+		{name: "Without placeholder", query: "width=50", code: http.StatusOK},
+		{name: "With placeholder", query: "width=50&placeholder=true&components=3x2", code: http.StatusOK, placeholder: true},
+		{name: "Invalid placeholder", query: "width=50&placeholder=maybe", code: http.StatusBadRequest},
+		{name: "Invalid components", query: "width=50&placeholder=true&components=3", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/thumbnail?"+tt.query, bytes.NewReader(data))
+			rr := httptest.NewRecorder()
+
+			handler := Handler(HandleThumbnail)
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			if !tt.placeholder {
+				assert.Empty(t, rr.Header().Get("X-BlurHash"))
+				return
+			}
+			thumbnail, err := png.Decode(bytes.NewReader(rr.Body.Bytes()))
+			assert.NoError(t, err)
+			expected, err := Placeholders(thumbnail, 3, 2)
+			assert.NoError(t, err)
+			assert.Equal(t, expected.BlurHash, rr.Header().Get("X-BlurHash"))
+			assert.Equal(t, expected.ThumbHash, rr.Header().Get("X-ThumbHash"))
+		})
+	}
+}
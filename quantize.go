@@ -0,0 +1,413 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// minOpaqueAlpha is the smallest alpha of a pixel that counts towards a palette
+const minOpaqueAlpha = 128
+
+// colorCount is a color and the number of pixels it stands for.
+type colorCount struct {
+	color color.RGBA
+	count int
+}
+
+// opaquePixels returns the non-premultiplied colors of the pixels of img that are at
+// least half opaque.
+func opaquePixels(img image.Image) []color.RGBA {
+	bounds := img.Bounds()
+	pixels := make([]color.RGBA, 0, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A >= minOpaqueAlpha {
+				pixels = append(pixels, color.RGBA{c.R, c.G, c.B, 255})
+			}
+		}
+	}
+	return pixels
+}
+
+// colorBox is a box in RGB space holding pixels, as used by median cut.
+type colorBox struct {
+	pixels []color.RGBA
+}
+
+// channel returns channel c of p: 0 for red, 1 for green and 2 for blue.
+func channel(p color.RGBA, c int) uint8 {
+	switch c {
+	case 0:
+		return p.R
+	case 1:
+		return p.G
+	default:
+		return p.B
+	}
+}
+
+// widest returns the channel with the largest range of values in b and that range.
+func (b colorBox) widest() (int, int) {
+	lo, hi := [3]uint8{255, 255, 255}, [3]uint8{}
+	for _, p := range b.pixels {
+		for c := range lo {
+			lo[c], hi[c] = min(lo[c], channel(p, c)), max(hi[c], channel(p, c))
+		}
+	}
+	best, bestRange := 0, -1
+	for c := range lo {
+		if r := int(hi[c]) - int(lo[c]); r > bestRange {
+			best, bestRange = c, r
+		}
+	}
+	return best, bestRange
+}
+
+// average returns the mean color of the pixels in b.
+func (b colorBox) average() colorCount {
+	var sum [3]int
+	for _, p := range b.pixels {
+		sum[0] += int(p.R)
+		sum[1] += int(p.G)
+		sum[2] += int(p.B)
+	}
+	n := len(b.pixels)
+	return colorCount{
+		color: color.RGBA{uint8((sum[0] + n/2) / n), uint8((sum[1] + n/2) / n), uint8((sum[2] + n/2) / n), 255},
+		count: n,
+	}
+}
+
+// MedianCut reduces pixels to at most n colors by repeatedly splitting the box of
+// pixels with the widest range of values at the median of that range. It returns the
+// mean color of each box and the number of pixels in it, most common first.
+func MedianCut(pixels []color.RGBA, n int) []colorCount {
+	if len(pixels) == 0 || n < 1 {
+		return nil
+	}
+	boxes := []colorBox{{pixels: append([]color.RGBA(nil), pixels...)}}
+	for len(boxes) < n {
+		// Split the box with the widest range, weighted by the pixels it holds
+		split, splitChannel, best := -1, 0, 0
+		for i, b := range boxes {
+			c, r := b.widest()
+			if score := r * len(b.pixels); r > 0 && score > best {
+				split, splitChannel, best = i, c, score
+			}
+		}
+		if split < 0 {
+			break
+		}
+
+		b := boxes[split]
+		sort.Slice(b.pixels, func(i, j int) bool {
+			return channel(b.pixels[i], splitChannel) < channel(b.pixels[j], splitChannel)
+		})
+		median := len(b.pixels) / 2
+		// Keep equal values on the same side so that both halves are distinct
+		for median > 0 && channel(b.pixels[median-1], splitChannel) == channel(b.pixels[median], splitChannel) {
+			median--
+		}
+		if median == 0 {
+			median = len(b.pixels) / 2
+			for median < len(b.pixels) && channel(b.pixels[median-1], splitChannel) == channel(b.pixels[median], splitChannel) {
+				median++
+			}
+		}
+		boxes[split] = colorBox{pixels: b.pixels[:median]}
+		boxes = append(boxes, colorBox{pixels: b.pixels[median:]})
+	}
+
+	colors := make([]colorCount, len(boxes))
+	for i, b := range boxes {
+		colors[i] = b.average()
+	}
+	sort.SliceStable(colors, func(i, j int) bool { return colors[i].count > colors[j].count })
+	return colors
+}
+
+// octreeDepth is the depth of the leaves of an octree, one level per bit of each channel
+const octreeDepth = 8
+
+// maxOctreeLeaves is the number of leaves an octree is reduced to while it is built,
+// which bounds its size for images with many colors
+const maxOctreeLeaves = 4096
+
+// octreeNode is a node of an octree. Each node holds the sum of the colors of the
+// pixels below it and their number.
+type octreeNode struct {
+	children [8]*octreeNode
+	sum      [3]int
+	count    int
+	leaf     bool
+}
+
+// octree is an octree color quantizer.
+type octree struct {
+	root octreeNode
+	// levels holds the inner nodes of each level that can be reduced into leaves
+	levels [octreeDepth][]*octreeNode
+	leaves int
+}
+
+// add adds count pixels of color p to the tree.
+func (t *octree) add(p color.RGBA, count int) {
+	node := &t.root
+	for level := 0; ; level++ {
+		node.sum[0] += int(p.R) * count
+		node.sum[1] += int(p.G) * count
+		node.sum[2] += int(p.B) * count
+		node.count += count
+		if node.leaf {
+			return
+		}
+		shift := octreeDepth - 1 - level
+		i := (p.R>>shift&1)<<2 | (p.G>>shift&1)<<1 | p.B>>shift&1
+		if node.children[i] == nil {
+			child := &octreeNode{leaf: level+1 == octreeDepth}
+			if child.leaf {
+				t.leaves++
+			} else {
+				t.levels[level+1] = append(t.levels[level+1], child)
+			}
+			node.children[i] = child
+		}
+		node = node.children[i]
+	}
+}
+
+// reduce merges the inner nodes with the fewest pixels, deepest first, into leaves
+// until the tree has at most n leaves.
+func (t *octree) reduce(n int) {
+	for level := octreeDepth - 1; level >= 0 && t.leaves > n; level-- {
+		nodes := t.levels[level]
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].count > nodes[j].count })
+		for len(nodes) > 0 && t.leaves > n {
+			node := nodes[len(nodes)-1]
+			nodes = nodes[:len(nodes)-1]
+			children := 0
+			for i, child := range node.children {
+				if child != nil {
+					children++
+					node.children[i] = nil
+				}
+			}
+			node.leaf = true
+			t.leaves -= children - 1
+		}
+		t.levels[level] = nodes
+	}
+}
+
+// colors returns the mean colors of the leaves below node.
+func (node *octreeNode) colors(colors []colorCount) []colorCount {
+	if node.leaf {
+		return append(colors, colorCount{
+			color: color.RGBA{
+				uint8((node.sum[0] + node.count/2) / node.count),
+				uint8((node.sum[1] + node.count/2) / node.count),
+				uint8((node.sum[2] + node.count/2) / node.count),
+				255,
+			},
+			count: node.count,
+		})
+	}
+	for _, child := range node.children {
+		if child != nil {
+			colors = child.colors(colors)
+		}
+	}
+	return colors
+}
+
+// Octree reduces pixels to at most n colors with an octree: the pixels are sorted into
+// a tree that splits each channel one bit per level, and the branches with the fewest
+// pixels are merged until at most n leaves remain. It returns the mean color of each
+// leaf and the number of pixels in it, most common first.
+func Octree(pixels []color.RGBA, n int) []colorCount {
+	if len(pixels) == 0 || n < 1 {
+		return nil
+	}
+	t := &octree{}
+	t.levels[0] = []*octreeNode{&t.root}
+	for _, p := range pixels {
+		t.add(p, 1)
+		if t.leaves > max(n, maxOctreeLeaves) {
+			t.reduce(max(n, maxOctreeLeaves) / 2)
+		}
+	}
+	t.reduce(n)
+
+	colors := t.root.colors(nil)
+	sort.SliceStable(colors, func(i, j int) bool { return colors[i].count > colors[j].count })
+	return colors
+}
+
+// wuSize is the number of histogram cells per channel used by Wu's quantizer: 32 cells
+// of 5 bits and a leading zero cell for the cumulative moments.
+const wuSize = 33
+
+// wuBox is a box of histogram cells, exclusive of its lower bounds.
+type wuBox struct {
+	min, max [3]int
+}
+
+// wuMoments holds the cumulative moments of a color histogram.
+type wuMoments struct {
+	weight [wuSize * wuSize * wuSize]float64
+	sum    [3][wuSize * wuSize * wuSize]float64
+	square [wuSize * wuSize * wuSize]float64
+}
+
+// wuIndex returns the index of the histogram cell r, g, b.
+func wuIndex(r, g, b int) int {
+	return (r*wuSize+g)*wuSize + b
+}
+
+// volume returns the sum of m over box b.
+func (b wuBox) volume(m *[wuSize * wuSize * wuSize]float64) float64 {
+	return m[wuIndex(b.max[0], b.max[1], b.max[2])] -
+		m[wuIndex(b.max[0], b.max[1], b.min[2])] -
+		m[wuIndex(b.max[0], b.min[1], b.max[2])] +
+		m[wuIndex(b.max[0], b.min[1], b.min[2])] -
+		m[wuIndex(b.min[0], b.max[1], b.max[2])] +
+		m[wuIndex(b.min[0], b.max[1], b.min[2])] +
+		m[wuIndex(b.min[0], b.min[1], b.max[2])] -
+		m[wuIndex(b.min[0], b.min[1], b.min[2])]
+}
+
+// below returns the sum of m over the part of box b up to position pos of channel c.
+func (b wuBox) below(m *[wuSize * wuSize * wuSize]float64, c, pos int) float64 {
+	b.max[c] = pos
+	return b.volume(m)
+}
+
+// variance returns the sum of the squared distances of the colors in box b from their mean.
+func (m *wuMoments) variance(b wuBox) float64 {
+	weight := b.volume(&m.weight)
+	if weight == 0 {
+		return 0
+	}
+	var sq float64
+	for c := range m.sum {
+		s := b.volume(&m.sum[c])
+		sq += s * s
+	}
+	return b.volume(&m.square) - sq/weight
+}
+
+// maximize returns the position of channel c at which cutting box b most reduces the
+// variance, and the resulting sum of the squared means weighted by the pixel counts.
+// The position is -1 if b cannot be cut along c.
+func (m *wuMoments) maximize(b wuBox, c int) (int, float64) {
+	var whole [3]float64
+	for i := range whole {
+		whole[i] = b.volume(&m.sum[i])
+	}
+	wholeWeight := b.volume(&m.weight)
+
+	cut, best := -1, 0.0
+	for pos := b.min[c] + 1; pos < b.max[c]; pos++ {
+		weight := b.below(&m.weight, c, pos)
+		if weight == 0 || weight == wholeWeight {
+			continue
+		}
+		score := 0.0
+		for i := range whole {
+			s := b.below(&m.sum[i], c, pos)
+			rest := whole[i] - s
+			score += s*s/weight + rest*rest/(wholeWeight-weight)
+		}
+		if score > best {
+			cut, best = pos, score
+		}
+	}
+	return cut, best
+}
+
+// Wu reduces pixels to at most n colors with Xiaolin Wu's quantizer: the colors are
+// counted in a histogram of 32 cells per channel, and the box of cells with the
+// largest variance is repeatedly cut where the cut minimizes the variance of the two
+// halves. It returns the mean color of each box and the number of pixels in it, most
+// common first.
+func Wu(pixels []color.RGBA, n int) []colorCount {
+	if len(pixels) == 0 || n < 1 {
+		return nil
+	}
+
+	m := &wuMoments{}
+	for _, p := range pixels {
+		i := wuIndex(int(p.R>>3)+1, int(p.G>>3)+1, int(p.B>>3)+1)
+		m.weight[i]++
+		m.sum[0][i] += float64(p.R)
+		m.sum[1][i] += float64(p.G)
+		m.sum[2][i] += float64(p.B)
+		m.square[i] += float64(p.R)*float64(p.R) + float64(p.G)*float64(p.G) + float64(p.B)*float64(p.B)
+	}
+	// Accumulate the moments so that the sum over any box takes eight lookups
+	moments := []*[wuSize * wuSize * wuSize]float64{&m.weight, &m.sum[0], &m.sum[1], &m.sum[2], &m.square}
+	for _, moment := range moments {
+		for r := 1; r < wuSize; r++ {
+			var area [wuSize]float64
+			for g := 1; g < wuSize; g++ {
+				line := 0.0
+				for b := 1; b < wuSize; b++ {
+					line += moment[wuIndex(r, g, b)]
+					area[b] += line
+					moment[wuIndex(r, g, b)] = moment[wuIndex(r-1, g, b)] + area[b]
+				}
+			}
+		}
+	}
+
+	boxes := []wuBox{{max: [3]int{wuSize - 1, wuSize - 1, wuSize - 1}}}
+	variances := []float64{m.variance(boxes[0])}
+	for len(boxes) < n {
+		// Cut the box with the largest variance
+		next := 0
+		for i, v := range variances {
+			if v > variances[next] {
+				next = i
+			}
+		}
+		if variances[next] <= 0 {
+			break
+		}
+
+		b := boxes[next]
+		channel, pos, best := -1, -1, 0.0
+		for c := range b.min {
+			if cut, score := m.maximize(b, c); cut >= 0 && score > best {
+				channel, pos, best = c, cut, score
+			}
+		}
+		if channel < 0 {
+			variances[next] = 0
+			continue
+		}
+		upper := b
+		b.max[channel] = pos
+		upper.min[channel] = pos
+		boxes[next] = b
+		boxes = append(boxes, upper)
+		variances[next] = m.variance(b)
+		variances = append(variances, m.variance(upper))
+	}
+
+	colors := make([]colorCount, 0, len(boxes))
+	for _, b := range boxes {
+		weight := b.volume(&m.weight)
+		if weight == 0 {
+			continue
+		}
+		var c [3]uint8
+		for i := range c {
+			c[i] = uint8(max(0, min(255, b.volume(&m.sum[i])/weight+0.5)))
+		}
+		colors = append(colors, colorCount{color: color.RGBA{c[0], c[1], c[2], 255}, count: int(weight + 0.5)})
+	}
+	sort.SliceStable(colors, func(i, j int) bool { return colors[i].count > colors[j].count })
+	return colors
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpaquePixels(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{10, 20, 30, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{40, 50, 60, 128})
+	img.SetNRGBA(2, 0, color.NRGBA{70, 80, 90, 127})
+
+	assert.Equal(t, []color.RGBA{{10, 20, 30, 255}, {40, 50, 60, 255}}, opaquePixels(img))
+}
+
+func TestMedianCut(t *testing.T) {
+	red, green, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}, color.RGBA{0, 0, 255, 255}
+	var pixels []color.RGBA
+	for i := 0; i < 60; i++ {
+		pixels = append(pixels, red)
+	}
+	for i := 0; i < 30; i++ {
+		pixels = append(pixels, green)
+	}
+	for i := 0; i < 10; i++ {
+		pixels = append(pixels, blue)
+	}
+
+	tests := []struct {
+		name     string
+		pixels   []color.RGBA
+		n        int
+		expected []colorCount
+	}{
+		{name: "Exact colors", pixels: pixels, n: 3, expected: []colorCount{{red, 60}, {green, 30}, {blue, 10}}},
+		{name: "More boxes than colors", pixels: pixels, n: 8, expected: []colorCount{{red, 60}, {green, 30}, {blue, 10}}},
+		{name: "Single box", pixels: pixels, n: 1, expected: []colorCount{{color.RGBA{153, 77, 26, 255}, 100}}},
+		{name: "No pixels", pixels: nil, n: 3, expected: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, MedianCut(tt.pixels, tt.n))
+		})
+	}
+}
+
+func TestMedianCutGradient(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 1))
+	for x := 0; x < 256; x++ {
+		img.Set(x, 0, color.RGBA{uint8(x), uint8(x), uint8(x), 255})
+	}
+	draw.Draw(img, image.Rect(0, 0, 0, 0), image.Black, image.Point{}, draw.Src)
+
+	colors := MedianCut(opaquePixels(img), 4)
+	assert.Len(t, colors, 4)
+	total := 0
+	for _, c := range colors {
+		assert.Equal(t, 64, c.count)
+		total += c.count
+	}
+	assert.Equal(t, 256, total)
+}
+
+// clusterPixels returns 60 red, 30 green and 10 blue pixels, each varying slightly.
+func clusterPixels() []color.RGBA {
+	var pixels []color.RGBA
+	for i := 0; i < 100; i++ {
+		d := uint8(i % 3)
+		switch {
+		case i < 60:
+			pixels = append(pixels, color.RGBA{250 + d, d, d, 255})
+		case i < 90:
+			pixels = append(pixels, color.RGBA{d, 250 + d, d, 255})
+		default:
+			pixels = append(pixels, color.RGBA{d, d, 250 + d, 255})
+		}
+	}
+	return pixels
+}
+
+func TestQuantizers(t *testing.T) {
+	pixels := opaquePixels(noisyImage())
+	for name, quantize := range quantizers {
+		t.Run(name, func(t *testing.T) {
+			for _, n := range []int{1, 16, 256} {
+				colors := quantize(pixels, n)
+				assert.LessOrEqual(t, len(colors), n)
+				assert.Greater(t, len(colors), n*3/4)
+				total := 0
+				for i, c := range colors {
+					total += c.count
+					if i > 0 {
+						assert.LessOrEqual(t, c.count, colors[i-1].count)
+					}
+				}
+				assert.Equal(t, len(pixels), total)
+			}
+			assert.Nil(t, quantize(nil, 3))
+		})
+	}
+}
+
+func TestQuantizersClusters(t *testing.T) {
+	// Median cut splits at the median, so it is left out: it cuts the largest cluster
+	for name, quantize := range map[string]func([]color.RGBA, int) []colorCount{"octree": Octree, "wu": Wu} {
+		t.Run(name, func(t *testing.T) {
+			colors := quantize(clusterPixels(), 3)
+			assert.Len(t, colors, 3)
+			for i, count := range []int{60, 30, 10} {
+				assert.Equal(t, count, colors[i].count)
+			}
+			assert.InDelta(t, 251, int(colors[0].color.R), 1)
+			assert.InDelta(t, 251, int(colors[1].color.G), 1)
+			assert.InDelta(t, 251, int(colors[2].color.B), 1)
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"net/http"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+const (
+	// Supported flips
+	flipHorizontal = "horizontal"
+	flipVertical   = "vertical"
+	flipBoth       = "both"
+
+	// defaultKernel is the default interpolation kernel of arbitrary-angle rotation
+	defaultKernel = "catmullrom"
+)
+
+// kernels maps the names of the supported interpolation kernels to their implementations.
+var kernels = map[string]draw.Interpolator{
+	"nearest":        draw.NearestNeighbor,
+	"approxbilinear": draw.ApproxBiLinear,
+	"bilinear":       draw.BiLinear,
+	"catmullrom":     draw.CatmullRom,
+}
+
+// Rotate returns img flipped as named by flip and then rotated clockwise by angle
+// degrees. Rotations by multiples of 90 degrees and flips move pixels without
+// interpolation and keep the color model of img. Other angles are interpolated with
+// kernel, and the areas not covered by img are filled with background. The rotated
+// image keeps the size of img, cropping the corners, unless expand is set, in which
+// case it grows to hold all of img.
+func Rotate(img image.Image, angle float64, flip string, kernel draw.Interpolator, background color.Color, expand bool) image.Image {
+	angle = math.Mod(angle, 360)
+	if angle < 0 {
+		angle += 360
+	}
+	if angle == 0 && flip == "" {
+		return img
+	}
+
+	var sin, cos float64
+	quarter := math.Mod(angle, 90) == 0
+	if quarter {
+		// Exact values keep the pixels aligned
+		sin, cos = [4]float64{0, 1, 0, -1}[int(angle)/90], [4]float64{1, 0, -1, 0}[int(angle)/90]
+	} else {
+		sin, cos = math.Sincos(angle * math.Pi / 180)
+	}
+	fx, fy := 1.0, 1.0
+	if flip == flipHorizontal || flip == flipBoth {
+		fx = -1
+	}
+	if flip == flipVertical || flip == flipBoth {
+		fy = -1
+	}
+
+	bounds := img.Bounds()
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	size := rotatedSize(bounds, angle, expand)
+	width, height := size.X, size.Y
+	rect := image.Rect(0, 0, width, height)
+
+	// Map the center of img to the center of the rotated image
+	m := f64.Aff3{cos * fx, -sin * fy, 0, sin * fx, cos * fy, 0}
+	cx, cy := float64(bounds.Min.X)+w/2, float64(bounds.Min.Y)+h/2
+	m[2] = float64(width)/2 - (m[0]*cx + m[1]*cy)
+	m[5] = float64(height)/2 - (m[3]*cx + m[4]*cy)
+
+	if quarter {
+		var dst draw.Image
+		if p, ok := img.(*image.Paletted); ok {
+			dst = image.NewPaletted(rect, p.Palette)
+		} else {
+			dst = newImageLike(img, rect)
+		}
+		draw.NearestNeighbor.Transform(dst, m, img, bounds, draw.Src, nil)
+		return dst
+	}
+
+	dst := newImageLike(img, rect)
+	if _, _, _, a := background.RGBA(); a < 0xffff {
+		// Grayscale images cannot hold the uncovered areas
+		switch dst.(type) {
+		case *image.Gray:
+			dst = image.NewRGBA(rect)
+		case *image.Gray16:
+			dst = image.NewRGBA64(rect)
+		}
+	}
+	draw.Draw(dst, rect, image.NewUniform(background), image.Point{}, draw.Src)
+	kernel.Transform(dst, m, img, bounds, draw.Over, nil)
+	return dst
+}
+
+// rotatedSize returns the size of an image with the given bounds rotated clockwise by
+// angle degrees by Rotate.
+func rotatedSize(bounds image.Rectangle, angle float64, expand bool) image.Point {
+	angle = math.Mod(angle, 360)
+	if angle < 0 {
+		angle += 360
+	}
+	size := bounds.Size()
+	if math.Mod(angle, 90) == 0 {
+		if int(angle)/90%2 == 1 {
+			size.X, size.Y = size.Y, size.X
+		}
+		return size
+	}
+	if expand {
+		sin, cos := math.Sincos(angle * math.Pi / 180)
+		w, h := float64(size.X), float64(size.Y)
+		// Round down sizes that are whole up to floating point error
+		size.X = int(math.Ceil(w*math.Abs(cos) + h*math.Abs(sin) - 1e-9))
+		size.Y = int(math.Ceil(w*math.Abs(sin) + h*math.Abs(cos) - 1e-9))
+	}
+	return size
+}
+
+// RotateImage decodes an image from r, applies the rotation and flip requested by
+// opts, and encodes the result in its original format unless opts name another.
+//
+// Possible errors:
+//   - ErrInvalidImage: If the image cannot be decoded.
+func RotateImage(ctx context.Context, r io.Reader, opts ...Option) ([]byte, error) {
+	img, format, err := image.Decode(r)
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+
+	o := newOptions(opts)
+	img, err = o.prepare(img)
+	if err != nil {
+		return nil, err
+	}
+	return o.encode(ctx, o.apply(img), format)
+}
+
+// HandleRotate rotates and flips the image in the request body, or the source image
+// named by the src query parameter.
+//
+// Query Parameters:
+// - angle: The clockwise rotation in degrees; multiples of 90 are lossless (angle or flip required).
+// - flip: "horizontal", "vertical" or "both", applied before the rotation (angle or flip required).
+// - kernel: The interpolation of other angles, "nearest", "approxbilinear", "bilinear" or
+// "catmullrom" (optional, defaults to "catmullrom").
+// - background: The hex color of the areas not covered by the rotated image (optional, defaults to transparent).
+// - expand: Whether to grow the image to hold all of the rotated image instead of cropping it (optional).
+// - format, quality and the other encoding parameters of ParseOptions (optional).
+//
+// Responses:
+// - 400 Bad Request: If neither angle nor flip is given, or a parameter is invalid.
+// - 404 Not Found: If the source image does not exist.
+// - 422 Unprocessable Entity: If the image is invalid, its format is unsupported, the crop rectangle is out of bounds,
+// the expanded image is larger than 4096 pixels and the image in either dimension, or it does not fit within
+// max_bytes.
+// - 500 Internal Server Error: If an error occurs during rotation.
+// - 200 OK: The rotated image.
+func HandleRotate(w http.ResponseWriter, r *http.Request) http.Handler {
+	// Validate query parameters
+	params := r.URL.Query()
+	if params.Get("angle") == "" && params.Get("flip") == "" {
+		return Error(http.StatusBadRequest, fmt.Errorf("missing required parameter: angle or flip"))
+	}
+
+	// Parse options
+	opts, err := ParseOptions(r)
+	if err != nil {
+		return Error(http.StatusBadRequest, err)
+	}
+	var report Report
+	opts = append(opts, WithReport(&report))
+
+	// Open image
+	body, info, err := RequestImage(r)
+	if err != nil {
+		return SourceError(err)
+	}
+	defer body.Close()
+
+	// Rotate image
+	rotated, err := RotateImage(r.Context(), body, opts...)
+	if err == ErrInvalidImage || err == ErrUnsupportedFormat || err == ErrTooLarge || err == ErrCropOutOfBounds || err == ErrDerivativeTooLarge {
+		return Error(http.StatusUnprocessableEntity, err)
+	}
+	if err != nil {
+		return Error(http.StatusInternalServerError, err)
+	}
+
+	// Return rotated image
+	return Image(http.StatusOK, rotated).LastModified(info.ModTime).Encoded(report)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// indexImage returns a 3x2 grayscale image at a non-zero origin whose pixels hold their index.
+func indexImage() *image.Gray {
+	img := image.NewGray(image.Rect(4, 7, 7, 9))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	return img
+}
+
+// grayRows returns the pixels of img as rows of values.
+func grayRows(img image.Image) [][]uint8 {
+	bounds := img.Bounds()
+	var rows [][]uint8
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		var row []uint8
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			row = append(row, color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func TestRotateLossless(t *testing.T) {
+	// 0 1 2
+	// 3 4 5
+	tests := []struct {
+		name     string
+		angle    float64
+		flip     string
+		expected [][]uint8
+	}{
+		{name: "90", angle: 90, expected: [][]uint8{{3, 0}, {4, 1}, {5, 2}}},
+		{name: "180", angle: 180, expected: [][]uint8{{5, 4, 3}, {2, 1, 0}}},
+		{name: "270", angle: 270, expected: [][]uint8{{2, 5}, {1, 4}, {0, 3}}},
+		{name: "-90", angle: -90, expected: [][]uint8{{2, 5}, {1, 4}, {0, 3}}},
+		{name: "450", angle: 450, expected: [][]uint8{{3, 0}, {4, 1}, {5, 2}}},
+		{name: "Horizontal flip", flip: flipHorizontal, expected: [][]uint8{{2, 1, 0}, {5, 4, 3}}},
+		{name: "Vertical flip", flip: flipVertical, expected: [][]uint8{{3, 4, 5}, {0, 1, 2}}},
+		{name: "Both flips", flip: flipBoth, expected: [][]uint8{{5, 4, 3}, {2, 1, 0}}},
+		{name: "Horizontal flip and 90", angle: 90, flip: flipHorizontal, expected: [][]uint8{{5, 2}, {4, 1}, {3, 0}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rotated := Rotate(indexImage(), tt.angle, tt.flip, kernels[defaultKernel], color.Transparent, false)
+			assert.IsType(t, &image.Gray{}, rotated)
+			assert.Equal(t, image.Point{}, rotated.Bounds().Min)
+			assert.Equal(t, tt.expected, grayRows(rotated))
+		})
+	}
+
+	img := indexImage()
+	assert.Same(t, img, Rotate(img, 360, "", kernels[defaultKernel], color.Transparent, false))
+}
+
+func TestRotatePaletted(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 4, 2), palette.Plan9)
+	img.SetColorIndex(0, 0, 42)
+	rotated := Rotate(img, 90, "", kernels[defaultKernel], color.Transparent, false)
+	if assert.IsType(t, &image.Paletted{}, rotated) {
+		paletted := rotated.(*image.Paletted)
+		assert.Equal(t, img.Palette, paletted.Palette)
+		assert.Equal(t, image.Rect(0, 0, 2, 4), paletted.Rect)
+		assert.Equal(t, uint8(42), paletted.ColorIndexAt(1, 0))
+	}
+}
+
+func TestRotateAngle(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	img := solidImage(100, 50, red)
+
+	tests := []struct {
+		name       string
+		img        image.Image
+		background color.Color
+		expand     bool
+		size       image.Point
+		corner     color.Color
+	}{
+		{name: "Cropped", img: img, background: blue, size: image.Pt(100, 50), corner: blue},
+		{name: "Expanded", img: img, background: blue, expand: true, size: image.Pt(107, 107), corner: blue},
+		{name: "Transparent background", img: img, background: color.Transparent, size: image.Pt(100, 50), corner: color.RGBA{}},
+		{name: "Grayscale with transparent background", img: image.NewGray(image.Rect(0, 0, 100, 50)), background: color.Transparent, size: image.Pt(100, 50), corner: color.RGBA{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rotated := Rotate(tt.img, 45, "", kernels["bilinear"], tt.background, tt.expand)
+			assert.Equal(t, image.Rectangle{Max: tt.size}, rotated.Bounds())
+			r, g, b, a := tt.corner.RGBA()
+			cr, cg, cb, ca := rotated.At(0, 0).RGBA()
+			assert.Equal(t, []uint32{r, g, b, a}, []uint32{cr, cg, cb, ca})
+			// The center keeps its color
+			center := rotated.Bounds().Max.Div(2)
+			r, g, b, a = tt.img.At(50, 25).RGBA()
+			cr, cg, cb, ca = rotated.At(center.X, center.Y).RGBA()
+			assert.Equal(t, []uint32{r, g, b, a}, []uint32{cr, cg, cb, ca})
+		})
+	}
+}
+
+func TestRotatedSize(t *testing.T) {
+	bounds := image.Rect(10, 10, 110, 60)
+	tests := []struct {
+		name     string
+		angle    float64
+		expand   bool
+		expected image.Point
+	}{
+		{name: "Quarter turn", angle: 90, expected: image.Pt(50, 100)},
+		{name: "Half turn", angle: -180, expected: image.Pt(100, 50)},
+		{name: "Cropped", angle: 45, expected: image.Pt(100, 50)},
+		{name: "Expanded", angle: 45, expand: true, expected: image.Pt(107, 107)},
+		{name: "Expanded quarter turn", angle: 270, expand: true, expected: image.Pt(50, 100)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, rotatedSize(bounds, tt.angle, tt.expand))
+		})
+	}
+
+	// Expanding a large image beyond maxDerivativeSize is refused before allocating it
+	large := image.NewGray(image.Rect(0, 0, 3000, 3000))
+	_, err := newOptions([]Option{WithRotation(45, "", true)}).prepare(large)
+	assert.Equal(t, ErrDerivativeTooLarge, err)
+	_, err = newOptions([]Option{WithRotation(90, "", true)}).prepare(large)
+	assert.NoError(t, err)
+}
+
+func TestHandleRotate(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, solidImage(40, 20, color.RGBA{255, 0, 0, 255})))
+	data := buf.Bytes()
+
+	tests := []struct {
+		name  string
+		query string
+		body  []byte
+		code  int
+		size  image.Point
+	}{
+		{name: "Missing angle and flip", query: "", body: data, code: http.StatusBadRequest},
+		{name: "Invalid angle", query: "angle=abc", body: data, code: http.StatusBadRequest},
+		{name: "Invalid flip", query: "flip=diagonal", body: data, code: http.StatusBadRequest},
+		{name: "Invalid kernel", query: "angle=30&kernel=lanczos", body: data, code: http.StatusBadRequest},
+		{name: "Invalid expand", query: "angle=30&expand=maybe", body: data, code: http.StatusBadRequest},
+		{name: "Invalid image", query: "angle=90", body: []byte("not an image"), code: http.StatusUnprocessableEntity},
+		{name: "Quarter turn", query: "angle=90", body: data, code: http.StatusOK, size: image.Pt(20, 40)},
+		{name: "Flip", query: "flip=horizontal", body: data, code: http.StatusOK, size: image.Pt(40, 20)},
+		{name: "Expanded", query: "angle=30&expand=true&kernel=nearest&background=00ff00", body: data, code: http.StatusOK, size: image.Pt(45, 38)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/rotate?"+tt.query, bytes.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+
+			handler := Handler(HandleRotate)
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			img, err := png.Decode(rr.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.size, img.Bounds().Size())
+		})
+	}
+}
+
+func TestResizeImageRotated(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, solidImage(40, 20, color.RGBA{255, 0, 0, 255})))
+
+	// Rotation happens before resizing, so the requested size is kept
+	req := httptest.NewRequest(http.MethodPost, "/thumbnail?width=10&angle=270", bytes.NewReader(buf.Bytes()))
+	rr := httptest.NewRecorder()
+	Handler(HandleThumbnail).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	img, err := png.Decode(rr.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Pt(10, 20), img.Bounds().Size())
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// sigV4Algorithm is the signing algorithm used for S3 requests
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	// sigV4Service is the service name used in the credential scope
+	sigV4Service = "s3"
+	// defaultS3Region is the region used when none is configured
+	defaultS3Region = "us-east-1"
+)
+
+// S3Config configures an S3Store.
+type S3Config struct {
+	// Endpoint is the base URL of the S3-compatible service, e.g. "https://s3.amazonaws.com"
+	Endpoint string
+	// Bucket is the bucket objects are read from and written to
+	Bucket string
+	// Region is the region used to sign requests; defaults to "us-east-1"
+	Region string
+	// AccessKey is the access key ID used to sign requests
+	AccessKey string
+	// SecretKey is the secret access key used to sign requests
+	SecretKey string
+	// PathStyle addresses the bucket in the URL path instead of the host name
+	PathStyle bool
+}
+
+// S3Store reads and writes objects in a bucket of an S3-compatible object store.
+// Requests are signed with AWS Signature Version 4. It implements both Source and
+// Destination.
+type S3Store struct {
+	endpoint *url.URL
+	config   S3Config
+	client   *http.Client
+	now      func() time.Time
+}
+
+// NewS3Store returns an S3Store for the bucket described by config.
+func NewS3Store(config S3Config) (*S3Store, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("missing bucket")
+	}
+	if config.Region == "" {
+		config.Region = defaultS3Region
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint: %s", config.Endpoint)
+	}
+	return &S3Store{endpoint: endpoint, config: config, client: http.DefaultClient, now: time.Now}, nil
+}
+
+// Get reads the object stored under key. It implements Source.
+func (s *S3Store) Get(ctx context.Context, key string, since time.Time) (io.ReadCloser, ObjectInfo, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	if !since.IsZero() {
+		req.Header.Set("If-Modified-Since", since.UTC().Format(http.TimeFormat))
+	}
+	s.sign(req, emptyPayloadHash)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		info := ObjectInfo{Key: key, Size: resp.ContentLength}
+		if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+			info.ModTime = modTime
+		}
+		return resp.Body, info, nil
+	case http.StatusNotModified:
+		resp.Body.Close()
+		return nil, ObjectInfo{Key: key}, ErrNotModified
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ObjectInfo{}, ErrNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, ObjectInfo{}, s3Error(resp)
+	}
+}
+
+// Put writes data to the object stored under key. It implements Destination.
+func (s *S3Store) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	req, err := s.newRequest(ctx, http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	sum := sha256.Sum256(data)
+	s.sign(req, hex.EncodeToString(sum[:]))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+// newRequest builds an unsigned request for the object stored under key.
+func (s *S3Store) newRequest(ctx context.Context, method, key string, data []byte) (*http.Request, error) {
+	key = strings.TrimPrefix(key, "/")
+	if key == "" {
+		return nil, ErrInvalidKey
+	}
+	for _, elem := range strings.Split(key, "/") {
+		if elem == "." || elem == ".." {
+			return nil, ErrInvalidKey
+		}
+	}
+
+	u := *s.endpoint
+	basePath := strings.TrimSuffix(u.Path, "/")
+	if s.config.PathStyle {
+		u.Path = basePath + "/" + s.config.Bucket + "/" + key
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+		u.Path = basePath + "/" + key
+	}
+	u.RawPath = uriEncode(u.Path)
+
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+	return http.NewRequestWithContext(ctx, method, u.String(), body)
+}
+
+// emptyPayloadHash is the hex-encoded SHA-256 hash of an empty payload
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (s *S3Store) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, s.config.Region, sigV4Service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := signingKey(s.config.SecretKey, date, s.config.Region, sigV4Service)
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, s.config.AccessKey, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+// signingKey derives the Signature Version 4 signing key for the given date, region and service.
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery returns the query string in Signature Version 4 canonical form.
+func canonicalQuery(values url.Values) string {
+	// url.Values.Encode sorts by key but encodes spaces as "+", which SigV4 does not allow.
+	return strings.ReplaceAll(values.Encode(), "+", "%20")
+}
+
+// uriEncode percent-encodes an object path as required by Signature Version 4.
+// Slashes separating path segments are left unencoded.
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Error builds an error from an unsuccessful S3 response.
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3: %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
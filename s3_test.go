@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is a minimal in-memory S3-compatible server that verifies request signatures.
+type fakeS3 struct {
+	secretKey string
+	region    string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	modTime time.Time
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.verify(r) {
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+
+	// Objects are keyed by host and escaped path so both addressing styles can be checked.
+	name := r.Host + r.URL.EscapedPath()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := f.objects[name]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !f.modTime.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Last-Modified", f.modTime.UTC().Format(http.TimeFormat))
+		w.Write(data)
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[name] = data
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// verify recomputes the Signature Version 4 signature of r from the server's point of view.
+func (f *fakeS3) verify(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	var accessKey, scope, signedHeaders, signature string
+	_, err := fmt.Sscanf(strings.ReplaceAll(auth, ",", ""), "AWS4-HMAC-SHA256 Credential=%s SignedHeaders=%s Signature=%s", &scope, &signedHeaders, &signature)
+	if err != nil {
+		return false
+	}
+	accessKey, scope, _ = strings.Cut(scope, "/")
+	if accessKey == "" {
+		return false
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != r.Header.Get("X-Amz-Content-Sha256") {
+		return false
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + value + "\n")
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		canonicalQuery(r.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		r.Header.Get("X-Amz-Date"),
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	parts := strings.Split(scope, "/")
+	if len(parts) != 4 || parts[1] != f.region {
+		return false
+	}
+	key := signingKey(f.secretKey, parts[0], parts[1], parts[2])
+	return hex.EncodeToString(hmacSHA256(key, stringToSign)) == signature
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{
+		secretKey: "secret",
+		region:    "eu-west-1",
+		objects:   map[string][]byte{},
+		modTime:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	return fake, srv
+}
+
+func TestSigningKey(t *testing.T) {
+	// Example from the AWS Signature Version 4 documentation.
+	key := signingKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20150830", "us-east-1", "iam")
+	assert.Equal(t, "c4afb1cc5771d871763a393e44b703571b55cc28424d1a5e86da6ed3c154a4b9", hex.EncodeToString(key))
+}
+
+func TestS3Store(t *testing.T) {
+	tests := []struct {
+		name      string
+		pathStyle bool
+		key       string
+	}{
+		{name: "Path style", pathStyle: true, key: "images/photo.jpg"},
+		{name: "Virtual hosted style", pathStyle: false, key: "images/photo.jpg"},
+		{name: "Key with special characters", pathStyle: true, key: "images/my photo+1.jpg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, srv := newFakeS3(t)
+			store, err := NewS3Store(S3Config{
+				Endpoint:  srv.URL,
+				Bucket:    "bucket",
+				Region:    fake.region,
+				AccessKey: "access",
+				SecretKey: fake.secretKey,
+				PathStyle: tt.pathStyle,
+			})
+			assert.NoError(t, err)
+
+			// Route virtual hosted requests for bucket.127.0.0.1 to the fake server.
+			addr := srv.Listener.Addr().String()
+			store.client = &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, addr)
+				},
+			}}
+
+			ctx := context.Background()
+			_, _, err = store.Get(ctx, tt.key, time.Time{})
+			assert.Equal(t, ErrNotFound, err)
+
+			err = store.Put(ctx, tt.key, []byte("image data"), "image/jpeg")
+			assert.NoError(t, err)
+
+			body, info, err := store.Get(ctx, tt.key, time.Time{})
+			assert.NoError(t, err)
+			data, _ := io.ReadAll(body)
+			body.Close()
+			assert.Equal(t, "image data", string(data))
+			assert.Equal(t, fake.modTime, info.ModTime)
+
+			_, _, err = store.Get(ctx, tt.key, fake.modTime)
+			assert.Equal(t, ErrNotModified, err)
+		})
+	}
+}
+
+func TestS3StoreBadCredentials(t *testing.T) {
+	_, srv := newFakeS3(t)
+	store, err := NewS3Store(S3Config{
+		Endpoint:  srv.URL,
+		Bucket:    "bucket",
+		Region:    "eu-west-1",
+		AccessKey: "access",
+		SecretKey: "wrong",
+		PathStyle: true,
+	})
+	assert.NoError(t, err)
+
+	_, _, err = store.Get(context.Background(), "photo.jpg", time.Time{})
+	assert.ErrorContains(t, err, "403")
+}
+
+func TestS3StoreInvalidKey(t *testing.T) {
+	store, err := NewS3Store(S3Config{Endpoint: "http://localhost:9000", Bucket: "bucket", PathStyle: true})
+	assert.NoError(t, err)
+
+	for _, key := range []string{"", "/", "../photo.jpg", "images/./photo.jpg"} {
+		_, _, err := store.Get(context.Background(), key, time.Time{})
+		assert.Equal(t, ErrInvalidKey, err, key)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	store, err := NewS3Store(S3Config{
+		Endpoint:  srv.URL,
+		Bucket:    "bucket",
+		Region:    fake.region,
+		AccessKey: "access",
+		SecretKey: fake.secretKey,
+		PathStyle: true,
+	})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/thumbnail?width=50&dest=thumbs/image.png", bytes.NewReader(createImage(t, "png")))
+	rr := httptest.NewRecorder()
+
+	handler := WithDestination(store, Persist(HandleThumbnail))
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, rr.Body.Bytes(), fake.objects[srv.Listener.Addr().String()+"/bucket/thumbs/image.png"])
+}
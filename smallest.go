@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"sync"
+)
+
+const (
+	// maxGIFColors is the number of colors a GIF can hold without quantization
+	maxGIFColors = 256
+	// defaultSmallestSSIM is the MS-SSIM lossy candidates of encodeSmallest must reach
+	// against the image when no target SSIM is requested
+	defaultSmallestSSIM = 0.98
+)
+
+// encodeSmallest encodes img with every candidate encoder in parallel and returns the
+// smallest output, recording its format, JPEG quality and MS-SSIM in report.
+// Candidates are limited to encodings that meet the requested quality: lossless PNG,
+// GIF and PNG8 for images with few enough colors, and no partially transparent
+// pixels, to be stored without quantization, and JPEG for opaque images. JPEG is
+// only a candidate if its MS-SSIM against img reaches the target SSIM of o, or
+// defaultSmallestSSIM. With a target SSIM it is encoded at the lowest quality that
+// reaches it, and otherwise at the configured quality.
+func encodeSmallest(ctx context.Context, img image.Image, o *Options, report *Report) ([]byte, error) {
+	candidates := []string{formatPNG}
+	if isOpaque(img) {
+		candidates = append(candidates, formatJPEG)
+	}
+	if countColors(img, maxGIFColors) <= maxGIFColors && !hasPartialAlpha(img) {
+		candidates = append(candidates, formatGIF, formatPNG8)
+	}
+
+	type result struct {
+		data    []byte
+		quality int
+		ssim    float64
+		err     error
+	}
+	results := make([]result, len(candidates))
+	var wg sync.WaitGroup
+	for i, format := range candidates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if format != formatJPEG {
+				data, err := EncodeImage(ctx, img, format, o.encoder())
+				results[i] = result{data: data, err: err}
+				return
+			}
+			data, quality, ssim, err := encodeSmallestJPEG(ctx, img, o)
+			results[i] = result{data, quality, ssim, err}
+		}()
+	}
+	wg.Wait()
+
+	best := -1
+	for i, res := range results {
+		if res.err != nil || res.data == nil {
+			continue
+		}
+		if best < 0 || len(res.data) < len(results[best].data) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil, results[0].err
+	}
+	report.Format = candidates[best]
+	if report.Format == formatJPEG {
+		report.Quality = results[best].quality
+		if o.TargetSSIM > 0 {
+			report.SSIM = results[best].ssim
+		}
+	}
+	return results[best].data, nil
+}
+
+// encodeSmallestJPEG returns the JPEG candidate of encodeSmallest along with its
+// quality and MS-SSIM against img, or nil data if it does not reach the target SSIM.
+func encodeSmallestJPEG(ctx context.Context, img image.Image, o *Options) ([]byte, int, float64, error) {
+	if o.TargetSSIM > 0 {
+		maxQuality := o.Quality
+		if maxQuality == 0 {
+			maxQuality = 100
+		}
+		data, quality, ssim, err := searchSSIM(ctx, img, maxQuality, o.TargetSSIM)
+		if err != nil || ssim < o.TargetSSIM {
+			return nil, 0, 0, err
+		}
+		return data, quality, ssim, nil
+	}
+
+	data, err := EncodeImage(ctx, img, formatJPEG, o.encoder())
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	ssim := msssimPlanes(lumaPlane(img), lumaPlane(decoded))
+	if ssim < defaultSmallestSSIM {
+		return nil, 0, 0, nil
+	}
+	return data, o.quality(), ssim, nil
+}
+
+// countColors returns the number of distinct colors in img, counting at most limit+1.
+// RGBA, NRGBA and grayscale images are read from their pixel buffers.
+func countColors(img image.Image, limit int) int {
+	bounds := img.Bounds()
+	seen := map[uint64]struct{}{}
+	add := func(c uint64) bool {
+		seen[c] = struct{}{}
+		return len(seen) > limit
+	}
+
+	switch src := img.(type) {
+	case *image.Paletted:
+		if len(src.Palette) <= limit {
+			return len(src.Palette)
+		}
+	case *image.Gray:
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			i := src.PixOffset(bounds.Min.X, y)
+			for _, v := range src.Pix[i : i+bounds.Dx()] {
+				if add(uint64(v)) {
+					return len(seen)
+				}
+			}
+		}
+		return len(seen)
+	case *image.RGBA, *image.NRGBA:
+		pix, stride := pixelBuffer(src)
+		for y := 0; y < bounds.Dy(); y++ {
+			row := pix[y*stride : y*stride+4*bounds.Dx()]
+			for i := 0; i < len(row); i += 4 {
+				c := uint64(binary.BigEndian.Uint32(row[i:]))
+				if row[i+3] == 0 {
+					// Fully transparent pixels look the same whatever their color
+					c = 0
+				}
+				if add(c) {
+					return len(seen)
+				}
+			}
+		}
+		return len(seen)
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if add(uint64(r)<<48 | uint64(g)<<32 | uint64(b)<<16 | uint64(a)) {
+				return len(seen)
+			}
+		}
+	}
+	return len(seen)
+}
+
+// hasPartialAlpha reports whether img has pixels that are neither fully opaque nor
+// fully transparent. RGBA and NRGBA images are read from their pixel buffers, and
+// paletted images are judged by their palette.
+func hasPartialAlpha(img image.Image) bool {
+	if isOpaque(img) {
+		return false
+	}
+	bounds := img.Bounds()
+
+	switch src := img.(type) {
+	case *image.Paletted:
+		for _, c := range src.Palette {
+			if _, _, _, a := c.RGBA(); a != 0 && a != 0xffff {
+				return true
+			}
+		}
+		return false
+	case *image.RGBA, *image.NRGBA:
+		pix, stride := pixelBuffer(src)
+		for y := 0; y < bounds.Dy(); y++ {
+			row := pix[y*stride : y*stride+4*bounds.Dx()]
+			for i := 3; i < len(row); i += 4 {
+				if row[i] != 0 && row[i] != 0xff {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0 && a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pixelBuffer returns the pixels of an RGBA or NRGBA image starting at the top left
+// corner of its bounds, and the stride between its rows.
+func pixelBuffer(img image.Image) ([]uint8, int) {
+	switch src := img.(type) {
+	case *image.RGBA:
+		return src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y):], src.Stride
+	case *image.NRGBA:
+		return src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y):], src.Stride
+	}
+	return nil, 0
+}
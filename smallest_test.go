@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// noisyImage returns an opaque image with many colors, which compresses poorly without loss.
+func noisyImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	for x := 0; x < 100; x++ {
+		for y := 0; y < 100; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 7 % 256), uint8(y * 13 % 256), uint8((x * y) % 256), 255})
+		}
+	}
+	return img
+}
+
+func TestEncodeSmallest(t *testing.T) {
+	flat := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	for i := range flat.Pix {
+		flat.Pix[i] = 255
+	}
+	transparent := noisyImage()
+	transparent.Set(0, 0, color.RGBA{})
+
+	tests := []struct {
+		name       string
+		img        image.Image
+		opts       Options
+		candidates []string
+		expected   string
+	}{
+		{name: "Flat opaque image", img: flat, candidates: []string{"png", "jpeg", "gif", "png8"}},
+		{name: "Noisy opaque image", img: noisyImage(), candidates: []string{"png", "jpeg"}, expected: "jpeg"},
+		{name: "Transparent image", img: transparent, candidates: []string{"png"}, expected: "png"},
+		// The lossy candidate is smaller, but below the default target SSIM
+		{name: "Lossy candidate too poor", img: noisyImage(), opts: Options{Quality: 1}, candidates: []string{"png"}, expected: "png"},
+		{name: "Lossy candidate below the target", img: noisyImage(), opts: Options{Quality: 10, TargetSSIM: 0.99}, candidates: []string{"png"}, expected: "png"},
+		{name: "Lossy candidate at the target", img: noisyImage(), opts: Options{TargetSSIM: 0.99}, candidates: []string{"png", "jpeg"}, expected: "jpeg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var report Report
+			data, err := encodeSmallest(context.Background(), tt.img, &tt.opts, &report)
+			assert.NoError(t, err)
+			assert.Contains(t, tt.candidates, report.Format)
+			if tt.expected != "" {
+				assert.Equal(t, tt.expected, report.Format)
+			}
+
+			for _, candidate := range tt.candidates {
+				encoded, err := EncodeImage(context.Background(), tt.img, candidate)
+				assert.NoError(t, err)
+				if candidate != formatJPEG || tt.opts.TargetSSIM == 0 {
+					assert.LessOrEqual(t, len(data), len(encoded), candidate)
+				}
+			}
+			if report.Format == formatJPEG && tt.opts.TargetSSIM > 0 {
+				assert.GreaterOrEqual(t, report.SSIM, tt.opts.TargetSSIM)
+				assert.Less(t, report.Quality, 100)
+			}
+		})
+	}
+}
+
+func TestCountColors(t *testing.T) {
+	assert.Equal(t, 1, countColors(image.NewRGBA(image.Rect(0, 0, 10, 10)), 256))
+	assert.Equal(t, 257, countColors(noisyImage(), 256))
+
+	// Fully transparent pixels count once whatever their color
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	nrgba.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 0})
+	nrgba.SetNRGBA(2, 0, color.NRGBA{0, 0, 255, 255})
+	assert.Equal(t, 2, countColors(nrgba, 256))
+
+	gray := image.NewGray(image.Rect(0, 0, 300, 1))
+	for x := 0; x < 300; x++ {
+		gray.SetGray(x, 0, color.Gray{uint8(x % 3)})
+	}
+	assert.Equal(t, 3, countColors(gray, 256))
+	assert.Equal(t, 2, countColors(gray.SubImage(image.Rect(1, 0, 3, 1)), 256))
+
+	// Sub-images only count their own pixels
+	assert.Equal(t, 1, countColors(noisyImage().SubImage(image.Rect(5, 5, 6, 6)), 256))
+}
+
+func TestHasPartialAlpha(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 255})
+	assert.False(t, hasPartialAlpha(img))
+	img.SetNRGBA(1, 0, color.NRGBA{255, 0, 0, 128})
+	assert.True(t, hasPartialAlpha(img))
+	assert.False(t, hasPartialAlpha(noisyImage()))
+	assert.False(t, hasPartialAlpha(img.SubImage(image.Rect(0, 0, 1, 1))))
+
+	paletted := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Transparent, color.NRGBA{0, 0, 0, 255}})
+	assert.False(t, hasPartialAlpha(paletted))
+	paletted.Palette = append(paletted.Palette, color.NRGBA{0, 0, 0, 128})
+	assert.True(t, hasPartialAlpha(paletted))
+}
+
+func TestHandleResizeSmallest(t *testing.T) {
+	data, err := EncodeImage(context.Background(), noisyImage(), "png")
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/resize?height=80&width=80&format=smallest", bytes.NewReader(data))
+	rr := httptest.NewRecorder()
+
+	handler := Handler(HandleResize)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "jpeg", rr.Header().Get("X-Image-Format"))
+	assert.Equal(t, "image/jpeg", rr.Header().Get("Content-Type"))
+}
+
+func TestHandleConvertQuality(t *testing.T) {
+	sizes := map[string]int{}
+	for _, quality := range []string{"10", "95"} {
+		req := httptest.NewRequest(http.MethodPost, "/convert?format=jpeg&quality="+quality, bytes.NewReader(createImage(t, "png")))
+		rr := httptest.NewRecorder()
+		Handler(HandleConvert).ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		sizes[quality] = rr.Body.Len()
+	}
+	assert.Less(t, sizes["10"], sizes["95"])
+
+	req := httptest.NewRequest(http.MethodPost, "/convert?format=jpeg&quality=101", bytes.NewReader(createImage(t, "png")))
+	rr := httptest.NewRecorder()
+	Handler(HandleConvert).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "invalid quality: 101\n", rr.Body.String())
+}
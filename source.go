@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a source has no object for the requested key
+	ErrNotFound = fmt.Errorf("not found")
+	// ErrNotModified is returned when a conditional read finds the object unchanged
+	ErrNotModified = fmt.Errorf("not modified")
+	// ErrInvalidKey is returned when a key is malformed or escapes the source root
+	ErrInvalidKey = fmt.Errorf("invalid key")
+	// ErrNoSource is returned when a request names a source key but no source is configured
+	ErrNoSource = fmt.Errorf("no source configured")
+	// ErrNoDestination is returned when a request names a destination key but no destination is configured
+	ErrNoDestination = fmt.Errorf("no destination configured")
+)
+
+// ObjectInfo describes an object held by a Source.
+type ObjectInfo struct {
+	// Key is the key the object is stored under
+	Key string
+	// Size is the size of the object in bytes
+	Size int64
+	// ModTime is the time the object was last modified
+	ModTime time.Time
+}
+
+// Source is an origin from which original images are read by key.
+type Source interface {
+	// Get opens the object stored under key. If since is non-zero and the object
+	// has not been modified after it, Get returns ErrNotModified. Get returns
+	// ErrNotFound if there is no object for key.
+	Get(ctx context.Context, key string, since time.Time) (io.ReadCloser, ObjectInfo, error)
+}
+
+// Destination is a store to which processed images are written by key.
+type Destination interface {
+	// Put stores data under key, replacing any existing object.
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+}
+
+// FileSource is a Source that reads images from a directory on the local filesystem.
+// Keys are slash-separated paths relative to the root directory. Keys that would
+// resolve outside of the root, either through ".." elements or symbolic links, are
+// rejected with ErrInvalidKey.
+type FileSource struct {
+	root string
+}
+
+// NewFileSource returns a FileSource rooted at dir. The directory must exist.
+func NewFileSource(dir string) (*FileSource, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &FileSource{root: root}, nil
+}
+
+// Get opens the file stored under key. It implements Source.
+func (s *FileSource) Get(ctx context.Context, key string, since time.Time) (io.ReadCloser, ObjectInfo, error) {
+	name, err := s.resolve(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, ObjectInfo{}, ErrNotFound
+	}
+
+	obj := ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}
+	if !since.IsZero() && !obj.ModTime.Truncate(time.Second).After(since) {
+		f.Close()
+		return nil, obj, ErrNotModified
+	}
+
+	return f, obj, nil
+}
+
+// resolve maps key to a path inside the root directory. Symbolic links are
+// followed and the result must still lie inside the root.
+func (s *FileSource) resolve(key string) (string, error) {
+	if key == "" || strings.ContainsRune(key, 0) || strings.Contains(key, "\\") {
+		return "", ErrInvalidKey
+	}
+	for _, elem := range strings.Split(key, "/") {
+		if elem == ".." {
+			return "", ErrInvalidKey
+		}
+	}
+
+	rel := strings.TrimPrefix(path.Clean("/"+key), "/")
+	if rel == "" {
+		return "", ErrInvalidKey
+	}
+
+	name, err := filepath.EvalSymlinks(filepath.Join(s.root, filepath.FromSlash(rel)))
+	if os.IsNotExist(err) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if !within(s.root, name) {
+		return "", ErrInvalidKey
+	}
+
+	return name, nil
+}
+
+// within reports whether name is root or lies inside of it.
+func within(root, name string) bool {
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+type sourceContextKey struct{}
+
+// WithSource returns an http.Handler that makes src available to the handlers
+// of next. Handlers read images from src when the request names a key in the
+// "src" query parameter.
+func WithSource(src Source, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), sourceContextKey{}, src)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestImage returns the image a request refers to. If the "src" query parameter
+// is set, the image is read from the Source configured with WithSource, honoring the
+// request's If-Modified-Since header unless it also has an If-None-Match header, which
+// takes precedence, and its ObjectInfo is returned. Otherwise the
+// request body is returned with a zero ObjectInfo. Images already buffered by Cached
+// are returned without being read again.
+func RequestImage(r *http.Request) (io.ReadCloser, ObjectInfo, error) {
+	if body, info, ok := requestImageData(r); ok {
+		return body, info, nil
+	}
+
+	key := r.URL.Query().Get("src")
+	if key == "" {
+		return r.Body, ObjectInfo{}, nil
+	}
+
+	src, ok := r.Context().Value(sourceContextKey{}).(Source)
+	if !ok || src == nil {
+		return nil, ObjectInfo{}, ErrNoSource
+	}
+
+	var since time.Time
+	if value := r.Header.Get("If-Modified-Since"); value != "" && r.Header.Get("If-None-Match") == "" {
+		if t, err := http.ParseTime(value); err == nil {
+			since = t
+		}
+	}
+
+	return src.Get(r.Context(), key, since)
+}
+
+type destinationContextKey struct{}
+
+// WithDestination returns an http.Handler that makes dst available to the handlers
+// of next. Handlers wrapped with Persist write their results to dst when the request
+// names a key in the "dest" query parameter.
+func WithDestination(dst Destination, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), destinationContextKey{}, dst)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Persist returns a Handler that writes the image produced by h to the Destination
+// configured with WithDestination when the request names a key in the "dest" query
+// parameter. Responses other than successful images are passed through unchanged.
+func Persist(h Handler) Handler {
+	return func(w http.ResponseWriter, r *http.Request) http.Handler {
+		key := r.URL.Query().Get("dest")
+		if key == "" {
+			return h(w, r)
+		}
+
+		dst, ok := r.Context().Value(destinationContextKey{}).(Destination)
+		if !ok || dst == nil {
+			return Error(http.StatusBadRequest, ErrNoDestination)
+		}
+
+		next := h(w, r)
+		resp, ok := next.(*ImageResponse)
+		if !ok || resp.Code != http.StatusOK {
+			return next
+		}
+
+		if err := dst.Put(r.Context(), key, resp.Data, http.DetectContentType(resp.Data)); err != nil {
+			return SourceError(err)
+		}
+		return next
+	}
+}
+
+// SourceError returns the http.Handler that reports err, an error returned by
+// a Source or Destination, to the client. Image routes wrapped with Cached answer
+// ErrNotModified with NotModified instead, which carries the entity tag of the image.
+func SourceError(err error) http.Handler {
+	switch err {
+	case ErrNotModified:
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotModified)
+		})
+	case ErrNotFound:
+		return Error(http.StatusNotFound, err)
+	case ErrInvalidKey, ErrNoSource, ErrNoDestination:
+		return Error(http.StatusBadRequest, err)
+	default:
+		return Error(http.StatusBadGateway, err)
+	}
+}
+
+// SourceETag returns the strong entity tag of the image transformed as requested by r
+// from the source image described by info. It depends only on the source image and the
+// transformation, so a source that reports the image unchanged can be answered with it
+// without transforming the image again.
+func SourceETag(r *http.Request, info ObjectInfo) string {
+	return `"` + cacheKey(r, []byte(info.Key+"\n"+info.ModTime.UTC().Format(time.RFC3339Nano)))[:32] + `"`
+}
+
+// NotModified returns an ImageResponse that answers a conditional request for the
+// image transformed from the source image described by info with 304 Not Modified.
+func NotModified(r *http.Request, info ObjectInfo) *ImageResponse {
+	resp := Image(http.StatusNotModified, nil).LastModified(info.ModTime)
+	resp.Header.Set("ETag", SourceETag(r, info))
+	return resp
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSourceGet(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "nested"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "image.png"), []byte("root"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "nested", "image.png"), []byte("nested"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(outside, "secret.png"), []byte("secret"), 0o644))
+	assert.NoError(t, os.Symlink(filepath.Join(outside, "secret.png"), filepath.Join(root, "escape.png")))
+	assert.NoError(t, os.Symlink(filepath.Join(root, "image.png"), filepath.Join(root, "link.png")))
+
+	src, err := NewFileSource(root)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		key         string
+		expected    string
+		expectedErr error
+	}{
+		{name: "File in root", key: "image.png", expected: "root"},
+		{name: "Nested file", key: "nested/image.png", expected: "nested"},
+		{name: "Leading slash", key: "/nested/image.png", expected: "nested"},
+		{name: "Symlink inside root", key: "link.png", expected: "root"},
+		{name: "Missing file", key: "missing.png", expectedErr: ErrNotFound},
+		{name: "Directory", key: "nested", expectedErr: ErrNotFound},
+		{name: "Empty key", key: "", expectedErr: ErrInvalidKey},
+		{name: "Parent traversal", key: "../secret.png", expectedErr: ErrInvalidKey},
+		{name: "Nested traversal", key: "nested/../../secret.png", expectedErr: ErrInvalidKey},
+		{name: "Backslash traversal", key: "..\\secret.png", expectedErr: ErrInvalidKey},
+		{name: "Symlink escape", key: "escape.png", expectedErr: ErrInvalidKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, info, err := src.Get(context.Background(), tt.key, time.Time{})
+			if tt.expectedErr != nil {
+				assert.Equal(t, tt.expectedErr, err)
+				return
+			}
+			assert.NoError(t, err)
+			defer body.Close()
+
+			data, err := io.ReadAll(body)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, string(data))
+			assert.Equal(t, int64(len(tt.expected)), info.Size)
+		})
+	}
+}
+
+func TestFileSourceGetConditional(t *testing.T) {
+	root := t.TempDir()
+	name := filepath.Join(root, "image.png")
+	assert.NoError(t, os.WriteFile(name, []byte("data"), 0o644))
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(name, modTime, modTime))
+
+	src, err := NewFileSource(root)
+	assert.NoError(t, err)
+
+	_, _, err = src.Get(context.Background(), "image.png", modTime)
+	assert.Equal(t, ErrNotModified, err)
+
+	body, _, err := src.Get(context.Background(), "image.png", modTime.Add(-time.Second))
+	assert.NoError(t, err)
+	body.Close()
+}
+
+func TestCachedFromSourceConditional(t *testing.T) {
+	root := t.TempDir()
+	name := filepath.Join(root, "image.png")
+	assert.NoError(t, os.WriteFile(name, createImage(t, "png"), 0o644))
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(name, modTime, modTime))
+	src, err := NewFileSource(root)
+	assert.NoError(t, err)
+
+	handler := WithSource(src, CacheControl("public, max-age=60", Cached(NewMemoryCache(1<<20), HandleThumbnail)))
+	etag := SourceETag(httptest.NewRequest(http.MethodPost, "/thumbnail?width=50&src=image.png", nil), ObjectInfo{Key: "image.png", ModTime: modTime})
+
+	tests := []struct {
+		name           string
+		query          string
+		header         map[string]string
+		expectedStatus int
+		expectedETag   string
+	}{
+		{name: "Unconditional", query: "width=50", expectedStatus: http.StatusOK, expectedETag: etag},
+		{name: "Cached", query: "width=50", expectedStatus: http.StatusOK, expectedETag: etag},
+		{name: "Not modified since", query: "width=50", header: map[string]string{"If-Modified-Since": modTime.Format(http.TimeFormat)}, expectedStatus: http.StatusNotModified, expectedETag: etag},
+		{name: "ETag takes precedence", query: "width=50", header: map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": modTime.Format(http.TimeFormat)}, expectedStatus: http.StatusOK, expectedETag: etag},
+		{name: "Different transformation", query: "width=40", header: map[string]string{"If-None-Match": etag}, expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/thumbnail?src=image.png&"+tt.query, nil)
+			for key, value := range tt.header {
+				req.Header.Set(key, value)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			if tt.expectedETag != "" {
+				assert.Equal(t, tt.expectedETag, rr.Header().Get("ETag"))
+			} else {
+				assert.NotEqual(t, etag, rr.Header().Get("ETag"))
+			}
+			assert.Equal(t, "public, max-age=60", rr.Header().Get("Cache-Control"))
+			assert.Equal(t, modTime.Format(http.TimeFormat), rr.Header().Get("Last-Modified"))
+		})
+	}
+}
+
+func TestHandleResizeFromSource(t *testing.T) {
+	root := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "image.png"), createImage(t, "png"), 0o644))
+	src, err := NewFileSource(root)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		queryParams    string
+		source         Source
+		expectedStatus int
+	}{
+		{
+			name:           "Source image",
+			queryParams:    "height=50&width=50&src=image.png",
+			source:         src,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Missing source image",
+			queryParams:    "height=50&width=50&src=missing.png",
+			source:         src,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Traversal",
+			queryParams:    "height=50&width=50&src=../image.png",
+			source:         src,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "No source configured",
+			queryParams:    "height=50&width=50&src=image.png",
+			source:         nil,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/resize?"+tt.queryParams, bytes.NewReader(nil))
+			rr := httptest.NewRecorder()
+
+			handler := WithSource(tt.source, Handler(HandleResize))
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+)
+
+// ErrSizeMismatch is returned when images that must have the same size do not
+var ErrSizeMismatch = fmt.Errorf("images differ in size")
+
+const (
+	// ssimWindow is the width of the Gaussian window SSIM statistics are computed over
+	ssimWindow = 11
+	// ssimSigma is the standard deviation of the Gaussian window
+	ssimSigma = 1.5
+	// ssimC1 and ssimC2 stabilize the SSIM division for 8-bit samples
+	ssimC1 = (0.01 * 255) * (0.01 * 255)
+	ssimC2 = (0.03 * 255) * (0.03 * 255)
+)
+
+// msssimWeights are the exponents of the MS-SSIM scales, from finest to coarsest.
+var msssimWeights = []float64{0.0448, 0.2856, 0.3001, 0.2363, 0.1333}
+
+// plane is a single channel of samples in row-major order.
+type plane struct {
+	width, height int
+	pix           []float64
+}
+
+// lumaPlane returns the luma of img on a 0–255 scale. Colors are read premultiplied,
+// so transparent pixels count as black; images with transparency are flattened onto
+// their background color before they are encoded to JPEG and compared.
+func lumaPlane(img image.Image) plane {
+	bounds := img.Bounds()
+	p := plane{width: bounds.Dx(), height: bounds.Dy(), pix: make([]float64, bounds.Dx()*bounds.Dy())}
+	i := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			p.pix[i] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+			i++
+		}
+	}
+	return p
+}
+
+// downsample returns p averaged over 2x2 blocks.
+func (p plane) downsample() plane {
+	d := plane{width: p.width / 2, height: p.height / 2}
+	d.pix = make([]float64, d.width*d.height)
+	for y := 0; y < d.height; y++ {
+		for x := 0; x < d.width; x++ {
+			i := 2*y*p.width + 2*x
+			d.pix[y*d.width+x] = (p.pix[i] + p.pix[i+1] + p.pix[i+p.width] + p.pix[i+p.width+1]) / 4
+		}
+	}
+	return d
+}
+
+// gaussianKernel returns a normalized one-dimensional Gaussian kernel of the given
+// radius and standard deviation.
+func gaussianKernel(radius int, sigma float64) []float64 {
+	kernel := make([]float64, 2*radius+1)
+	sum := 0.0
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return kernel
+}
+
+// filter returns p convolved with kernel horizontally and vertically. Samples beyond
+// the edges are clamped to the nearest edge sample.
+func (p plane) filter(kernel []float64) plane {
+	radius := len(kernel) / 2
+	tmp := make([]float64, len(p.pix))
+	for y := 0; y < p.height; y++ {
+		row := p.pix[y*p.width : (y+1)*p.width]
+		for x := 0; x < p.width; x++ {
+			sum := 0.0
+			for k, weight := range kernel {
+				sum += weight * row[min(max(x+k-radius, 0), p.width-1)]
+			}
+			tmp[y*p.width+x] = sum
+		}
+	}
+	out := plane{width: p.width, height: p.height, pix: make([]float64, len(p.pix))}
+	for y := 0; y < p.height; y++ {
+		for x := 0; x < p.width; x++ {
+			sum := 0.0
+			for k, weight := range kernel {
+				sum += weight * tmp[min(max(y+k-radius, 0), p.height-1)*p.width+x]
+			}
+			out.pix[y*p.width+x] = sum
+		}
+	}
+	return out
+}
+
+// product returns the element-wise product of p and q.
+func (p plane) product(q plane) plane {
+	out := plane{width: p.width, height: p.height, pix: make([]float64, len(p.pix))}
+	for i := range p.pix {
+		out.pix[i] = p.pix[i] * q.pix[i]
+	}
+	return out
+}
+
+// ssimPlanes returns the mean SSIM of a and b and the mean of its contrast-structure
+// term, which MS-SSIM uses at all but the coarsest scale.
+func ssimPlanes(a, b plane) (ssim, cs float64) {
+	kernel := gaussianKernel(ssimWindow/2, ssimSigma)
+	muA, muB := a.filter(kernel), b.filter(kernel)
+	sqA, sqB, ab := a.product(a).filter(kernel), b.product(b).filter(kernel), a.product(b).filter(kernel)
+
+	for i := range a.pix {
+		ma, mb := muA.pix[i], muB.pix[i]
+		varA := sqA.pix[i] - ma*ma
+		varB := sqB.pix[i] - mb*mb
+		cov := ab.pix[i] - ma*mb
+		c := (2*cov + ssimC2) / (varA + varB + ssimC2)
+		l := (2*ma*mb + ssimC1) / (ma*ma + mb*mb + ssimC1)
+		ssim += l * c
+		cs += c
+	}
+	n := float64(len(a.pix))
+	return ssim / n, cs / n
+}
+
+// msssimPlanes returns the MS-SSIM of a and b. Scales are added while the coarser
+// plane still covers the SSIM window, so small images use fewer scales.
+func msssimPlanes(a, b plane) float64 {
+	scales := 1
+	for w, h := a.width/2, a.height/2; scales < len(msssimWeights) && min(w, h) >= ssimWindow; w, h = w/2, h/2 {
+		scales++
+	}
+	weights := msssimWeights[:scales]
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+
+	result := 1.0
+	for i, w := range weights {
+		ssim, cs := ssimPlanes(a, b)
+		value := cs
+		if i == scales-1 {
+			value = ssim
+		}
+		result *= math.Pow(max(value, 0), w/total)
+		a, b = a.downsample(), b.downsample()
+	}
+	return result
+}
+
+// SSIM returns the structural similarity of the luma of a and b, between -1 and 1,
+// where 1 means the images are identical. It returns ErrSizeMismatch if the images
+// differ in size.
+func SSIM(a, b image.Image) (float64, error) {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return 0, ErrSizeMismatch
+	}
+	ssim, _ := ssimPlanes(lumaPlane(a), lumaPlane(b))
+	return ssim, nil
+}
+
+// MSSSIM returns the multi-scale structural similarity of the luma of a and b,
+// between 0 and 1, where 1 means the images are identical. It returns
+// ErrSizeMismatch if the images differ in size.
+func MSSSIM(a, b image.Image) (float64, error) {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return 0, ErrSizeMismatch
+	}
+	return msssimPlanes(lumaPlane(a), lumaPlane(b)), nil
+}
+
+// searchSSIM returns the JPEG encoding of img with the lowest quality up to
+// maxQuality whose decoded image has an MS-SSIM of at least target against img,
+// together with that quality and MS-SSIM. If no quality meets the target, img is
+// encoded at maxQuality.
+func searchSSIM(ctx context.Context, img image.Image, maxQuality int, target float64) ([]byte, int, float64, error) {
+	reference := lumaPlane(img)
+	var best []byte
+	bestQuality, bestSSIM := 0, 0.0
+
+	lo, hi := 1, maxQuality
+	for lo <= hi {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, 0, err
+		}
+		mid := (lo + hi) / 2
+		data, err := EncodeImage(ctx, img, formatJPEG, WithQuality(mid))
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		ssim := msssimPlanes(reference, lumaPlane(decoded))
+		if ssim >= target {
+			best, bestQuality, bestSSIM = data, mid, ssim
+			hi = mid - 1
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	if best == nil {
+		data, err := EncodeImage(ctx, img, formatJPEG, WithQuality(maxQuality))
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		return data, maxQuality, msssimPlanes(reference, lumaPlane(decoded)), nil
+	}
+	return best, bestQuality, bestSSIM, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gradientImage returns an opaque 200x200 image with smooth gradients, which
+// compresses well and is large enough for every MS-SSIM scale.
+func gradientImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	for x := 0; x < 200; x++ {
+		for y := 0; y < 200; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8((x + y) / 2), 255})
+		}
+	}
+	return img
+}
+
+func TestSSIM(t *testing.T) {
+	img := noisyImage()
+	inverted := image.NewRGBA(img.Bounds())
+	for i := range img.Pix {
+		inverted.Pix[i] = 255 - img.Pix[i]
+		if i%4 == 3 {
+			inverted.Pix[i] = 255
+		}
+	}
+	encoded, err := EncodeImage(context.Background(), img, "jpeg", WithQuality(10))
+	assert.NoError(t, err)
+	degraded, err := jpeg.Decode(bytes.NewReader(encoded))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		a, b   image.Image
+		min    float64
+		max    float64
+		err    error
+		metric func(a, b image.Image) (float64, error)
+	}{
+		{name: "SSIM of identical images", a: img, b: img, min: 1, max: 1, metric: SSIM},
+		{name: "SSIM of degraded image", a: img, b: degraded, min: 0.1, max: 0.95, metric: SSIM},
+		{name: "SSIM of inverted image", a: img, b: inverted, min: -1, max: 0.1, metric: SSIM},
+		{name: "SSIM size mismatch", a: img, b: gradientImage(), err: ErrSizeMismatch, metric: SSIM},
+		{name: "MS-SSIM of identical images", a: gradientImage(), b: gradientImage(), min: 1, max: 1, metric: MSSSIM},
+		{name: "MS-SSIM of degraded image", a: img, b: degraded, min: 0.1, max: 0.99, metric: MSSSIM},
+		{name: "MS-SSIM size mismatch", a: img, b: gradientImage(), err: ErrSizeMismatch, metric: MSSSIM},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := tt.metric(tt.a, tt.b)
+			assert.Equal(t, tt.err, err)
+			if tt.err != nil {
+				return
+			}
+			assert.InDelta(t, (tt.min+tt.max)/2, value, (tt.max-tt.min)/2+1e-9)
+		})
+	}
+}
+
+func TestSearchSSIM(t *testing.T) {
+	for _, target := range []float64{0.9, 0.99} {
+		data, quality, ssim, err := searchSSIM(context.Background(), gradientImage(), 100, target)
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, ssim, target)
+
+		decoded, err := jpeg.Decode(bytes.NewReader(data))
+		assert.NoError(t, err)
+		value, err := MSSSIM(gradientImage(), decoded)
+		assert.NoError(t, err)
+		assert.InDelta(t, ssim, value, 1e-9)
+
+		// The next quality down must miss the target
+		if quality > 1 {
+			lower, err := EncodeImage(context.Background(), gradientImage(), "jpeg", WithQuality(quality-1))
+			assert.NoError(t, err)
+			decoded, err := jpeg.Decode(bytes.NewReader(lower))
+			assert.NoError(t, err)
+			value, err := MSSSIM(gradientImage(), decoded)
+			assert.NoError(t, err)
+			assert.Less(t, value, target)
+		}
+	}
+
+	// Unreachable targets fall back to the maximum quality
+	_, quality, _, err := searchSSIM(context.Background(), noisyImage(), 80, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 80, quality)
+}
+
+func TestHandleConvertTargetSSIM(t *testing.T) {
+	data, err := EncodeImage(context.Background(), gradientImage(), "png")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		query string
+		code  int
+	}{
+		{name: "Low target", query: "format=jpeg&target_ssim=0.9", code: http.StatusOK},
+		{name: "High target", query: "format=jpeg&target_ssim=0.995", code: http.StatusOK},
+		{name: "Zero target", query: "format=jpeg&target_ssim=0", code: http.StatusBadRequest},
+		{name: "Target above one", query: "format=jpeg&target_ssim=1.5", code: http.StatusBadRequest},
+		{name: "Invalid target", query: "format=jpeg&target_ssim=high", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/convert?"+tt.query, bytes.NewReader(data))
+			rr := httptest.NewRecorder()
+
+			handler := Handler(HandleConvert)
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			target, _ := strconv.ParseFloat(req.URL.Query().Get("target_ssim"), 64)
+			ssim, err := strconv.ParseFloat(rr.Header().Get("X-Image-SSIM"), 64)
+			assert.NoError(t, err)
+			assert.GreaterOrEqual(t, ssim, target-0.00005)
+			assert.NotEmpty(t, rr.Header().Get("X-Image-Quality"))
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImageMeta describes an original image held in a Storage.
+type ImageMeta struct {
+	// ID is the content-addressed identifier of the image
+	ID string `json:"id"`
+	// Format is the format the image is encoded in
+	Format string `json:"format"`
+	// Width is the width of the image in pixels
+	Width int `json:"width"`
+	// Height is the height of the image in pixels
+	Height int `json:"height"`
+	// Size is the size of the encoded image in bytes
+	Size int `json:"size"`
+	// Created is the time the image was stored
+	Created time.Time `json:"created"`
+}
+
+// Storage stores original images and their metadata by ID.
+type Storage interface {
+	// Put stores data and its metadata under meta.ID, replacing any existing image.
+	Put(ctx context.Context, meta ImageMeta, data []byte) error
+	// Get returns the image stored under id, or ErrNotFound.
+	Get(ctx context.Context, id string) ([]byte, ImageMeta, error)
+	// Stat returns the metadata of the image stored under id, or ErrNotFound.
+	Stat(ctx context.Context, id string) (ImageMeta, error)
+	// Delete removes the image stored under id, or returns ErrNotFound.
+	Delete(ctx context.Context, id string) error
+	// List returns the metadata of all stored images ordered by creation time.
+	List(ctx context.Context) ([]ImageMeta, error)
+}
+
+// MemoryStorage is a Storage that keeps images in memory.
+type MemoryStorage struct {
+	mu     sync.RWMutex
+	images map[string]memoryImage
+}
+
+type memoryImage struct {
+	meta ImageMeta
+	data []byte
+}
+
+// NewMemoryStorage returns an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{images: map[string]memoryImage{}}
+}
+
+// Put stores data under meta.ID. It implements Storage.
+func (s *MemoryStorage) Put(ctx context.Context, meta ImageMeta, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.images[meta.ID] = memoryImage{meta: meta, data: append([]byte(nil), data...)}
+	return nil
+}
+
+// Get returns the image stored under id. It implements Storage.
+func (s *MemoryStorage) Get(ctx context.Context, id string) ([]byte, ImageMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	img, ok := s.images[id]
+	if !ok {
+		return nil, ImageMeta{}, ErrNotFound
+	}
+	return img.data, img.meta, nil
+}
+
+// Stat returns the metadata of the image stored under id. It implements Storage.
+func (s *MemoryStorage) Stat(ctx context.Context, id string) (ImageMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	img, ok := s.images[id]
+	if !ok {
+		return ImageMeta{}, ErrNotFound
+	}
+	return img.meta, nil
+}
+
+// Delete removes the image stored under id. It implements Storage.
+func (s *MemoryStorage) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.images[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.images, id)
+	return nil
+}
+
+// List returns the metadata of all stored images. It implements Storage.
+func (s *MemoryStorage) List(ctx context.Context) ([]ImageMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	metas := make([]ImageMeta, 0, len(s.images))
+	for _, img := range s.images {
+		metas = append(metas, img.meta)
+	}
+	sortImageMetas(metas)
+	return metas, nil
+}
+
+// FileStorage is a Storage that keeps images in a directory on the local filesystem.
+// Each image is stored in a file named after its ID, next to a JSON file holding its
+// metadata. Files are written atomically so readers never observe partial images.
+type FileStorage struct {
+	dir string
+}
+
+// metaSuffix is the file name suffix of metadata files
+const metaSuffix = ".json"
+
+// NewFileStorage returns a FileStorage that keeps images in dir, creating it if needed.
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStorage{dir: dir}, nil
+}
+
+// Put stores data under meta.ID. It implements Storage.
+func (s *FileStorage) Put(ctx context.Context, meta ImageMeta, data []byte) error {
+	if !validImageID(meta.ID) {
+		return ErrInvalidKey
+	}
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	// The image is written before its metadata, which marks it as present.
+	if err := writeFileAtomic(filepath.Join(s.dir, meta.ID), data); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, meta.ID+metaSuffix), encoded)
+}
+
+// Get returns the image stored under id. It implements Storage.
+func (s *FileStorage) Get(ctx context.Context, id string) ([]byte, ImageMeta, error) {
+	if !validImageID(id) {
+		return nil, ImageMeta{}, ErrNotFound
+	}
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return nil, ImageMeta{}, err
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, id))
+	if os.IsNotExist(err) {
+		return nil, ImageMeta{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, ImageMeta{}, err
+	}
+	return data, meta, nil
+}
+
+// Stat returns the metadata of the image stored under id. It implements Storage.
+func (s *FileStorage) Stat(ctx context.Context, id string) (ImageMeta, error) {
+	if !validImageID(id) {
+		return ImageMeta{}, ErrNotFound
+	}
+	return s.readMeta(id)
+}
+
+// Delete removes the image stored under id. It implements Storage.
+func (s *FileStorage) Delete(ctx context.Context, id string) error {
+	if !validImageID(id) {
+		return ErrNotFound
+	}
+	err := os.Remove(filepath.Join(s.dir, id+metaSuffix))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.dir, id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns the metadata of all stored images. It implements Storage.
+func (s *FileStorage) List(ctx context.Context) ([]ImageMeta, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	metas := []ImageMeta{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), metaSuffix)
+		if !ok || !validImageID(id) {
+			continue
+		}
+		meta, err := s.readMeta(id)
+		if err == ErrNotFound {
+			// Deleted while listing
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+	sortImageMetas(metas)
+	return metas, nil
+}
+
+func (s *FileStorage) readMeta(id string) (ImageMeta, error) {
+	encoded, err := os.ReadFile(filepath.Join(s.dir, id+metaSuffix))
+	if os.IsNotExist(err) {
+		return ImageMeta{}, ErrNotFound
+	}
+	if err != nil {
+		return ImageMeta{}, err
+	}
+	var meta ImageMeta
+	err = json.Unmarshal(encoded, &meta)
+	return meta, err
+}
+
+// writeFileAtomic writes data to a temporary file in the directory of name and
+// renames it into place.
+func writeFileAtomic(name string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// validImageID reports whether id is a well-formed content-addressed image ID.
+func validImageID(id string) bool {
+	return len(id) == 64 && isLowerHex(id)
+}
+
+// isLowerHex reports whether s consists only of lowercase hexadecimal digits.
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func sortImageMetas(metas []ImageMeta) {
+	sort.Slice(metas, func(i, j int) bool {
+		if !metas[i].Created.Equal(metas[j].Created) {
+			return metas[i].Created.Before(metas[j].Created)
+		}
+		return metas[i].ID < metas[j].ID
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorage(t *testing.T) {
+	fileStorage, err := NewFileStorage(t.TempDir())
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		storage Storage
+	}{
+		{name: "Memory storage", storage: NewMemoryStorage()},
+		{name: "File storage", storage: fileStorage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			first := ImageMeta{ID: strings.Repeat("a", 64), Format: "png", Width: 10, Height: 20, Size: 5, Created: time.Unix(100, 0).UTC()}
+			second := ImageMeta{ID: strings.Repeat("b", 64), Format: "jpeg", Width: 30, Height: 40, Size: 6, Created: time.Unix(50, 0).UTC()}
+
+			_, _, err := tt.storage.Get(ctx, first.ID)
+			assert.Equal(t, ErrNotFound, err)
+
+			assert.NoError(t, tt.storage.Put(ctx, first, []byte("first")))
+			assert.NoError(t, tt.storage.Put(ctx, second, []byte("second")))
+
+			data, meta, err := tt.storage.Get(ctx, first.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, "first", string(data))
+			assert.Equal(t, first, meta)
+
+			metas, err := tt.storage.List(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, []ImageMeta{second, first}, metas)
+
+			assert.NoError(t, tt.storage.Delete(ctx, first.ID))
+			assert.Equal(t, ErrNotFound, tt.storage.Delete(ctx, first.ID))
+
+			_, _, err = tt.storage.Get(ctx, first.ID)
+			assert.Equal(t, ErrNotFound, err)
+
+			metas, err = tt.storage.List(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, []ImageMeta{second}, metas)
+		})
+	}
+}
+
+func TestFileStorageInvalidID(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	assert.NoError(t, err)
+
+	err = storage.Put(context.Background(), ImageMeta{ID: "../escape"}, []byte("data"))
+	assert.Equal(t, ErrInvalidKey, err)
+
+	_, _, err = storage.Get(context.Background(), "../escape")
+	assert.Equal(t, ErrNotFound, err)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gobolditalic"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// defaultFont is the font text is drawn in when no font is given
+	defaultFont = "regular"
+	// defaultTextSize is the size of text in pixels when no size is given
+	defaultTextSize = 24
+	// maxTextSize is the largest text size in pixels
+	maxTextSize = 1000
+	// maxStrokeWidth is the widest text outline in pixels
+	maxStrokeWidth = 20
+	// maxTextLength is the largest number of characters of text
+	maxTextLength = 1000
+	// defaultTextGravity is where text is placed when no gravity is given
+	defaultTextGravity = "center"
+)
+
+const (
+	// textAlignLeft aligns lines at their left edges
+	textAlignLeft = "left"
+	// textAlignCenter centers lines
+	textAlignCenter = "center"
+	// textAlignRight aligns lines at their right edges
+	textAlignRight = "right"
+)
+
+// bundledFonts are the Go fonts, which are always available by name.
+var bundledFonts = mustParseFonts(map[string][]byte{
+	"regular":    goregular.TTF,
+	"bold":       gobold.TTF,
+	"italic":     goitalic.TTF,
+	"bolditalic": gobolditalic.TTF,
+	"mono":       gomono.TTF,
+	"monobold":   gomonobold.TTF,
+})
+
+// Fonts maps font names to parsed fonts.
+type Fonts map[string]*opentype.Font
+
+// mustParseFonts parses the fonts in data and panics if one is invalid.
+func mustParseFonts(data map[string][]byte) Fonts {
+	fonts := make(Fonts, len(data))
+	for name, src := range data {
+		f, err := opentype.Parse(src)
+		if err != nil {
+			panic(fmt.Sprintf("font %s: %v", name, err))
+		}
+		fonts[name] = f
+	}
+	return fonts
+}
+
+// LoadFonts parses the TrueType and OpenType fonts in dir. Each font is named after
+// its file name, in lower case and without its extension.
+func LoadFonts(dir string) (Fonts, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	fonts := Fonts{}
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".ttf" && ext != ".otf") {
+			continue
+		}
+		src, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		f, err := opentype.Parse(src)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		fonts[strings.ToLower(strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())))] = f
+	}
+	return fonts, nil
+}
+
+type fontsContextKey struct{}
+
+// WithFonts returns an http.Handler that makes fonts available to the handlers of
+// next, in addition to the bundled fonts, which they replace if their names clash.
+func WithFonts(fonts Fonts, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), fontsContextKey{}, fonts)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestFont returns the font named name, looking in the fonts configured with
+// WithFonts before the bundled fonts.
+func requestFont(r *http.Request, name string) (*opentype.Font, bool) {
+	if fonts, ok := r.Context().Value(fontsContextKey{}).(Fonts); ok {
+		if f, ok := fonts[name]; ok {
+			return f, true
+		}
+	}
+	f, ok := bundledFonts[name]
+	return f, ok
+}
+
+// Text describes text drawn over processed images.
+type Text struct {
+	// Text is the text to draw; line breaks start new lines
+	Text string
+	// Font is the font to draw in; nil selects the bundled regular font
+	Font *opentype.Font
+	// Size is the size of the font in pixels; zero selects 24
+	Size float64
+	// Color is the color of the text; nil selects black
+	Color color.Color
+	// Stroke is the width in pixels of the outline drawn around the text; zero draws none
+	Stroke int
+	// StrokeColor is the color of the outline; nil selects white
+	StrokeColor color.Color
+	// Align aligns the lines with each other: "left", "center" or "right"
+	Align string
+	// Width is the width of the box lines are wrapped within; zero wraps them at the
+	// width of the image
+	Width int
+	// Gravity names the position of the text, such as "south"; empty selects "center"
+	Gravity string
+	// Offset moves the text away from the edges it sticks to, or right and down when centered
+	Offset image.Point
+}
+
+// parseText parses the text drawn over the image requested by r from the query
+// parameters prefixed with "text_".
+func parseText(r *http.Request, text string) (Text, error) {
+	if utf8.RuneCountInString(text) > maxTextLength {
+		return Text{}, fmt.Errorf("invalid text: longer than %d characters", maxTextLength)
+	}
+	params := r.URL.Query()
+	gravity, offset, err := parsePlacement(params, "text_")
+	if err != nil {
+		return Text{}, err
+	}
+	t := Text{Text: text, Gravity: gravity, Offset: offset, Align: params.Get("text_align")}
+
+	name := params.Get("text_font")
+	if name == "" {
+		name = defaultFont
+	}
+	var ok bool
+	if t.Font, ok = requestFont(r, name); !ok {
+		return Text{}, fmt.Errorf("invalid text_font: %s", name)
+	}
+	if value := params.Get("text_size"); value != "" {
+		t.Size, err = strconv.ParseFloat(value, 64)
+		if err != nil || !(t.Size >= 1 && t.Size <= maxTextSize) {
+			return Text{}, fmt.Errorf("invalid text_size: %s", value)
+		}
+	}
+	if value := params.Get("text_color"); value != "" {
+		if t.Color, err = ParseColor(value); err != nil {
+			return Text{}, fmt.Errorf("invalid text_color: %s", value)
+		}
+	}
+	if value := params.Get("text_stroke"); value != "" {
+		t.Stroke, err = strconv.Atoi(value)
+		if err != nil || t.Stroke < 0 || t.Stroke > maxStrokeWidth {
+			return Text{}, fmt.Errorf("invalid text_stroke: %s", value)
+		}
+	}
+	if value := params.Get("text_stroke_color"); value != "" {
+		if t.StrokeColor, err = ParseColor(value); err != nil {
+			return Text{}, fmt.Errorf("invalid text_stroke_color: %s", value)
+		}
+	}
+	switch t.Align {
+	case "", textAlignLeft, textAlignCenter, textAlignRight:
+	default:
+		return Text{}, fmt.Errorf("invalid text_align: %s", t.Align)
+	}
+	if value := params.Get("text_width"); value != "" {
+		if t.Width, err = dimensionParam(value); err != nil {
+			return Text{}, fmt.Errorf("invalid text_width: %s", value)
+		}
+	}
+	return t, nil
+}
+
+// wrapText splits text into lines no wider than width when drawn in face. Words
+// wider than width are put on lines of their own.
+func wrapText(face font.Face, text string, width int) []string {
+	limit := fixed.I(width)
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			if line != "" && font.MeasureString(face, candidate) > limit {
+				lines = append(lines, line)
+				candidate = word
+			}
+			line = candidate
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// DrawText returns a copy of img with the text of t drawn over it. Lines are wrapped
+// within the box of t, aligned with each other, and the block they form is placed at
+// the gravity of t.
+func DrawText(img image.Image, t Text) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+
+	f := t.Font
+	if f == nil {
+		f = bundledFonts[defaultFont]
+	}
+	size := t.Size
+	if size == 0 {
+		size = defaultTextSize
+	}
+	// NewFace does not fail for parsed fonts
+	face, _ := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	defer face.Close()
+	fill, stroke := t.Color, t.StrokeColor
+	if fill == nil {
+		fill = color.Black
+	}
+	if stroke == nil {
+		stroke = color.White
+	}
+
+	width := t.Width
+	if width == 0 {
+		width = bounds.Dx()
+	}
+	lines := wrapText(face, t.Text, width)
+	widths := make([]int, len(lines))
+	block := image.Point{}
+	for i, line := range lines {
+		widths[i] = font.MeasureString(face, line).Ceil()
+		block.X = max(block.X, widths[i])
+	}
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	block.Y = len(lines) * lineHeight
+	block = block.Add(image.Pt(2*t.Stroke, 2*t.Stroke))
+
+	gravity := t.Gravity
+	if gravity == "" {
+		gravity = defaultTextGravity
+	}
+	pos := Position(bounds, block, gravity, t.Offset).Add(image.Pt(t.Stroke, t.Stroke))
+
+	// Rasterize the lines into a mask, leaving room for the outline and for glyphs that
+	// reach beyond their advances
+	rect := image.Rectangle{pos, pos.Add(block)}.Sub(image.Pt(t.Stroke, t.Stroke)).Inset(-lineHeight).Intersect(bounds)
+	mask := image.NewAlpha(rect)
+	d := font.Drawer{Dst: mask, Src: image.Opaque, Face: face}
+	for i, line := range lines {
+		x := pos.X
+		switch t.Align {
+		case textAlignCenter:
+			x += (block.X - 2*t.Stroke - widths[i]) / 2
+		case textAlignRight:
+			x += block.X - 2*t.Stroke - widths[i]
+		}
+		d.Dot = fixed.P(x, pos.Y+i*lineHeight).Add(fixed.Point26_6{Y: metrics.Ascent})
+		d.DrawString(line)
+	}
+
+	// The outline is the mask grown by the stroke width, under the text
+	if t.Stroke > 0 {
+		draw.DrawMask(dst, rect, image.NewUniform(stroke), image.Point{}, dilate(mask, t.Stroke), rect.Min, draw.Over)
+	}
+	draw.DrawMask(dst, rect, image.NewUniform(fill), image.Point{}, mask, rect.Min, draw.Over)
+	return dst
+}
+
+// dilate returns mask grown by a disk of the given radius: every pixel takes the
+// largest alpha within radius of it. The disk is covered row by row with a horizontal
+// maximum that is widened by a pixel at a time, so the cost grows linearly with radius.
+func dilate(mask *image.Alpha, radius int) *image.Alpha {
+	// rows[w] holds the offsets of the rows of the disk that are 2w+1 pixels wide
+	rows := make([][]int, radius+1)
+	for dy := -radius; dy <= radius; dy++ {
+		w := int(math.Sqrt(float64(radius*radius - dy*dy)))
+		rows[w] = append(rows[w], dy)
+	}
+
+	bounds := mask.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	out := image.NewAlpha(bounds)
+	wide, next := image.NewAlpha(bounds), image.NewAlpha(bounds)
+	for y := 0; y < height; y++ {
+		copy(wide.Pix[y*width:(y+1)*width], mask.Pix[mask.PixOffset(bounds.Min.X, bounds.Min.Y+y):])
+	}
+	for w := 0; w <= radius; w++ {
+		if w > 0 {
+			for y := 0; y < height; y++ {
+				src, dst := wide.Pix[y*width:(y+1)*width], next.Pix[y*width:(y+1)*width]
+				for x := range src {
+					v := src[x]
+					if x > 0 {
+						v = max(v, src[x-1])
+					}
+					if x+1 < width {
+						v = max(v, src[x+1])
+					}
+					dst[x] = v
+				}
+			}
+			wide, next = next, wide
+		}
+		for _, dy := range rows[w] {
+			for y := max(0, -dy); y < min(height, height-dy); y++ {
+				src, dst := wide.Pix[(y+dy)*width:(y+dy+1)*width], out.Pix[y*width:(y+1)*width]
+				for x, v := range src {
+					dst[x] = max(dst[x], v)
+				}
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+)
+
+// inkBounds returns the bounds of the pixels of img that are not white.
+func inkBounds(img *image.RGBA) image.Rectangle {
+	var ink image.Rectangle
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			if img.RGBAAt(x, y) != (color.RGBA{255, 255, 255, 255}) {
+				ink = ink.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return ink
+}
+
+// countColor returns the number of pixels of img that are exactly c.
+func countColor(img *image.RGBA, c color.RGBA) int {
+	n := 0
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			if img.RGBAAt(x, y) == c {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestWrapText(t *testing.T) {
+	face, _ := opentype.NewFace(bundledFonts[defaultFont], &opentype.FaceOptions{Size: 20, DPI: 72})
+	wordWidth := font.MeasureString(face, "price").Ceil()
+	lineWidth := font.MeasureString(face, "price tag").Ceil()
+
+	tests := []struct {
+		name     string
+		text     string
+		width    int
+		expected []string
+	}{
+		{name: "Fits", text: "price tag", width: lineWidth, expected: []string{"price tag"}},
+		{name: "Wraps", text: "price tag", width: lineWidth - 1, expected: []string{"price", "tag"}},
+		{name: "Long word", text: "price", width: wordWidth / 2, expected: []string{"price"}},
+		{name: "Collapses spaces", text: "  price   tag ", width: 1000, expected: []string{"price tag"}},
+		{name: "Line breaks", text: "price\ntag", width: 1000, expected: []string{"price", "tag"}},
+		{name: "Empty line", text: "price\n\ntag", width: 1000, expected: []string{"price", "", "tag"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, wrapText(face, tt.text, tt.width))
+		})
+	}
+}
+
+func TestDrawText(t *testing.T) {
+	white := color.RGBA{255, 255, 255, 255}
+	base := solidImage(300, 150, white)
+
+	tests := []struct {
+		name  string
+		text  Text
+		check func(t *testing.T, ink image.Rectangle, out *image.RGBA)
+	}{
+		{
+			name: "Centered by default",
+			text: Text{Text: "Sale"},
+			check: func(t *testing.T, ink image.Rectangle, out *image.RGBA) {
+				assert.InDelta(t, 150, (ink.Min.X+ink.Max.X)/2, 4)
+				assert.InDelta(t, 75, (ink.Min.Y+ink.Max.Y)/2, 8)
+				assert.Less(t, ink.Dy(), 30)
+				assert.Greater(t, countColor(out, color.RGBA{0, 0, 0, 255}), 0)
+			},
+		},
+		{
+			name: "Gravity and offset",
+			text: Text{Text: "Sale", Gravity: "northwest", Offset: image.Pt(10, 20)},
+			check: func(t *testing.T, ink image.Rectangle, out *image.RGBA) {
+				assert.InDelta(t, 10, ink.Min.X, 3)
+				assert.GreaterOrEqual(t, ink.Min.Y, 20)
+				assert.Less(t, ink.Min.Y, 30)
+			},
+		},
+		{
+			name: "Southeast",
+			text: Text{Text: "Sale", Gravity: "southeast"},
+			check: func(t *testing.T, ink image.Rectangle, out *image.RGBA) {
+				assert.InDelta(t, 300, ink.Max.X, 3)
+				assert.Greater(t, ink.Max.Y, 135)
+			},
+		},
+		{
+			name: "Size",
+			text: Text{Text: "Sale", Size: 72},
+			check: func(t *testing.T, ink image.Rectangle, out *image.RGBA) {
+				assert.Greater(t, ink.Dy(), 45)
+			},
+		},
+		{
+			name: "Color",
+			text: Text{Text: "Sale", Size: 48, Color: color.NRGBA{255, 0, 0, 255}},
+			check: func(t *testing.T, ink image.Rectangle, out *image.RGBA) {
+				assert.Greater(t, countColor(out, color.RGBA{255, 0, 0, 255}), 0)
+				assert.Equal(t, 0, countColor(out, color.RGBA{0, 0, 0, 255}))
+			},
+		},
+		{
+			name: "Stroke",
+			text: Text{Text: "Sale", Size: 48, Stroke: 3, StrokeColor: color.NRGBA{0, 0, 255, 255}},
+			check: func(t *testing.T, ink image.Rectangle, out *image.RGBA) {
+				assert.Greater(t, countColor(out, color.RGBA{0, 0, 255, 255}), 0)
+				assert.Greater(t, countColor(out, color.RGBA{0, 0, 0, 255}), 0)
+			},
+		},
+		{
+			name: "Wrapped within the image",
+			text: Text{Text: "a very long caption that cannot fit on a single line of the image", Gravity: "north"},
+			check: func(t *testing.T, ink image.Rectangle, out *image.RGBA) {
+				assert.LessOrEqual(t, ink.Dx(), 300)
+				assert.Greater(t, ink.Dy(), 40)
+			},
+		},
+		{
+			name: "Wrapped within a box",
+			text: Text{Text: "price tag here", Width: 60},
+			check: func(t *testing.T, ink image.Rectangle, out *image.RGBA) {
+				assert.LessOrEqual(t, ink.Dx(), 60)
+				assert.Greater(t, ink.Dy(), 60)
+			},
+		},
+		{
+			name: "Bold font",
+			text: Text{Text: "Sale", Font: mustParseFonts(map[string][]byte{"bold": gobold.TTF})["bold"]},
+			check: func(t *testing.T, ink image.Rectangle, out *image.RGBA) {
+				assert.False(t, ink.Empty())
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := DrawText(base, tt.text)
+			assert.Equal(t, base.Bounds(), out.Bounds())
+			tt.check(t, inkBounds(out), out)
+		})
+	}
+
+	// The source image is left untouched
+	assert.True(t, inkBounds(base).Empty())
+}
+
+func TestDrawTextAlign(t *testing.T) {
+	base := solidImage(300, 150, color.RGBA{255, 255, 255, 255})
+	text := "wide first line\nshort"
+
+	lastLine := func(align string) image.Rectangle {
+		out := DrawText(base, Text{Text: text, Align: align, Gravity: "northwest"})
+		// The second line lies below the first line, which is 24 pixels high
+		return inkBounds(out.SubImage(image.Rect(0, 30, 300, 150)).(*image.RGBA))
+	}
+	left, center, right := lastLine(textAlignLeft), lastLine(textAlignCenter), lastLine(textAlignRight)
+	first := inkBounds(DrawText(base, Text{Text: text, Gravity: "northwest"}))
+
+	assert.InDelta(t, first.Min.X, left.Min.X, 2)
+	assert.InDelta(t, first.Max.X, right.Max.X, 2)
+	assert.InDelta(t, (first.Min.X+first.Max.X)/2, (center.Min.X+center.Max.X)/2, 3)
+	assert.Less(t, left.Min.X, center.Min.X)
+	assert.Less(t, center.Min.X, right.Min.X)
+}
+
+func TestDilate(t *testing.T) {
+	mask := image.NewAlpha(image.Rect(3, 4, 40, 30))
+	mask.SetAlpha(10, 10, color.Alpha{255})
+	mask.SetAlpha(30, 12, color.Alpha{100})
+	mask.SetAlpha(4, 29, color.Alpha{200})
+
+	for _, radius := range []int{0, 1, 3, 7} {
+		out := dilate(mask, radius)
+		assert.Equal(t, mask.Bounds(), out.Bounds())
+		// Compare with the largest alpha within radius of every pixel
+		for y := mask.Rect.Min.Y; y < mask.Rect.Max.Y; y++ {
+			for x := mask.Rect.Min.X; x < mask.Rect.Max.X; x++ {
+				var expected uint8
+				for dy := -radius; dy <= radius; dy++ {
+					for dx := -radius; dx <= radius; dx++ {
+						if dx*dx+dy*dy <= radius*radius && image.Pt(x+dx, y+dy).In(mask.Rect) {
+							expected = max(expected, mask.AlphaAt(x+dx, y+dy).A)
+						}
+					}
+				}
+				if !assert.Equal(t, expected, out.AlphaAt(x, y).A, "radius %d, pixel (%d,%d)", radius, x, y) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func TestLoadFonts(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "Brand.TTF"), gobold.TTF, 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "readme.txt"), []byte("fonts"), 0o644))
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "extra.ttf"), 0o755))
+
+	fonts, err := LoadFonts(dir)
+	assert.NoError(t, err)
+	assert.Len(t, fonts, 1)
+	assert.NotNil(t, fonts["brand"])
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "broken.otf"), []byte("not a font"), 0o644))
+	_, err = LoadFonts(dir)
+	assert.Error(t, err)
+
+	_, err = LoadFonts(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestParseOptionsText(t *testing.T) {
+	brand := mustParseFonts(map[string][]byte{"brand": gobold.TTF})
+
+	tests := []struct {
+		name     string
+		query    string
+		err      bool
+		expected *Text
+	}{
+		{name: "No text", query: "text_size=30"},
+		{
+			name:     "Defaults",
+			query:    "text=Sale",
+			expected: &Text{Text: "Sale", Font: bundledFonts[defaultFont]},
+		},
+		{
+			name: "All parameters",
+			query: "text=Only+%249.99&text_font=mono&text_size=36&text_color=ff0000&text_stroke=2&text_stroke_color=000" +
+				"&text_align=right&text_width=120&text_gravity=south&text_offset=0,10",
+			expected: &Text{
+				Text: "Only $9.99", Font: bundledFonts["mono"], Size: 36, Color: color.NRGBA{255, 0, 0, 255},
+				Stroke: 2, StrokeColor: color.NRGBA{0, 0, 0, 255}, Align: "right", Width: 120,
+				Gravity: "south", Offset: image.Pt(0, 10),
+			},
+		},
+		{
+			name:     "Configured font",
+			query:    "text=Sale&text_font=brand",
+			expected: &Text{Text: "Sale", Font: brand["brand"]},
+		},
+		{name: "Unknown font", query: "text=Sale&text_font=comic", err: true},
+		{name: "Zero size", query: "text=Sale&text_size=0", err: true},
+		{name: "Huge size", query: "text=Sale&text_size=5000", err: true},
+		{name: "Invalid color", query: "text=Sale&text_color=red", err: true},
+		{name: "Negative stroke", query: "text=Sale&text_stroke=-1", err: true},
+		{name: "Wide stroke", query: "text=Sale&text_stroke=50", err: true},
+		{name: "Invalid stroke color", query: "text=Sale&text_stroke_color=blue", err: true},
+		{name: "Invalid align", query: "text=Sale&text_align=justify", err: true},
+		{name: "Invalid width", query: "text=Sale&text_width=0", err: true},
+		{name: "Invalid gravity", query: "text=Sale&text_gravity=top", err: true},
+		{name: "Invalid offset", query: "text=Sale&text_offset=1", err: true},
+		{name: "Text too long", query: "text=" + strings.Repeat("a", maxTextLength+1), err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/resize?"+tt.query, nil)
+			req = req.WithContext(context.WithValue(req.Context(), fontsContextKey{}, brand))
+			opts, err := ParseOptions(req)
+			assert.Equal(t, tt.err, err != nil)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, tt.expected, newOptions(opts).Text)
+		})
+	}
+}
+
+func TestHandleConvertText(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, solidImage(200, 100, color.RGBA{255, 255, 255, 255})))
+
+	req := httptest.NewRequest(http.MethodPost, "/convert?format=png&text=Sale&text_color=ff0000", bytes.NewReader(buf.Bytes()))
+	rr := httptest.NewRecorder()
+	handler := Handler(HandleConvert)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	img, err := png.Decode(rr.Body)
+	assert.NoError(t, err)
+	assert.Greater(t, countColor(toRGBA(img), color.RGBA{255, 0, 0, 255}), 0)
+}
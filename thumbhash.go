@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/base64"
+	"image"
+	"image/color"
+	"math"
+)
+
+// maxThumbHashSize is the largest width and height of the image a ThumbHash is computed from
+const maxThumbHashSize = 100
+
+// ThumbHash returns the ThumbHash of img encoded in base64. The number of components
+// is fixed by the format and depends on the aspect ratio of img and whether it has
+// transparency. Images larger than 100x100 must be scaled down first.
+func ThumbHash(img image.Image) string {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	// Determine the average color
+	rgba := make([]color.NRGBA, 0, w*h)
+	avgR, avgG, avgB, avgA := 0.0, 0.0, 0.0, 0.0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			alpha := float64(c.A) / 255
+			avgR += alpha / 255 * float64(c.R)
+			avgG += alpha / 255 * float64(c.G)
+			avgB += alpha / 255 * float64(c.B)
+			avgA += alpha
+			rgba = append(rgba, c)
+		}
+	}
+	if avgA > 0 {
+		avgR /= avgA
+		avgG /= avgA
+		avgB /= avgA
+	}
+
+	hasAlpha := avgA < float64(w*h)
+	limit := 7
+	if hasAlpha {
+		// Use fewer luminance bits if there's alpha
+		limit = 5
+	}
+	lx := max(1, int(roundHalfUp(float64(limit*w)/float64(max(w, h)))))
+	ly := max(1, int(roundHalfUp(float64(limit*h)/float64(max(w, h)))))
+
+	// Convert the image from RGBA to LPQA, composited atop the average color
+	l, p, q, a := make([]float64, w*h), make([]float64, w*h), make([]float64, w*h), make([]float64, w*h)
+	for i, c := range rgba {
+		alpha := float64(c.A) / 255
+		r := avgR*(1-alpha) + alpha/255*float64(c.R)
+		g := avgG*(1-alpha) + alpha/255*float64(c.G)
+		b := avgB*(1-alpha) + alpha/255*float64(c.B)
+		l[i] = (r + g + b) / 3
+		p[i] = (r+g)/2 - b
+		q[i] = r - g
+		a[i] = alpha
+	}
+
+	// Encode using the DCT into DC (constant) and normalized AC (varying) terms
+	encodeChannel := func(channel []float64, nx, ny int) (dc float64, ac []float64, scale float64) {
+		fx := make([]float64, w)
+		for cy := 0; cy < ny; cy++ {
+			for cx := 0; cx*ny < nx*(ny-cy); cx++ {
+				f := 0.0
+				for x := 0; x < w; x++ {
+					fx[x] = math.Cos(math.Pi / float64(w) * float64(cx) * (float64(x) + 0.5))
+				}
+				for y := 0; y < h; y++ {
+					fy := math.Cos(math.Pi / float64(h) * float64(cy) * (float64(y) + 0.5))
+					for x := 0; x < w; x++ {
+						f += channel[x+y*w] * fx[x] * fy
+					}
+				}
+				f /= float64(w * h)
+				if cx > 0 || cy > 0 {
+					ac = append(ac, f)
+					scale = max(scale, math.Abs(f))
+				} else {
+					dc = f
+				}
+			}
+		}
+		if scale > 0 {
+			for i := range ac {
+				ac[i] = 0.5 + 0.5/scale*ac[i]
+			}
+		}
+		return dc, ac, scale
+	}
+	lDC, lAC, lScale := encodeChannel(l, max(3, lx), max(3, ly))
+	pDC, pAC, pScale := encodeChannel(p, 3, 3)
+	qDC, qAC, qScale := encodeChannel(q, 3, 3)
+
+	// Write the constants
+	isLandscape := w > h
+	header24 := int(roundHalfUp(63*lDC)) | int(roundHalfUp(31.5+31.5*pDC))<<6 | int(roundHalfUp(31.5+31.5*qDC))<<12 | int(roundHalfUp(31*lScale))<<18
+	header16 := int(roundHalfUp(63*pScale))<<3 | int(roundHalfUp(63*qScale))<<9
+	if hasAlpha {
+		header24 |= 1 << 23
+	}
+	if isLandscape {
+		header16 |= ly | 1<<15
+	} else {
+		header16 |= lx
+	}
+	hash := []byte{byte(header24), byte(header24 >> 8), byte(header24 >> 16), byte(header16), byte(header16 >> 8)}
+	channels := [][]float64{lAC, pAC, qAC}
+	if hasAlpha {
+		aDC, aAC, aScale := encodeChannel(a, 5, 5)
+		hash = append(hash, byte(int(roundHalfUp(15*aDC))|int(roundHalfUp(15*aScale))<<4))
+		channels = append(channels, aAC)
+	}
+
+	// Write the varying factors
+	start, index := len(hash), 0
+	for _, ac := range channels {
+		for _, f := range ac {
+			if start+index>>1 == len(hash) {
+				hash = append(hash, 0)
+			}
+			hash[start+index>>1] |= byte(int(roundHalfUp(15*f)) << ((index & 1) << 2))
+			index++
+		}
+	}
+	return base64.StdEncoding.EncodeToString(hash)
+}
+
+// DecodeThumbHash renders the base64 encoded ThumbHash as an image of at most 32x32
+// pixels with the aspect ratio of the original image. It returns ErrInvalidHash if
+// hash is malformed.
+func DecodeThumbHash(encoded string) (*image.NRGBA, error) {
+	hash, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		if hash, err = base64.RawStdEncoding.DecodeString(encoded); err != nil {
+			return nil, ErrInvalidHash
+		}
+	}
+	if len(hash) < 5 {
+		return nil, ErrInvalidHash
+	}
+
+	// Read the constants
+	header24 := int(hash[0]) | int(hash[1])<<8 | int(hash[2])<<16
+	header16 := int(hash[3]) | int(hash[4])<<8
+	lDC := float64(header24&63) / 63
+	pDC := float64(header24>>6&63)/31.5 - 1
+	qDC := float64(header24>>12&63)/31.5 - 1
+	lScale := float64(header24>>18&31) / 31
+	hasAlpha := header24>>23 != 0
+	pScale := float64(header16>>3&63) / 63
+	qScale := float64(header16>>9&63) / 63
+	isLandscape := header16>>15 != 0
+	limit := 7
+	if hasAlpha {
+		limit = 5
+	}
+	lx, ly := max(3, header16&7), max(3, limit)
+	if isLandscape {
+		lx, ly = max(3, limit), max(3, header16&7)
+	}
+	aDC, aScale := 1.0, 0.0
+	start := 5
+	if hasAlpha {
+		if len(hash) < 6 {
+			return nil, ErrInvalidHash
+		}
+		aDC, aScale = float64(hash[5]&15)/15, float64(hash[5]>>4)/15
+		start = 6
+	}
+
+	// Read the varying factors, boosting saturation by 1.25x to compensate for quantization
+	index := 0
+	decodeChannel := func(nx, ny int, scale float64) ([]float64, error) {
+		var ac []float64
+		for cy := 0; cy < ny; cy++ {
+			for cx := firstAC(cy); cx*ny < nx*(ny-cy); cx++ {
+				i := start + index>>1
+				if i >= len(hash) {
+					return nil, ErrInvalidHash
+				}
+				ac = append(ac, (float64(hash[i]>>((index&1)<<2)&15)/7.5-1)*scale)
+				index++
+			}
+		}
+		return ac, nil
+	}
+	lAC, err := decodeChannel(lx, ly, lScale)
+	if err != nil {
+		return nil, err
+	}
+	pAC, err := decodeChannel(3, 3, pScale*1.25)
+	if err != nil {
+		return nil, err
+	}
+	qAC, err := decodeChannel(3, 3, qScale*1.25)
+	if err != nil {
+		return nil, err
+	}
+	var aAC []float64
+	if hasAlpha {
+		if aAC, err = decodeChannel(5, 5, aScale); err != nil {
+			return nil, err
+		}
+	}
+
+	// Decode using the DCT into RGB
+	ratio := thumbHashAspectRatio(hash)
+	w, h := int(roundHalfUp(32*ratio)), 32
+	if ratio > 1 {
+		w, h = 32, int(roundHalfUp(32/ratio))
+	}
+	if w == 0 || h == 0 {
+		// Encoders never write a zero component count for the shorter side
+		return nil, ErrInvalidHash
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	n := 3
+	if hasAlpha {
+		n = 5
+	}
+	fx, fy := make([]float64, max(lx, n)), make([]float64, max(ly, n))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			l, p, q, a := lDC, pDC, qDC, aDC
+
+			// Precompute the coefficients
+			for cx := range fx {
+				fx[cx] = math.Cos(math.Pi / float64(w) * (float64(x) + 0.5) * float64(cx))
+			}
+			for cy := range fy {
+				fy[cy] = math.Cos(math.Pi / float64(h) * (float64(y) + 0.5) * float64(cy))
+			}
+
+			// Decode L
+			j := 0
+			for cy := 0; cy < ly; cy++ {
+				for cx := firstAC(cy); cx*ly < lx*(ly-cy); cx++ {
+					l += lAC[j] * fx[cx] * fy[cy] * 2
+					j++
+				}
+			}
+
+			// Decode P and Q
+			j = 0
+			for cy := 0; cy < 3; cy++ {
+				for cx := firstAC(cy); cx < 3-cy; cx++ {
+					f := fx[cx] * fy[cy] * 2
+					p += pAC[j] * f
+					q += qAC[j] * f
+					j++
+				}
+			}
+
+			// Decode A
+			if hasAlpha {
+				j = 0
+				for cy := 0; cy < 5; cy++ {
+					for cx := firstAC(cy); cx < 5-cy; cx++ {
+						a += aAC[j] * fx[cx] * fy[cy] * 2
+						j++
+					}
+				}
+			}
+
+			// Convert to RGB
+			b := l - 2.0/3*p
+			r := (3*l - b + q) / 2
+			g := r - q
+			img.SetNRGBA(x, y, color.NRGBA{unitToByte(r), unitToByte(g), unitToByte(b), unitToByte(a)})
+		}
+	}
+	return img, nil
+}
+
+// thumbHashAspectRatio returns the approximate aspect ratio of the image hash was
+// computed from.
+func thumbHashAspectRatio(hash []byte) float64 {
+	hasAlpha := hash[2]&0x80 != 0
+	isLandscape := hash[4]&0x80 != 0
+	limit := 7
+	if hasAlpha {
+		limit = 5
+	}
+	lx, ly := int(hash[3]&7), limit
+	if isLandscape {
+		lx, ly = limit, int(hash[3]&7)
+	}
+	if ly == 0 {
+		return 1
+	}
+	return float64(lx) / float64(ly)
+}
+
+// firstAC returns the first horizontal AC component in row cy; the first component
+// of the first row is the DC term.
+func firstAC(cy int) int {
+	if cy == 0 {
+		return 1
+	}
+	return 0
+}
+
+// roundHalfUp rounds value to the nearest integer, rounding halves up.
+func roundHalfUp(value float64) float64 {
+	return math.Floor(value + 0.5)
+}
+
+// unitToByte converts a value between 0 and 1 to a byte, clamping it to that range.
+func unitToByte(value float64) uint8 {
+	return uint8(max(0, 255*min(1, value)))
+}
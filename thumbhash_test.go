@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// patternImage returns a 37x23 image with varying colors and, unless opaque is set,
+// varying transparency. Hashes of it were checked against the reference implementations.
+func patternImage(opaque bool) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 37, 23))
+	for x := 0; x < 37; x++ {
+		for y := 0; y < 23; y++ {
+			c := color.NRGBA{uint8(x * 7), uint8(y * 11), uint8((x * y) % 256), uint8(255 - (x*y)%90)}
+			if opaque {
+				c.A = 255
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestThumbHashReference(t *testing.T) {
+	assert.Equal(t, "3AiKG5YNYHZwiIbykw/3h97Mv4md58g=", ThumbHash(patternImage(false)))
+	assert.Equal(t, "3AgOHJpgdodwiIiGiIbyow/3hw==", ThumbHash(patternImage(true)))
+}
+
+func TestThumbHash(t *testing.T) {
+	transparent := image.NewRGBA(image.Rect(0, 0, 60, 60))
+	draw.Draw(transparent, image.Rect(15, 15, 45, 45), image.NewUniform(color.RGBA{0, 0, 255, 255}), image.Point{}, draw.Src)
+
+	tests := []struct {
+		name   string
+		img    image.Image
+		bounds image.Rectangle
+		alpha  bool
+		center color.NRGBA
+	}{
+		{name: "Square", img: solidImage(50, 50, color.RGBA{200, 100, 50, 255}), bounds: image.Rect(0, 0, 32, 32), center: color.NRGBA{200, 100, 50, 255}},
+		{name: "Landscape", img: solidImage(100, 50, color.RGBA{20, 160, 90, 255}), bounds: image.Rect(0, 0, 32, 18), center: color.NRGBA{20, 160, 90, 255}},
+		{name: "Portrait", img: solidImage(25, 100, color.RGBA{240, 240, 240, 255}), bounds: image.Rect(0, 0, 9, 32), center: color.NRGBA{240, 240, 240, 255}},
+		{name: "Transparent", img: transparent, bounds: image.Rect(0, 0, 32, 32), alpha: true, center: color.NRGBA{0, 0, 255, 255}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash := ThumbHash(tt.img)
+			raw, err := base64.StdEncoding.DecodeString(hash)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.alpha, raw[2]&0x80 != 0)
+
+			decoded, err := DecodeThumbHash(hash)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.bounds, decoded.Bounds())
+
+			center := decoded.NRGBAAt(decoded.Bounds().Dx()/2, decoded.Bounds().Dy()/2)
+			assert.InDelta(t, tt.center.R, center.R, 16)
+			assert.InDelta(t, tt.center.G, center.G, 16)
+			assert.InDelta(t, tt.center.B, center.B, 16)
+			assert.InDelta(t, tt.center.A, center.A, 16)
+			if tt.alpha {
+				assert.Less(t, int(decoded.NRGBAAt(0, 0).A), 64)
+			}
+		})
+	}
+}
+
+func TestDecodeThumbHashInvalid(t *testing.T) {
+	valid := ThumbHash(solidImage(10, 10, color.White))
+	raw, _ := base64.StdEncoding.DecodeString(valid)
+
+	// A portrait hash without horizontal components would decode to zero width
+	zeroWidth := bytes.Clone(raw)
+	zeroWidth[3] &^= 7
+
+	for _, invalid := range []string{"", "!!!!", base64.StdEncoding.EncodeToString(raw[:4]), base64.StdEncoding.EncodeToString(raw[:len(raw)-2]), base64.StdEncoding.EncodeToString(zeroWidth)} {
+		_, err := DecodeThumbHash(invalid)
+		assert.Equal(t, ErrInvalidHash, err, invalid)
+	}
+
+	// Unpadded hashes are accepted
+	_, err := DecodeThumbHash(base64.RawStdEncoding.EncodeToString(raw))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"image"
+	"image/color"
+
+	"golang.org/x/image/draw"
+)
+
+// defaultTrimTolerance is the default largest channel difference from the border
+// color of pixels that are trimmed
+const defaultTrimTolerance = 10
+
+// BorderColor returns the most common color among the four corners of img, preferring
+// the top left corner on ties.
+func BorderColor(img image.Image) color.RGBA {
+	bounds := img.Bounds()
+	corners := [4]color.RGBA{}
+	for i, p := range []image.Point{
+		bounds.Min,
+		{bounds.Max.X - 1, bounds.Min.Y},
+		{bounds.Min.X, bounds.Max.Y - 1},
+		bounds.Max.Sub(image.Pt(1, 1)),
+	} {
+		corners[i] = color.RGBAModel.Convert(img.At(p.X, p.Y)).(color.RGBA)
+	}
+
+	best, bestCount := corners[0], 0
+	for _, c := range corners {
+		count := 0
+		for _, other := range corners {
+			if other == c {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = c, count
+		}
+	}
+	return best
+}
+
+// TrimBounds returns the smallest rectangle of img holding every pixel whose
+// premultiplied channels differ from border by more than tolerance. Rows and columns
+// are scanned inwards from each edge up to the first pixel that does not match. If
+// every pixel matches border, it returns the bounds of img.
+func TrimBounds(img image.Image, border color.Color, tolerance int) image.Rectangle {
+	b := color.RGBAModel.Convert(border).(color.RGBA)
+	within := func(v, w uint8) bool {
+		d := int(v) - int(w)
+		return -tolerance <= d && d <= tolerance
+	}
+	at := rgbaAt(img)
+	matches := func(x, y int) bool {
+		c := at(x, y)
+		return within(c.R, b.R) && within(c.G, b.G) && within(c.B, b.B) && within(c.A, b.A)
+	}
+	rowMatches := func(y, x0, x1 int) bool {
+		for x := x0; x < x1; x++ {
+			if !matches(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	columnMatches := func(x, y0, y1 int) bool {
+		for y := y0; y < y1; y++ {
+			if !matches(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+
+	bounds := img.Bounds()
+	top := bounds.Min.Y
+	for top < bounds.Max.Y && rowMatches(top, bounds.Min.X, bounds.Max.X) {
+		top++
+	}
+	if top == bounds.Max.Y {
+		return bounds
+	}
+	// The row at top holds content, so the remaining scans stop before passing it
+	bottom := bounds.Max.Y
+	for rowMatches(bottom-1, bounds.Min.X, bounds.Max.X) {
+		bottom--
+	}
+	left := bounds.Min.X
+	for columnMatches(left, top, bottom) {
+		left++
+	}
+	right := bounds.Max.X
+	for columnMatches(right-1, top, bottom) {
+		right--
+	}
+	return image.Rect(left, top, right, bottom)
+}
+
+// rgbaAt returns a function reading the premultiplied color of the pixels of img,
+// reading the pixel buffers of common image types directly.
+func rgbaAt(img image.Image) func(x, y int) color.RGBA {
+	switch src := img.(type) {
+	case *image.RGBA:
+		return src.RGBAAt
+	case *image.NRGBA:
+		return func(x, y int) color.RGBA {
+			r, g, b, a := src.NRGBAAt(x, y).RGBA()
+			return color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+		}
+	case *image.YCbCr:
+		return func(x, y int) color.RGBA {
+			r, g, b, _ := src.YCbCrAt(x, y).RGBA()
+			return color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 0xff}
+		}
+	case *image.Gray:
+		return func(x, y int) color.RGBA {
+			v := src.GrayAt(x, y).Y
+			return color.RGBA{v, v, v, 0xff}
+		}
+	}
+	return func(x, y int) color.RGBA {
+		return color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+	}
+}
+
+// Trim returns img cropped to the content inside a uniform border of the given color,
+// as found by TrimBounds, and surrounded by padding pixels of the border color. A nil
+// border uses the color of BorderColor. The result shares pixels with img when the
+// padding lies within img.
+func Trim(img image.Image, border color.Color, tolerance, padding int) image.Image {
+	if border == nil {
+		border = BorderColor(img)
+	}
+	bounds := img.Bounds()
+	rect := TrimBounds(img, border, tolerance).Inset(-padding)
+	if rect.In(bounds) {
+		return subImage(img, rect)
+	}
+
+	// The padding extends beyond img, so draw the content onto a border colored canvas
+	padded := image.NewRGBA(image.Rectangle{Max: rect.Size()})
+	draw.Draw(padded, padded.Rect, image.NewUniform(border), image.Point{}, draw.Src)
+	content := rect.Intersect(bounds)
+	draw.Draw(padded, content.Sub(rect.Min), img, content.Min, draw.Src)
+	return padded
+}
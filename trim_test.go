@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// productImage returns a 100x80 white image with a red product at (20, 10)-(60, 50)
+// and slightly off-white noise in the margins.
+func productImage() *image.RGBA {
+	img := solidImage(100, 80, color.RGBA{255, 255, 255, 255})
+	draw.Draw(img, image.Rect(20, 10, 60, 50), image.NewUniform(color.RGBA{200, 0, 0, 255}), image.Point{}, draw.Src)
+	img.SetRGBA(5, 70, color.RGBA{248, 250, 252, 255})
+	img.SetRGBA(90, 3, color.RGBA{250, 250, 250, 255})
+	return img
+}
+
+func TestBorderColor(t *testing.T) {
+	white, black := color.RGBA{255, 255, 255, 255}, color.RGBA{0, 0, 0, 255}
+	img := solidImage(10, 10, white)
+	assert.Equal(t, white, BorderColor(img))
+
+	img.SetRGBA(0, 0, black)
+	assert.Equal(t, white, BorderColor(img))
+
+	// Ties go to the top left corner
+	img.SetRGBA(9, 9, black)
+	assert.Equal(t, black, BorderColor(img))
+}
+
+func TestTrimBounds(t *testing.T) {
+	transparent := image.NewNRGBA(image.Rect(0, 0, 30, 30))
+	for i := 0; i < len(transparent.Pix); i += 4 {
+		// Fully transparent pixels match whatever their color
+		transparent.Pix[i] = uint8(i)
+	}
+	transparent.SetNRGBA(7, 12, color.NRGBA{0, 0, 255, 255})
+
+	gray := image.NewGray(image.Rect(0, 0, 20, 10))
+	for i := range gray.Pix {
+		gray.Pix[i] = 255
+	}
+	gray.SetGray(19, 9, color.Gray{})
+	gray.SetGray(3, 4, color.Gray{})
+
+	ycbcr := image.NewYCbCr(image.Rect(0, 0, 16, 16), image.YCbCrSubsampleRatio444)
+	for i := range ycbcr.Y {
+		ycbcr.Y[i], ycbcr.Cb[i], ycbcr.Cr[i] = 255, 128, 128
+	}
+	ycbcr.Y[ycbcr.YOffset(0, 8)] = 0
+
+	tests := []struct {
+		name      string
+		img       image.Image
+		border    color.Color
+		tolerance int
+		expected  image.Rectangle
+	}{
+		{name: "Tolerance", img: productImage(), border: color.White, tolerance: 10, expected: image.Rect(20, 10, 60, 50)},
+		{name: "Exact", img: productImage(), border: color.White, tolerance: 0, expected: image.Rect(5, 3, 91, 71)},
+		{name: "Other border color", img: productImage(), border: color.RGBA{200, 0, 0, 255}, tolerance: 10, expected: image.Rect(0, 0, 100, 80)},
+		{name: "Transparent border", img: transparent, border: color.Transparent, tolerance: 0, expected: image.Rect(7, 12, 8, 13)},
+		{name: "Content in the corners", img: gray, border: color.White, tolerance: 0, expected: image.Rect(3, 4, 20, 10)},
+		{name: "Sub-image", img: gray.SubImage(image.Rect(2, 2, 10, 8)), border: color.White, tolerance: 0, expected: image.Rect(3, 4, 4, 5)},
+		{name: "YCbCr", img: ycbcr, border: color.White, tolerance: 0, expected: image.Rect(0, 8, 1, 9)},
+		{name: "Uniform image", img: solidImage(10, 5, color.RGBA{1, 2, 3, 255}), border: color.RGBA{1, 2, 3, 255}, tolerance: 0, expected: image.Rect(0, 0, 10, 5)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, TrimBounds(tt.img, tt.border, tt.tolerance))
+		})
+	}
+}
+
+func TestTrim(t *testing.T) {
+	img := productImage()
+
+	trimmed := Trim(img, nil, defaultTrimTolerance, 0)
+	assert.Equal(t, image.Rect(20, 10, 60, 50), trimmed.Bounds())
+
+	// Padding within the image shares its pixels
+	padded := Trim(img, nil, defaultTrimTolerance, 5)
+	assert.IsType(t, &image.RGBA{}, padded)
+	assert.Equal(t, image.Rect(15, 5, 65, 55), padded.Bounds())
+	img.SetRGBA(15, 5, color.RGBA{1, 2, 3, 255})
+	assert.Equal(t, color.RGBA{1, 2, 3, 255}, padded.At(15, 5))
+
+	// Padding beyond the image is filled with the border color
+	padded = Trim(productImage(), color.White, defaultTrimTolerance, 15)
+	assert.Equal(t, image.Rect(0, 0, 70, 70), padded.Bounds())
+	assert.Equal(t, color.RGBA{255, 255, 255, 255}, color.RGBAModel.Convert(padded.At(0, 0)))
+	assert.Equal(t, color.RGBA{200, 0, 0, 255}, color.RGBAModel.Convert(padded.At(15, 15)))
+	assert.Equal(t, color.RGBA{200, 0, 0, 255}, color.RGBAModel.Convert(padded.At(54, 54)))
+	assert.Equal(t, color.RGBA{255, 255, 255, 255}, color.RGBAModel.Convert(padded.At(55, 55)))
+}
+
+func TestHandleThumbnailTrim(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, productImage()))
+	data := buf.Bytes()
+
+	tests := []struct {
+		name  string
+		query string
+		code  int
+		size  image.Point
+	}{
+		{name: "Without trim", query: "width=20", code: http.StatusOK, size: image.Pt(20, 16)},
+		{name: "Trim", query: "width=20&trim=true", code: http.StatusOK, size: image.Pt(20, 20)},
+		{name: "Trim with padding", query: "width=20&trim=true&trim_padding=20&trim_color=fff", code: http.StatusOK, size: image.Pt(20, 20)},
+		{name: "Trim then crop", query: "width=20&trim=true&crop=0,0,50%25,100%25", code: http.StatusOK, size: image.Pt(20, 40)},
+		{name: "Invalid trim", query: "width=20&trim=yes", code: http.StatusBadRequest},
+		{name: "Invalid trim color", query: "width=20&trim=true&trim_color=white", code: http.StatusBadRequest},
+		{name: "Invalid trim tolerance", query: "width=20&trim=true&trim_tolerance=256", code: http.StatusBadRequest},
+		{name: "Invalid trim padding", query: "width=20&trim=true&trim_padding=-1", code: http.StatusBadRequest},
+		{name: "Trim padding too large", query: "width=20&trim=true&trim_padding=2049", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/thumbnail?"+tt.query, bytes.NewReader(data))
+			rr := httptest.NewRecorder()
+			Handler(HandleThumbnail).ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			img, err := png.Decode(rr.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.size, img.Bounds().Size())
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// ErrNoWatermark is returned when a request asks for a watermark but none is configured or uploaded
+var ErrNoWatermark = fmt.Errorf("no watermark configured")
+
+// defaultGravity is where watermarks are placed when no gravity is given
+const defaultGravity = "southeast"
+
+// gravities maps the names of the positions overlays can be placed at to the edges
+// they stick to: -1 for the left or top, 1 for the right or bottom and 0 for the center.
+var gravities = map[string]image.Point{
+	"center":    {0, 0},
+	"north":     {0, -1},
+	"south":     {0, 1},
+	"east":      {1, 0},
+	"west":      {-1, 0},
+	"northeast": {1, -1},
+	"northwest": {-1, -1},
+	"southeast": {1, 1},
+	"southwest": {-1, 1},
+}
+
+// Watermark describes an overlay composited on top of processed images.
+type Watermark struct {
+	// Image is the overlay
+	Image image.Image
+	// Gravity names the position of the overlay, such as "southeast"; empty selects "southeast"
+	Gravity string
+	// Offset moves the overlay away from the edges it sticks to, or right and down when centered
+	Offset image.Point
+	// Scale is the width of the overlay as a fraction of the width of the image; zero
+	// keeps the size of the overlay
+	Scale float64
+	// Opacity is the opacity of the overlay between 0 and 1
+	Opacity float64
+	// Tile repeats the overlay across the whole image, starting from its position
+	Tile bool
+}
+
+// LoadWatermark decodes the overlay image stored in the file name.
+func LoadWatermark(name string) (image.Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return img, nil
+}
+
+// Position returns the top left corner of a rectangle of the given size placed within
+// bounds at the named gravity and moved by offset away from the edges it sticks to.
+func Position(bounds image.Rectangle, size image.Point, gravity string, offset image.Point) image.Point {
+	g := gravities[gravity]
+	align := func(lo, hi, size, edge, offset int) int {
+		switch edge {
+		case -1:
+			return lo + offset
+		case 1:
+			return hi - size - offset
+		default:
+			return lo + (hi-lo-size)/2 + offset
+		}
+	}
+	return image.Pt(
+		align(bounds.Min.X, bounds.Max.X, size.X, g.X, offset.X),
+		align(bounds.Min.Y, bounds.Max.Y, size.Y, g.Y, offset.Y),
+	)
+}
+
+// Composite returns a copy of img with the overlay of wm drawn over it. The copy keeps
+// the color model and bit depth of img, as chosen by newImageLike, except that
+// grayscale images become RGBA to hold the colors of an overlay that is not grayscale.
+func Composite(img image.Image, wm Watermark) image.Image {
+	bounds := img.Bounds()
+	overlay := wm.Image
+	if wm.Scale > 0 {
+		src := overlay.Bounds()
+		width := max(1, int(float64(bounds.Dx())*wm.Scale+0.5))
+		height := max(1, src.Dy()*width/max(1, src.Dx()))
+		overlay = Resample(overlay, width, height)
+	}
+
+	dst := newImageLike(img, bounds)
+	switch overlay.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+	default:
+		switch dst.(type) {
+		case *image.Gray:
+			dst = image.NewRGBA(bounds)
+		case *image.Gray16:
+			dst = image.NewRGBA64(bounds)
+		}
+	}
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+	gravity := wm.Gravity
+	if gravity == "" {
+		gravity = defaultGravity
+	}
+	src := overlay.Bounds()
+	size := src.Size()
+	if size.X == 0 || size.Y == 0 {
+		return dst
+	}
+	pos := Position(bounds, size, gravity, wm.Offset)
+	mask := image.NewUniform(color.Alpha16{uint16(max(0, min(1, wm.Opacity)) * 0xffff)})
+
+	if !wm.Tile {
+		draw.DrawMask(dst, image.Rectangle{pos, pos.Add(size)}, overlay, src.Min, mask, image.Point{}, draw.Over)
+		return dst
+	}
+	// Step back from the position to the first tile that covers the top left corner
+	start := image.Pt(
+		pos.X-(pos.X-bounds.Min.X+size.X-1)/size.X*size.X,
+		pos.Y-(pos.Y-bounds.Min.Y+size.Y-1)/size.Y*size.Y,
+	)
+	// Lay out the tiles covering the first size.Y rows, copy them down the image and
+	// composite the layer at once
+	layer := image.NewRGBA(bounds)
+	for y := start.Y; y < min(bounds.Max.Y, bounds.Min.Y+size.Y); y += size.Y {
+		for x := start.X; x < bounds.Max.X; x += size.X {
+			draw.Draw(layer, image.Rect(x, y, x+size.X, y+size.Y), overlay, src.Min, draw.Src)
+		}
+	}
+	for y := bounds.Min.Y + size.Y; y < bounds.Max.Y; y++ {
+		row := layer.PixOffset(bounds.Min.X, y)
+		copy(layer.Pix[row:row+4*bounds.Dx()], layer.Pix[row-size.Y*layer.Stride:])
+	}
+	draw.DrawMask(dst, bounds, layer, bounds.Min, mask, image.Point{}, draw.Over)
+	return dst
+}
+
+// parsePlacement parses the position of an overlay from the query parameters
+// prefix+"gravity" and prefix+"offset", given as "x,y" in pixels.
+func parsePlacement(params url.Values, prefix string) (string, image.Point, error) {
+	gravity := params.Get(prefix + "gravity")
+	if _, ok := gravities[gravity]; gravity != "" && !ok {
+		return "", image.Point{}, fmt.Errorf("invalid %sgravity: %s", prefix, gravity)
+	}
+	var offset image.Point
+	if value := params.Get(prefix + "offset"); value != "" {
+		x, y, ok := strings.Cut(value, ",")
+		var errX, errY error
+		offset.X, errX = strconv.Atoi(x)
+		offset.Y, errY = strconv.Atoi(y)
+		if !ok || errX != nil || errY != nil {
+			return "", image.Point{}, fmt.Errorf("invalid %soffset: %s", prefix, value)
+		}
+	}
+	return gravity, offset, nil
+}
+
+// parseWatermark parses the placement of a watermark from the query parameters
+// prefix+"gravity", "offset", "scale", "opacity" and "tile". The offset is given as
+// "x,y" in pixels, the scale as a fraction of the image width and the opacity between
+// 0 and 1, defaulting to 1.
+func parseWatermark(params url.Values, prefix string) (Watermark, error) {
+	gravity, offset, err := parsePlacement(params, prefix)
+	if err != nil {
+		return Watermark{}, err
+	}
+	wm := Watermark{Gravity: gravity, Offset: offset, Opacity: 1}
+	if value := params.Get(prefix + "scale"); value != "" {
+		scale, err := strconv.ParseFloat(value, 64)
+		if err != nil || !(scale > 0 && scale <= 1) {
+			return Watermark{}, fmt.Errorf("invalid %sscale: %s", prefix, value)
+		}
+		wm.Scale = scale
+	}
+	if value := params.Get(prefix + "opacity"); value != "" {
+		opacity, err := strconv.ParseFloat(value, 64)
+		if err != nil || !(opacity >= 0 && opacity <= 1) {
+			return Watermark{}, fmt.Errorf("invalid %sopacity: %s", prefix, value)
+		}
+		wm.Opacity = opacity
+	}
+	wm.Tile, err = boolParam(params.Get(prefix + "tile"))
+	if err != nil {
+		return Watermark{}, fmt.Errorf("invalid %stile: %s", prefix, params.Get(prefix+"tile"))
+	}
+	return wm, nil
+}
+
+type overlayContextKey struct{}
+
+// WithOverlay returns an http.Handler that makes overlay available to the handlers
+// of next as the watermark of requests that ask for one.
+func WithOverlay(overlay image.Image, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), overlayContextKey{}, overlay)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestOverlay returns the watermark configured with WithOverlay, or nil.
+func requestOverlay(r *http.Request) image.Image {
+	overlay, _ := r.Context().Value(overlayContextKey{}).(image.Image)
+	return overlay
+}
+
+// HandleWatermark composites a watermark over the image in the request body, or the
+// source image named by the src query parameter, after optionally scaling it. The
+// watermark is the image configured at startup, unless the request is a multipart form
+// whose "image" field holds the image and whose "watermark" field holds the overlay.
+//
+// Query Parameters:
+// - gravity: The position of the watermark, "center", "north", "south", "east", "west", "northeast",
+// "northwest", "southeast" or "southwest" (optional, defaults to "southeast").
+// - offset: The distance of the watermark from the edges it sticks to as "x,y" in pixels (optional).
+// - scale: The width of the watermark as a fraction of the image width (optional, defaults to its own size).
+// - opacity: The opacity of the watermark between 0 and 1 (optional, defaults to 1).
+// - tile: Whether to repeat the watermark across the whole image (optional).
+// - w, h: The size to scale the image to before watermarking it; either one preserves the aspect ratio (optional).
+// - format, quality and the other parameters of ParseOptions (optional).
+//
+// Responses:
+// - 400 Bad Request: If a parameter is invalid, the form is malformed, or there is no watermark.
+// - 404 Not Found: If the source image does not exist.
+// - 422 Unprocessable Entity: If the image or watermark is invalid, its format is unsupported, the crop rectangle
+// is out of bounds, the result is larger than 4096 pixels and the image in either dimension, or it does not fit
+// within max_bytes.
+// - 500 Internal Server Error: If an error occurs during watermarking.
+// - 200 OK: The watermarked image.
+func HandleWatermark(w http.ResponseWriter, r *http.Request) http.Handler {
+	// Parse query parameters
+	params := r.URL.Query()
+	wm, err := parseWatermark(params, "")
+	if err != nil {
+		return Error(http.StatusBadRequest, err)
+	}
+	width, err := dimensionParam(params.Get("w"))
+	if err != nil {
+		return Error(http.StatusBadRequest, fmt.Errorf("invalid w: %s", params.Get("w")))
+	}
+	height, err := dimensionParam(params.Get("h"))
+	if err != nil {
+		return Error(http.StatusBadRequest, fmt.Errorf("invalid h: %s", params.Get("h")))
+	}
+
+	// Parse options
+	opts, err := ParseOptions(r)
+	if err != nil {
+		return Error(http.StatusBadRequest, err)
+	}
+
+	// Open image
+	body, info, err := RequestImage(r)
+	if err != nil {
+		return SourceError(err)
+	}
+	defer body.Close()
+
+	var src io.Reader = body
+	wm.Image = requestOverlay(r)
+	mediaType, mediaParams, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if params.Get("src") == "" && mediaType == "multipart/form-data" {
+		form, err := multipart.NewReader(body, mediaParams["boundary"]).ReadForm(maxUploadSize)
+		if err != nil {
+			return Error(http.StatusBadRequest, err)
+		}
+		defer form.RemoveAll()
+
+		files := form.File["image"]
+		if len(files) == 0 {
+			return Error(http.StatusBadRequest, fmt.Errorf("missing image: image"))
+		}
+		f, err := files[0].Open()
+		if err != nil {
+			return Error(http.StatusInternalServerError, err)
+		}
+		defer f.Close()
+		src = f
+
+		if len(form.File["watermark"]) > 0 {
+			wm.Image, err = formImage(form, "watermark")
+			if err != nil {
+				return Error(http.StatusUnprocessableEntity, err)
+			}
+		}
+	}
+	if wm.Image == nil {
+		return Error(http.StatusBadRequest, ErrNoWatermark)
+	}
+	var report Report
+	opts = append(opts, WithWatermark(wm), WithReport(&report))
+
+	// Watermark image
+	watermarked, err := transformImage(r.Context(), src, width, height, opts)
+	if err == ErrInvalidImage || err == ErrCropOutOfBounds || err == ErrUnsupportedFormat || err == ErrTooLarge || err == ErrDerivativeTooLarge {
+		return Error(http.StatusUnprocessableEntity, err)
+	}
+	if err != nil {
+		return Error(http.StatusInternalServerError, err)
+	}
+
+	// Return watermarked image
+	return Image(http.StatusOK, watermarked).LastModified(info.ModTime).Encoded(report)
+}
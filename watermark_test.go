@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// watermarkRequest returns a /watermark request uploading img and, if set, overlay.
+func watermarkRequest(t *testing.T, query string, img, overlay []byte) *http.Request {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for name, data := range map[string][]byte{"image": img, "watermark": overlay} {
+		if data == nil {
+			continue
+		}
+		part, err := mw.CreateFormFile(name, name+".png")
+		assert.NoError(t, err)
+		part.Write(data)
+	}
+	assert.NoError(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/watermark?"+query, body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestPosition(t *testing.T) {
+	bounds := image.Rect(0, 0, 100, 50)
+	size := image.Pt(20, 10)
+
+	tests := []struct {
+		gravity  string
+		offset   image.Point
+		expected image.Point
+	}{
+		{gravity: "northwest", expected: image.Pt(0, 0)},
+		{gravity: "north", expected: image.Pt(40, 0)},
+		{gravity: "northeast", expected: image.Pt(80, 0)},
+		{gravity: "west", expected: image.Pt(0, 20)},
+		{gravity: "center", expected: image.Pt(40, 20)},
+		{gravity: "east", expected: image.Pt(80, 20)},
+		{gravity: "southwest", expected: image.Pt(0, 40)},
+		{gravity: "south", expected: image.Pt(40, 40)},
+		{gravity: "southeast", expected: image.Pt(80, 40)},
+		{gravity: "southeast", offset: image.Pt(5, 3), expected: image.Pt(75, 37)},
+		{gravity: "northwest", offset: image.Pt(5, 3), expected: image.Pt(5, 3)},
+		{gravity: "center", offset: image.Pt(5, 3), expected: image.Pt(45, 23)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.gravity, func(t *testing.T) {
+			assert.Equal(t, tt.expected, Position(bounds, size, tt.gravity, tt.offset))
+		})
+	}
+}
+
+func TestComposite(t *testing.T) {
+	white := color.RGBA{255, 255, 255, 255}
+	red := color.RGBA{255, 0, 0, 255}
+	base := solidImage(100, 50, white)
+	overlay := solidImage(20, 10, red)
+
+	tests := []struct {
+		name   string
+		wm     Watermark
+		red    []image.Point
+		white  []image.Point
+		blend  []image.Point
+		opaque bool
+	}{
+		{
+			name:  "Default gravity",
+			wm:    Watermark{Image: overlay, Opacity: 1},
+			red:   []image.Point{{80, 40}, {99, 49}},
+			white: []image.Point{{79, 40}, {80, 39}, {0, 0}},
+		},
+		{
+			name:  "Offset",
+			wm:    Watermark{Image: overlay, Gravity: "northwest", Offset: image.Pt(10, 5), Opacity: 1},
+			red:   []image.Point{{10, 5}, {29, 14}},
+			white: []image.Point{{9, 5}, {30, 14}, {10, 15}},
+		},
+		{
+			name:  "Scale",
+			wm:    Watermark{Image: overlay, Gravity: "northwest", Scale: 0.5, Opacity: 1},
+			red:   []image.Point{{0, 0}, {49, 24}},
+			white: []image.Point{{51, 0}, {0, 26}},
+		},
+		{
+			name:  "Opacity",
+			wm:    Watermark{Image: overlay, Gravity: "center", Opacity: 0.5},
+			blend: []image.Point{{50, 25}},
+			white: []image.Point{{0, 0}},
+		},
+		{
+			name: "Tile",
+			wm:   Watermark{Image: overlay, Gravity: "center", Opacity: 1, Tile: true},
+			red:  []image.Point{{0, 0}, {99, 49}, {50, 25}, {0, 49}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := Composite(base, tt.wm)
+			assert.Equal(t, base.Bounds(), out.Bounds())
+			at := rgbaAt(out)
+			for _, p := range tt.red {
+				assert.Equal(t, red, at(p.X, p.Y), "pixel %v", p)
+			}
+			for _, p := range tt.white {
+				assert.Equal(t, white, at(p.X, p.Y), "pixel %v", p)
+			}
+			for _, p := range tt.blend {
+				c := at(p.X, p.Y)
+				assert.Equal(t, uint8(255), c.R)
+				assert.InDelta(t, 128, int(c.G), 2)
+				assert.InDelta(t, 128, int(c.B), 2)
+			}
+		})
+	}
+
+	// The source image is left untouched
+	assert.Equal(t, white, base.RGBAAt(99, 49))
+}
+
+func TestCompositeColorModel(t *testing.T) {
+	red := solidImage(4, 4, color.RGBA{255, 0, 0, 255})
+	gray := image.NewGray(image.Rect(0, 0, 4, 4))
+	draw.Draw(gray, gray.Rect, image.NewUniform(color.Gray{100}), image.Point{}, draw.Src)
+
+	tests := []struct {
+		name     string
+		img      image.Image
+		overlay  image.Image
+		expected image.Image
+	}{
+		{name: "NRGBA", img: image.NewNRGBA(image.Rect(0, 0, 10, 10)), overlay: red, expected: &image.NRGBA{}},
+		{name: "16-bit", img: image.NewRGBA64(image.Rect(0, 0, 10, 10)), overlay: red, expected: &image.RGBA64{}},
+		{name: "Gray with gray overlay", img: image.NewGray(image.Rect(0, 0, 10, 10)), overlay: gray, expected: &image.Gray{}},
+		{name: "Gray with color overlay", img: image.NewGray(image.Rect(0, 0, 10, 10)), overlay: red, expected: &image.RGBA{}},
+		{name: "Gray16 with color overlay", img: image.NewGray16(image.Rect(0, 0, 10, 10)), overlay: red, expected: &image.RGBA64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := Composite(tt.img, Watermark{Image: tt.overlay, Gravity: "northwest", Opacity: 1})
+			assert.IsType(t, tt.expected, out)
+			assert.Equal(t, color.RGBAModel.Convert(tt.overlay.At(0, 0)), color.RGBAModel.Convert(out.At(0, 0)))
+		})
+	}
+}
+
+func TestCompositeTiles(t *testing.T) {
+	base := image.NewRGBA(image.Rect(5, 7, 50, 40))
+	for _, size := range []image.Point{{3, 2}, {1, 1}, {60, 50}} {
+		overlay := image.NewRGBA(image.Rectangle{Max: size})
+		for y := 0; y < size.Y; y++ {
+			for x := 0; x < size.X; x++ {
+				overlay.SetRGBA(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+			}
+		}
+		wm := Watermark{Image: overlay, Gravity: "center", Offset: image.Pt(1, 2), Opacity: 1, Tile: true}
+		pos := Position(base.Bounds(), size, wm.Gravity, wm.Offset)
+
+		out := Composite(base, wm)
+		at := rgbaAt(out)
+		for y := base.Rect.Min.Y; y < base.Rect.Max.Y; y++ {
+			for x := base.Rect.Min.X; x < base.Rect.Max.X; x++ {
+				u := ((x-pos.X)%size.X + size.X) % size.X
+				v := ((y-pos.Y)%size.Y + size.Y) % size.Y
+				if !assert.Equal(t, overlay.RGBAAt(u, v), at(x, y), "size %v, pixel (%d,%d)", size, x, y) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func TestLoadWatermark(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "logo.png")
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, solidImage(8, 4, color.RGBA{0, 0, 255, 255})))
+	assert.NoError(t, os.WriteFile(name, buf.Bytes(), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "logo.txt"), []byte("not an image"), 0o644))
+
+	img, err := LoadWatermark(name)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 8, 4), img.Bounds())
+
+	_, err = LoadWatermark(filepath.Join(dir, "logo.txt"))
+	assert.Error(t, err)
+	_, err = LoadWatermark(filepath.Join(dir, "missing.png"))
+	assert.Error(t, err)
+}
+
+func TestHandleWatermark(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, solidImage(100, 50, color.RGBA{255, 255, 255, 255})))
+	base := buf.Bytes()
+	buf = bytes.Buffer{}
+	assert.NoError(t, png.Encode(&buf, solidImage(20, 10, color.RGBA{255, 0, 0, 255})))
+	overlay := buf.Bytes()
+	configured := solidImage(10, 10, color.RGBA{0, 0, 255, 255})
+
+	tests := []struct {
+		name       string
+		req        *http.Request
+		configured image.Image
+		code       int
+		size       image.Point
+		corner     color.RGBA
+	}{
+		{
+			name:   "Uploaded watermark",
+			req:    watermarkRequest(t, "", base, overlay),
+			code:   http.StatusOK,
+			size:   image.Pt(100, 50),
+			corner: color.RGBA{255, 0, 0, 255},
+		},
+		{
+			name:       "Uploaded watermark overrides configured",
+			req:        watermarkRequest(t, "gravity=northwest", base, overlay),
+			configured: configured,
+			code:       http.StatusOK,
+			size:       image.Pt(100, 50),
+			corner:     color.RGBA{255, 0, 0, 255},
+		},
+		{
+			name:       "Configured watermark with form",
+			req:        watermarkRequest(t, "gravity=southeast", base, nil),
+			configured: configured,
+			code:       http.StatusOK,
+			size:       image.Pt(100, 50),
+			corner:     color.RGBA{0, 0, 255, 255},
+		},
+		{
+			name:       "Configured watermark with body",
+			req:        httptest.NewRequest(http.MethodPost, "/watermark?w=50", bytes.NewReader(base)),
+			configured: configured,
+			code:       http.StatusOK,
+			size:       image.Pt(50, 25),
+			corner:     color.RGBA{0, 0, 255, 255},
+		},
+		{
+			name:       "Too large",
+			req:        httptest.NewRequest(http.MethodPost, "/watermark?w=100000", bytes.NewReader(base)),
+			configured: configured,
+			code:       http.StatusUnprocessableEntity,
+		},
+		{
+			name: "No watermark",
+			req:  httptest.NewRequest(http.MethodPost, "/watermark", bytes.NewReader(base)),
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "Missing image",
+			req:  watermarkRequest(t, "", nil, overlay),
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "Invalid watermark",
+			req:  watermarkRequest(t, "", base, []byte("not an image")),
+			code: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "Invalid image",
+			req:  watermarkRequest(t, "", []byte("not an image"), overlay),
+			code: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "Invalid gravity",
+			req:  watermarkRequest(t, "gravity=up", base, overlay),
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "Invalid offset",
+			req:  watermarkRequest(t, "offset=5", base, overlay),
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "Invalid scale",
+			req:  watermarkRequest(t, "scale=2", base, overlay),
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "Invalid opacity",
+			req:  watermarkRequest(t, "opacity=-0.5", base, overlay),
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "Invalid tile",
+			req:  watermarkRequest(t, "tile=sometimes", base, overlay),
+			code: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			var handler http.Handler = Handler(HandleWatermark)
+			if tt.configured != nil {
+				handler = WithOverlay(tt.configured, handler)
+			}
+			handler.ServeHTTP(rr, tt.req)
+
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			img, err := png.Decode(rr.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.size, img.Bounds().Size())
+			corner := image.Pt(tt.size.X-1, tt.size.Y-1)
+			if tt.req.URL.Query().Get("gravity") == "northwest" {
+				corner = image.Point{}
+			}
+			assert.Equal(t, tt.corner, color.RGBAModel.Convert(img.At(corner.X, corner.Y)))
+		})
+	}
+}
+
+func TestParseOptionsWatermark(t *testing.T) {
+	overlay := solidImage(10, 10, color.RGBA{0, 0, 255, 255})
+
+	tests := []struct {
+		name       string
+		query      string
+		configured image.Image
+		err        bool
+		expected   *Watermark
+	}{
+		{name: "No watermark", query: "watermark=false", configured: overlay},
+		{
+			name:       "Configured watermark",
+			query:      "watermark=true&watermark_gravity=north&watermark_offset=2,-3&watermark_scale=0.25&watermark_opacity=0.5&watermark_tile=1",
+			configured: overlay,
+			expected: &Watermark{
+				Image: overlay, Gravity: "north", Offset: image.Pt(2, -3), Scale: 0.25, Opacity: 0.5, Tile: true,
+			},
+		},
+		{name: "Not configured", query: "watermark=true", err: true},
+		{name: "Invalid watermark", query: "watermark=maybe", configured: overlay, err: true},
+		{name: "Invalid gravity", query: "watermark=true&watermark_gravity=up", configured: overlay, err: true},
+		{name: "Invalid offset", query: "watermark=true&watermark_offset=a,b", configured: overlay, err: true},
+		{name: "Zero scale", query: "watermark=true&watermark_scale=0", configured: overlay, err: true},
+		{name: "Opacity above one", query: "watermark=true&watermark_opacity=1.5", configured: overlay, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/resize?"+tt.query, nil)
+			if tt.configured != nil {
+				req = req.WithContext(context.WithValue(req.Context(), overlayContextKey{}, tt.configured))
+			}
+			opts, err := ParseOptions(req)
+			assert.Equal(t, tt.err, err != nil)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, tt.expected, newOptions(opts).Watermark)
+		})
+	}
+}
+
+func TestResizeImageWatermark(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, solidImage(200, 100, color.RGBA{255, 255, 255, 255})))
+	overlay := solidImage(10, 10, color.RGBA{255, 0, 0, 255})
+
+	// The watermark keeps its size on the resized image
+	data, err := ResizeImage(context.Background(), bytes.NewReader(buf.Bytes()), 50, 100,
+		WithWatermark(Watermark{Image: overlay, Opacity: 1}))
+	assert.NoError(t, err)
+	img, err := png.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, color.RGBA{255, 0, 0, 255}, color.RGBAModel.Convert(img.At(90, 40)))
+	assert.Equal(t, color.RGBA{255, 255, 255, 255}, color.RGBAModel.Convert(img.At(89, 40)))
+}